@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/lieberdev/http/internal/http"
 )
@@ -20,7 +22,7 @@ func main() {
 	}
 
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		switch r.StatusLine.Target {
+		switch r.Target.Path {
 		case "/yourproblem":
 			w.WriteStatusLine(http.StatusBadRequest)
 			w.Headers.Set("Content-Type", "text/html")
@@ -50,11 +52,8 @@ func main() {
 				</html>`))
 			return
 		case "/cat":
-			w.WriteStatusLine(http.StatusOK)
-			w.WriteHeaders(http.Headers{
-				"Content-Type":  "image/jpeg",
-			})
-			w.WriteBody(image)
+			w.Headers.Set("Content-Type", "image/jpeg")
+			http.ServeContent(&w, r, time.Time{}, bytes.NewReader(image), int64(len(image)))
 			return
 		default:
 			w.WriteStatusLine(http.StatusOK)
@@ -0,0 +1,268 @@
+// Package hpack implements HPACK header compression for HTTP/2 (RFC 7541).
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+	ErrTruncated = errors.New("hpack: truncated header block")
+	ErrIntegerOverflow = errors.New("hpack: integer overflow")
+	ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+)
+
+const DefaultTableSize = 4096
+
+type HeaderField struct {
+	Name string
+	Value string
+	// Never added to a dynamic table by any intermediary
+	Sensitive bool
+}
+
+// Size of an entry in the dynamic table. See RFC 7541 4.1
+func (hf HeaderField) size() uint32 {
+	return uint32(len(hf.Name) + len(hf.Value) + 32)
+}
+
+type Decoder struct {
+	// Newest entry first
+	dynamic []HeaderField
+	size uint32
+	max_size uint32
+	// Limit the encoder has to respect, from SETTINGS_HEADER_TABLE_SIZE
+	allowed_max_size uint32
+	// Limit for a single string, 0 means no limit
+	MaxStringLength int
+	// Limit for the size of the decoded fields of a block, counted like
+	// SETTINGS_MAX_HEADER_LIST_SIZE. 0 means no limit. See RFC 9113 6.5.2
+	MaxHeaderListSize uint32
+}
+
+func NewDecoder(max_table_size uint32) *Decoder {
+	return &Decoder{max_size: max_table_size, allowed_max_size: max_table_size}
+}
+
+// Decodes a complete header block. A block over MaxHeaderListSize is still
+// decoded to keep the dynamic table in sync, but its fields are dropped and
+// ErrHeaderListTooLarge is returned
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	fields := []HeaderField{}
+	seen_field := false
+	list_size := uint64(0)
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b & 0x80 != 0:
+			// Indexed header field. See RFC 7541 6.1
+			idx, n, err := readInt(block, 7)
+			if err != nil { return nil, err }
+			hf, err := d.at(idx)
+			if err != nil { return nil, err }
+			fields = append(fields, hf)
+			block = block[n:]
+		case b & 0xc0 == 0x40:
+			// Literal with incremental indexing. See RFC 7541 6.2.1
+			hf, n, err := d.readLiteral(block, 6)
+			if err != nil { return nil, err }
+			d.add(hf)
+			fields = append(fields, hf)
+			block = block[n:]
+		case b & 0xe0 == 0x20:
+			// Dynamic table size update. See RFC 7541 6.3
+			if seen_field {
+				return nil, fmt.Errorf("hpack: dynamic table size update after header field")
+			}
+			size, n, err := readInt(block, 5)
+			if err != nil { return nil, err }
+			if size > uint64(d.allowed_max_size) {
+				return nil, fmt.Errorf("hpack: dynamic table size update too large: %d", size)
+			}
+			d.max_size = uint32(size)
+			d.evict()
+			block = block[n:]
+			continue
+		default:
+			// Literal without indexing or never indexed. See RFC 7541 6.2.2
+			hf, n, err := d.readLiteral(block, 4)
+			if err != nil { return nil, err }
+			hf.Sensitive = b & 0xf0 == 0x10
+			fields = append(fields, hf)
+			block = block[n:]
+		}
+		seen_field = true
+		list_size += uint64(fields[len(fields)-1].size())
+		// Fields past the limit are dropped right away, so repeated
+		// references to a large entry cost no memory
+		if d.MaxHeaderListSize > 0 && list_size > uint64(d.MaxHeaderListSize) { fields = fields[:0] }
+	}
+	if d.MaxHeaderListSize > 0 && list_size > uint64(d.MaxHeaderListSize) { return nil, ErrHeaderListTooLarge }
+	return fields, nil
+}
+
+// Changes the limit the encoder may use, e.g. after sending SETTINGS
+func (d *Decoder) SetAllowedMaxDynamicTableSize(v uint32) {
+	d.allowed_max_size = v
+}
+
+// Index 1 to 61 are static, everything after is dynamic. See RFC 7541 2.3.3
+func (d *Decoder) at(idx uint64) (HeaderField, error) {
+	if idx == 0 { return HeaderField{}, fmt.Errorf("hpack: invalid index 0") }
+	if idx <= uint64(len(staticTable)) { return staticTable[idx-1], nil }
+	idx -= uint64(len(staticTable)) + 1
+	if idx >= uint64(len(d.dynamic)) {
+		return HeaderField{}, fmt.Errorf("hpack: invalid index %d", idx + uint64(len(staticTable)) + 1)
+	}
+	return d.dynamic[idx], nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, int, error) {
+	hf := HeaderField{}
+	idx, n, err := readInt(block, prefix)
+	if err != nil { return hf, 0, err }
+
+	if idx == 0 {
+		name, m, err := d.readString(block[n:])
+		if err != nil { return hf, 0, err }
+		hf.Name = name
+		n += m
+	} else {
+		indexed, err := d.at(idx)
+		if err != nil { return hf, 0, err }
+		hf.Name = indexed.Name
+	}
+
+	value, m, err := d.readString(block[n:])
+	if err != nil { return hf, 0, err }
+	hf.Value = value
+	return hf, n + m, nil
+}
+
+// See RFC 7541 5.2
+func (d *Decoder) readString(block []byte) (string, int, error) {
+	if len(block) == 0 { return "", 0, ErrTruncated }
+	huffman := block[0] & 0x80 != 0
+	length, n, err := readInt(block, 7)
+	if err != nil { return "", 0, err }
+	if uint64(len(block) - n) < length { return "", 0, ErrTruncated }
+	if d.MaxStringLength > 0 && length > uint64(d.MaxStringLength) {
+		return "", 0, fmt.Errorf("hpack: string exceeds %d bytes", d.MaxStringLength)
+	}
+
+	data := block[n : n+int(length)]
+	if !huffman { return string(data), n + int(length), nil }
+	s, err := huffmanDecode(data)
+	if err != nil { return "", 0, err }
+	if d.MaxStringLength > 0 && len(s) > d.MaxStringLength {
+		return "", 0, fmt.Errorf("hpack: string exceeds %d bytes", d.MaxStringLength)
+	}
+	return s, n + int(length), nil
+}
+
+// See RFC 7541 4.4
+func (d *Decoder) add(hf HeaderField) {
+	d.dynamic = append([]HeaderField{hf}, d.dynamic...)
+	d.size += hf.size()
+	d.evict()
+}
+
+func (d *Decoder) evict() {
+	for d.size > d.max_size && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// Encodes header fields without using the dynamic table, so the encoder
+// holds no state apart from pending table size updates
+type Encoder struct {
+	pending_size_update bool
+	max_size uint32
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// Must be called when the peer changes SETTINGS_HEADER_TABLE_SIZE. The
+// update is sent at the start of the next header block
+func (e *Encoder) SetMaxDynamicTableSize(v uint32) {
+	e.pending_size_update = true
+	e.max_size = v
+}
+
+// Appends the header block for fields to dst
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pending_size_update {
+		// Our table is always empty, so the smallest size is fine
+		dst = appendInt(dst, 0x20, 5, 0)
+		e.pending_size_update = false
+	}
+
+	for _, hf := range fields {
+		name_idx := 0
+		for i, static := range staticTable {
+			if static.Name != hf.Name { continue }
+			if static.Value == hf.Value && !hf.Sensitive {
+				name_idx = -(i + 1)
+				break
+			}
+			if name_idx == 0 { name_idx = i + 1 }
+		}
+
+		if name_idx < 0 {
+			dst = appendInt(dst, 0x80, 7, uint64(-name_idx))
+			continue
+		}
+		first := byte(0x00)
+		if hf.Sensitive { first = 0x10 }
+		dst = appendInt(dst, first, 4, uint64(name_idx))
+		if name_idx == 0 { dst = appendString(dst, hf.Name) }
+		dst = appendString(dst, hf.Value)
+	}
+	return dst
+}
+
+// Uses Huffman coding if it is shorter
+func appendString(dst []byte, s string) []byte {
+	huffman_len := huffmanEncodedLen(s)
+	if huffman_len < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(huffman_len))
+		return appendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// See RFC 7541 5.1
+func appendInt(dst []byte, first byte, prefix uint8, v uint64) []byte {
+	max := uint64(1) << prefix - 1
+	if v < max { return append(dst, first | byte(v)) }
+	dst = append(dst, first | byte(max))
+	v -= max
+	for v >= 128 {
+		dst = append(dst, byte(v % 128) | 0x80)
+		v /= 128
+	}
+	return append(dst, byte(v))
+}
+
+func readInt(data []byte, prefix uint8) (uint64, int, error) {
+	if len(data) == 0 { return 0, 0, ErrTruncated }
+	max := uint64(1) << prefix - 1
+	v := uint64(data[0]) & max
+	if v < max { return v, 1, nil }
+
+	shift := 0
+	for i := 1; i < len(data); i++ {
+		b := data[i]
+		if shift > 56 { return 0, 0, ErrIntegerOverflow }
+		v += uint64(b & 0x7f) << shift
+		shift += 7
+		if b & 0x80 == 0 { return v, i + 1, nil }
+	}
+	return 0, 0, ErrTruncated
+}
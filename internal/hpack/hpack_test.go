@@ -0,0 +1,119 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return data
+}
+
+func TestDecodeRequestsWithHuffman(t *testing.T) {
+	// Examples from RFC 7541 C.4, the dynamic table carries over
+	d := NewDecoder(DefaultTableSize)
+
+	fields, err := d.Decode(decodeHex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}, fields)
+
+	fields, err = d.Decode(decodeHex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":authority", Value: "www.example.com"}, fields[3])
+	assert.Equal(t, HeaderField{Name: "cache-control", Value: "no-cache"}, fields[4])
+
+	fields, err = d.Decode(decodeHex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":scheme", Value: "https"}, fields[1])
+	assert.Equal(t, HeaderField{Name: ":path", Value: "/index.html"}, fields[2])
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+	assert.Equal(t, uint32(164), d.size)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// Test: Index 0
+	_, err := NewDecoder(DefaultTableSize).Decode([]byte{0x80})
+	require.Error(t, err)
+
+	// Test: Index past the dynamic table
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0xbe})
+	require.Error(t, err)
+
+	// Test: Truncated string
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0x40, 0x05, 'a'})
+	require.ErrorIs(t, err, ErrTruncated)
+
+	// Test: Table size update above the limit
+	_, err = NewDecoder(DefaultTableSize).Decode(decodeHex(t, "3fe2 1f"))
+	require.Error(t, err)
+
+	// Test: Table size update after a field
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0x82, 0x20})
+	require.Error(t, err)
+
+	// Test: Huffman padding longer than 7 bits
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0x00, 0x81, 'a', 0x82, 0xff, 0xff})
+	require.ErrorIs(t, err, ErrInvalidHuffman)
+
+	// Test: Integer overflow
+	_, err = NewDecoder(DefaultTableSize).Decode(decodeHex(t, "ff ffff ffff ffff ffff ffff 7f"))
+	require.ErrorIs(t, err, ErrIntegerOverflow)
+
+	// Test: Header list over the limit, repeating an indexed large entry
+	d := NewDecoder(DefaultTableSize)
+	d.MaxHeaderListSize = 16 << 10
+	block := appendInt(nil, 0x40, 6, 0)
+	block = appendString(block, "x-large")
+	block = appendString(block, strings.Repeat("a", 1000))
+	block = append(block, bytes.Repeat([]byte{0xbe}, 100)...)
+	_, err = d.Decode(block)
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+	// The dynamic table was still updated
+	fields, err := d.Decode([]byte{0xbe})
+	require.NoError(t, err)
+	assert.Equal(t, "x-large", fields[0].Name)
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: ":status", Value: "418"},
+		{Name: "content-type", Value: "text/html"},
+		{Name: "x-custom", Value: "some value that is long enough for huffman"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+		{Name: "empty", Value: ""},
+	}
+	e := NewEncoder()
+	e.SetMaxDynamicTableSize(0)
+	block := e.Encode(nil, fields)
+	// Indexed :status 200 comes right after the table size update
+	assert.Equal(t, []byte{0x20, 0x88}, block[:2])
+
+	decoded, err := NewDecoder(DefaultTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+}
+
+func TestIntegers(t *testing.T) {
+	// Examples from RFC 7541 C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 0, 5, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 0, 8, 42))
+
+	v, n, err := readInt([]byte{0x1f, 0x9a, 0x0a}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), v)
+	assert.Equal(t, 3, n)
+}
@@ -0,0 +1,75 @@
+package hpack
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	// -1 for inner nodes
+	sym int
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{sym: -1}
+	for sym, code := range huffmanCodes {
+		node := root
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := (code >> i) & 1
+			if node.children[bit] == nil { node.children[bit] = &huffmanNode{sym: -1} }
+			node = node.children[bit]
+		}
+		node.sym = sym
+	}
+	return root
+}
+
+// Padding has to be shorter than 8 bits and consist of ones, which also
+// rules out EOS. See RFC 7541 5.2
+func huffmanDecode(data []byte) (string, error) {
+	out := make([]byte, 0, len(data) * 8 / 5)
+	node := huffmanRoot
+	pending_bits := 0
+	all_ones := true
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			node = node.children[bit]
+			if node == nil { return "", ErrInvalidHuffman }
+			pending_bits++
+			if bit == 0 { all_ones = false }
+			if node.sym >= 0 {
+				out = append(out, byte(node.sym))
+				node = huffmanRoot
+				pending_bits = 0
+				all_ones = true
+			}
+		}
+	}
+	if pending_bits > 7 || !all_ones { return "", ErrInvalidHuffman }
+	return string(out), nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ { bits += int(huffmanCodeLen[s[i]]) }
+	return (bits + 7) / 8
+}
+
+func appendHuffman(dst []byte, s string) []byte {
+	x := uint64(0)
+	n := 0
+	for i := 0; i < len(s); i++ {
+		l := int(huffmanCodeLen[s[i]])
+		x = x << l | uint64(huffmanCodes[s[i]])
+		n += l
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(x >> n))
+		}
+	}
+	// Pad with the most significant bits of EOS, which are all ones
+	if n > 0 {
+		x = x << (8 - n) | (1 << (8 - n) - 1)
+		dst = append(dst, byte(x))
+	}
+	return dst
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
+	"math"
 	"sync/atomic"
 )
 
@@ -13,109 +13,181 @@ type chunkedBodyState int
 const (
 	readChunkSize chunkedBodyState = iota
 	readChunk
+	readTrailers
 )
 
 type body struct {
+	// Closed by Close, reads go through rb
 	rc io.ReadCloser
-	buf []byte
-	unconsumed_bytes int
+	// Shared with the parser, which may have read part of the body already
+	rb *readBuffer
 	content_length int
 	closed atomic.Bool
 	eof bool
 	total_consumed_bytes int
+	// Called once when the end of the body is reached
+	on_eof func()
+	// The body ends when rc does, only for responses. See RFC 9112 6.3
+	until_eof bool
 	// Needed for chunked body parsing
 	is_chunked bool
 	chunk_size int
 	consumed_chunk_bytes int
 	cb_state chunkedBodyState
+	trailers Headers
+	trailers_size int
 }
 
 func (b *body) Read(data []byte) (int, error) {
 	if b.closed.Load() { return 0, io.ErrClosedPipe }
-	if b.eof { return 0, io.EOF }
+	if len(data) == 0 { return 0, nil }
 
 	for {
-		// Check if buffer is full
-		if len(b.buf) == b.unconsumed_bytes { b.buf = grow(b.buf) }
-
-		n, err := b.rc.Read(b.buf[b.unconsumed_bytes:])
-		if errors.Is(err, io.EOF) {
-			b.eof = true
-			break
-		} else if err != nil { 
-			return 0, err
+		if b.eof {
+			if b.on_eof != nil {
+				on_eof := b.on_eof
+				b.on_eof = nil
+				on_eof()
+			}
+			return 0, io.EOF
 		}
-		b.unconsumed_bytes += n
 
+		// Consume what is already buffered before reading more
 		consumed_bytes := 0
-		err = error(nil)
+		err := error(nil)
 		if b.is_chunked {
 			consumed_bytes, err = b.parseChunked(data)
+		} else if b.until_eof {
+			consumed_bytes = b.parseUntilEOF(data)
 		} else {
 			consumed_bytes, err = b.parseFixed(data)
 		}
 		if err != nil { return 0, err }
-		if consumed_bytes != 0 { 
-			return consumed_bytes, nil
+		if consumed_bytes != 0 { return consumed_bytes, nil }
+		if b.eof { continue }
+
+		// Chunk size lines and trailers are bounded like a head
+		if b.is_chunked && len(b.rb.buffered()) >= maxHeadSize { return 0, errHeadTooLarge }
+		err = b.rb.fill()
+		if errors.Is(err, io.EOF) {
+			if !b.until_eof { return 0, io.ErrUnexpectedEOF }
+		} else if err != nil {
+			return 0, err
 		}
 	}
-	return 0, nil
+}
+
+// Reports if the whole body has been consumed
+func (b *body) done() bool {
+	return b.eof || (!b.is_chunked && !b.until_eof && b.total_consumed_bytes == b.content_length)
 }
 
 func (b *body) parseFixed(data []byte) (int, error) {
-	// uncosmumed_bytes can still be smaller if EOF was reached
-	consumed_bytes := min(b.unconsumed_bytes, len(data))
-	// Also do not consume more bytes than the content length
+	// Do not consume more bytes than the content length
 	remaining_bytes := b.content_length - b.total_consumed_bytes
-	if remaining_bytes <= consumed_bytes {
-		consumed_bytes = remaining_bytes
+	if remaining_bytes == 0 {
 		b.eof = true
+		return 0, nil
 	}
-	copy(data, b.buf[:consumed_bytes])
-	copy(b.buf, b.buf[consumed_bytes:])
-	b.unconsumed_bytes -= consumed_bytes
+	consumed_bytes := copy(data[:min(len(data), remaining_bytes)], b.rb.buffered())
+	b.rb.consume(consumed_bytes)
 	b.total_consumed_bytes += consumed_bytes
+	if b.total_consumed_bytes == b.content_length { b.eof = true }
 	return consumed_bytes, nil
 }
 
+func (b *body) parseUntilEOF(data []byte) int {
+	if len(b.rb.buffered()) == 0 && b.rb.eof {
+		b.eof = true
+		return 0
+	}
+	consumed_bytes := copy(data, b.rb.buffered())
+	b.rb.consume(consumed_bytes)
+	b.total_consumed_bytes += consumed_bytes
+	return consumed_bytes
+}
+
+// See RFC 9112 7.1
 func (b *body) parseChunked(data []byte) (int, error) {
-	idx := bytes.Index(b.buf[:b.unconsumed_bytes], []byte("\r\n"))
-	if idx == -1 { return 0, nil }
+	for {
+		switch b.cb_state {
+		case readChunkSize:
+			buffered := b.rb.buffered()
+			idx := bytes.Index(buffered, []byte("\r\n"))
+			if idx == -1 { return 0, nil }
 
-	switch b.cb_state {
-	case readChunkSize:
-		size, err := strconv.ParseInt(string(b.buf[:idx]), 16, 64)
-		if err != nil { return 0, err }
-		b.chunk_size = int(size)
-		b.cb_state = readChunk
-		copy(b.buf, b.buf[idx+2:])
-		b.unconsumed_bytes -= idx+2
-		return 0, nil
-	case readChunk:
-		remaining_bytes := b.chunk_size - b.consumed_chunk_bytes
-		if remaining_bytes != idx {
-			return 0, fmt.Errorf("Sent chunk size is different than chunk len")
+			// Chunk extensions are ignored
+			size_field, _, _ := bytes.Cut(buffered[:idx], []byte(";"))
+			size, ok := parseChunkSize(bytes.TrimSpace(size_field))
+			if !ok {
+				return 0, fmt.Errorf("Invalid chunk size: '%s'", size_field)
+			}
+			b.rb.consume(idx+2)
+			if size == 0 {
+				b.cb_state = readTrailers
+				continue
+			}
+			b.chunk_size = int(size)
+			b.consumed_chunk_bytes = 0
+			b.cb_state = readChunk
+		case readChunk:
+			remaining_bytes := b.chunk_size - b.consumed_chunk_bytes
+			if remaining_bytes == 0 {
+				// Chunk data is followed by crlf
+				if len(b.rb.buffered()) < 2 { return 0, nil }
+				if !bytes.HasPrefix(b.rb.buffered(), []byte("\r\n")) {
+					return 0, fmt.Errorf("Sent chunk size is different than chunk len")
+				}
+				b.rb.consume(2)
+				b.cb_state = readChunkSize
+				continue
+			}
+
+			// Read only part of chunk if needed
+			consumed_bytes := copy(data[:min(len(data), remaining_bytes)], b.rb.buffered())
+			if consumed_bytes == 0 { return 0, nil }
+			b.rb.consume(consumed_bytes)
+			b.consumed_chunk_bytes += consumed_bytes
+			b.total_consumed_bytes += consumed_bytes
+			return consumed_bytes, nil
+		case readTrailers:
+			if b.trailers == nil { b.trailers = Headers{} }
+			n, done, err := b.trailers.parse(b.rb.buffered())
+			if err != nil { return 0, err }
+			if n == 0 { return 0, nil }
+			b.rb.consume(n)
+			b.trailers_size += n
+			if b.trailers_size >= maxHeadSize { return 0, errHeadTooLarge }
+			if done {
+				b.eof = true
+				return 0, nil
+			}
+		default:
+			return 0, fmt.Errorf("Unknown chunked body state: %d", b.cb_state)
 		}
+	}
+}
 
-		// Read only part of chunk
-		if len(data) < remaining_bytes {
-			copy(data, b.buf[:len(data)])
-			copy(b.buf, b.buf[len(data):])
-			b.unconsumed_bytes -= len(data)
-			b.consumed_chunk_bytes += len(data)
-			return len(data), nil
-		} else {
-			copy(data, b.buf[:remaining_bytes])
-			copy(b.buf, b.buf[remaining_bytes+2:])
-			b.unconsumed_bytes -= remaining_bytes + 2
-			// Finished consuming chunk
-			b.consumed_chunk_bytes = 0
-			b.cb_state = readChunkSize
-			return remaining_bytes, nil
+// chunk-size = 1*HEXDIG. See RFC 9112 7.1
+func parseChunkSize(s []byte) (int, bool) {
+	if len(s) == 0 { return 0, false }
+	size := 0
+	for _, c := range s {
+		digit := 0
+		switch {
+		case c >= '0' && c <= '9':
+			digit = int(c - '0')
+		case c >= 'a' && c <= 'f':
+			digit = int(c - 'a' + 10)
+		case c >= 'A' && c <= 'F':
+			digit = int(c - 'A' + 10)
+		default:
+			return 0, false
 		}
-	default:
-		return 0, fmt.Errorf("Unknown chunked body state: %d", b.cb_state)
+		if size > math.MaxInt >> 4 { return 0, false }
+		size = size << 4 | digit
 	}
+	return size, true
 }
 
 func (b *body) Close() error {
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Initial size of read buffers, they grow for larger messages
+const buffer_size = 4096
+
+// Limit for the start line and fields of a message, interim responses
+// included. A head whose end is not found within it is rejected instead of
+// buffered. Repeated fields are joined into one string, so parsing time
+// grows with its square
+const maxHeadSize = 64 << 10
+
+var errHeadTooLarge = errors.New("Message head is too large")
+
+// Read buffers of server connections, returned when the connection closes
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, buffer_size)
+		return &buf
+	},
+}
+
+// Response writers of server connections
+var writerPool = sync.Pool{
+	New: func() any { return bufio.NewWriterSize(nil, buffer_size) },
+}
+
+// Buffered reader shared by the parser and the body of a message. Parsing
+// works on slices of buf, bytes are only moved when buf is full
+type readBuffer struct {
+	rd io.Reader
+	buf []byte
+	// buf[start:end] has been read but not consumed yet
+	start int
+	end int
+	// rd has no more data, only buf is left
+	eof bool
+}
+
+func (rb *readBuffer) buffered() []byte {
+	return rb.buf[rb.start:rb.end]
+}
+
+func (rb *readBuffer) consume(n int) {
+	rb.start += n
+	if rb.start == rb.end { rb.start, rb.end = 0, 0 }
+}
+
+// Reads once from rd. When buf is full the unconsumed bytes are moved to
+// the front or, if they fill all of it, buf grows. Returns io.EOF once rd
+// has no more data
+func (rb *readBuffer) fill() error {
+	if rb.eof { return io.EOF }
+	if rb.end == len(rb.buf) {
+		if rb.start > 0 {
+			rb.end = copy(rb.buf, rb.buf[rb.start:rb.end])
+			rb.start = 0
+		} else {
+			rb.buf = grow(rb.buf)
+		}
+	}
+
+	n, err := rb.rd.Read(rb.buf[rb.end:])
+	rb.end += n
+	if errors.Is(err, io.EOF) {
+		rb.eof = true
+		if n > 0 { return nil }
+	}
+	return err
+}
+
+// Strings that are the same for most requests. Parsing takes them from
+// here instead of allocating
+var commonStrings = func() map[string]string {
+	strs := map[string]string{}
+	for _, s := range []string{
+		"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH",
+		"HTTP/1.1", "HTTP/1.0", "/", "*",
+		"accept", "accept-encoding", "accept-language", "authorization", "cache-control",
+		"connection", "content-length", "content-type", "cookie", "host", "if-modified-since",
+		"if-none-match", "origin", "pragma", "range", "referer", "te", "transfer-encoding",
+		"upgrade", "user-agent", "x-forwarded-for", "x-forwarded-proto", "x-request-id",
+		"close", "keep-alive", "chunked", "*/*", "gzip", "gzip, deflate", "gzip, deflate, br",
+		"no-cache", "0",
+	} {
+		strs[s] = s
+	}
+	return strs
+}()
+
+// Keep the strings of a connection from growing without bound
+const (
+	maxTableStrings = 64
+	maxTableStringLen = 1024
+)
+
+// Strings seen on a connection. Clients send mostly the same target and
+// field values with every request, e.g. Host and User-Agent, so they are
+// only allocated once. A nil table only uses commonStrings
+type stringTable struct {
+	strs map[string]string
+}
+
+func (st *stringTable) str(b []byte) string {
+	if s, ok := commonStrings[string(b)]; ok { return s }
+	if st == nil { return string(b) }
+	if s, ok := st.strs[string(b)]; ok { return s }
+
+	s := string(b)
+	if st.strs == nil { st.strs = map[string]string{} }
+	if len(st.strs) < maxTableStrings && len(s) <= maxTableStringLen { st.strs[s] = s }
+	return s
+}
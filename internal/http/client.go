@@ -0,0 +1,316 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultMaxRedirects = 10
+
+// Returned by CheckRedirect to stop following redirects. Do then returns
+// the redirect response with its body unread
+var ErrUseLastResponse = errors.New("Use last response")
+
+// Sends requests over HTTP/1.1 and reads the responses with the same parser
+// the server uses
+type Client struct {
+	// Limit for a whole exchange, from connecting until the response body
+	// is read. Zero means no limit besides the context
+	Timeout time.Duration
+	// Manages connections. Defaults to DefaultTransport
+	Transport *Transport
+	// Called before a redirect is followed with the next request and the
+	// ones sent so far, oldest first. An error stops following redirects
+	CheckRedirect func(req *Request, via []*Request) error
+	// Defaults to DefaultMaxRedirects
+	MaxRedirects int
+	// Stores cookies from responses and sends them with later requests.
+	// nil disables cookies
+	Jar *CookieJar
+}
+
+var DefaultTransport = &Transport{}
+
+// Creates a request for the client. A body with a Len method, e.g.
+// *bytes.Reader or *strings.Reader, is sent with Content-Length, any other
+// body is sent chunked. Trailers can be set before Do is called
+func NewRequest(method string, url string, body io.Reader) (*Request, error) {
+	if method == "" || !isUpper(method) { return nil, fmt.Errorf("Invalid method: '%s'", method) }
+	target, err := parseRequestTarget(method, url)
+	if err != nil { return nil, err }
+	if target.Form != AbsoluteForm || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, fmt.Errorf("Request needs an http or https URL: '%s'", url)
+	}
+
+	r := &Request{
+		StatusLine: StatusLine{Method: method, Target: url, Version: "HTTP/1.1"},
+		Target: target,
+		Headers: Headers{},
+		Proto: "HTTP/1.1",
+		state: Done,
+	}
+	r.Headers.Set("Host", target.Authority)
+	if body == nil { return r, nil }
+	if sized, ok := body.(interface{ Len() int }); ok {
+		r.Headers.Set("Content-Length", strconv.Itoa(sized.Len()))
+	}
+	switch b := body.(type) {
+	case *bytes.Reader:
+		snapshot := *b
+		r.GetBody = func() (io.ReadCloser, error) {
+			copied := snapshot
+			return io.NopCloser(&copied), nil
+		}
+	case *strings.Reader:
+		snapshot := *b
+		r.GetBody = func() (io.ReadCloser, error) {
+			copied := snapshot
+			return io.NopCloser(&copied), nil
+		}
+	case *bytes.Buffer:
+		data := b.Bytes()
+		r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	}
+	rc, ok := body.(io.ReadCloser)
+	if !ok { rc = io.NopCloser(body) }
+	r.Body = rc
+	return r, nil
+}
+
+// Sends the request and reads the response headers, following redirects.
+// The body is read from the returned response and has to be closed, which
+// frees the connection for the next request. ctx and Timeout cover all
+// redirects and reading the body as well
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	if req.Target.Form != AbsoluteForm {
+		return nil, fmt.Errorf("Request needs an absolute URL: '%s'", req.StatusLine.Target)
+	}
+	cancel := context.CancelFunc(func() {})
+	if c.Timeout > 0 { ctx, cancel = context.WithTimeout(ctx, c.Timeout) }
+	t := c.Transport
+	if t == nil { t = DefaultTransport }
+	max_redirects := c.MaxRedirects
+	if max_redirects <= 0 { max_redirects = DefaultMaxRedirects }
+
+	via := []*Request{}
+	for {
+		out := req
+		if c.Jar != nil { out = c.Jar.addCookies(req) }
+		// The context has to outlive the bodies of redirect responses
+		following := false
+		resp, err := t.roundTrip(ctx, out, func() { if !following { cancel() } })
+		if err != nil { return nil, err }
+		if c.Jar != nil { c.Jar.SetCookies(req.Target, resp.Headers.Values("set-cookie")) }
+
+		next, err := redirectRequest(req, resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if next == nil { return resp, nil }
+		via = append(via, req)
+		if len(via) > max_redirects {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Stopped after %d redirects", max_redirects)
+		}
+		if c.CheckRedirect != nil {
+			if err := c.CheckRedirect(next, via); err != nil {
+				if errors.Is(err, ErrUseLastResponse) { return resp, nil }
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+
+		// A short body is read, so the connection can be reused
+		following = true
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4 * 1024))
+		resp.Body.Close()
+		req = next
+	}
+}
+
+// Builds the request for a redirect response. Returns nil if the response
+// is no redirect, has no Location or the body can not be sent again.
+// See RFC 9110 15.4
+func redirectRequest(req *Request, resp *Response) (*Request, error) {
+	method := req.StatusLine.Method
+	keep_body := true
+	switch resp.StatusCode {
+	case StatusMovedPermanently, StatusFound:
+		// Historically POST becomes GET. See RFC 9110 15.4.2 and 15.4.3
+		if method == "POST" {
+			method = "GET"
+			keep_body = false
+		}
+	case StatusSeeOther:
+		if method != "HEAD" { method = "GET" }
+		keep_body = false
+	case StatusTemporaryRedirect, StatusPermanentRedirect:
+	default:
+		return nil, nil
+	}
+	location := resp.Headers.Get("location")
+	if location == "" { return nil, nil }
+	if keep_body && req.Body != nil && req.GetBody == nil { return nil, nil }
+
+	// Location can be relative to the request URL. See RFC 9110 10.2.2
+	base, err := url.Parse(req.StatusLine.Target)
+	if err != nil { return nil, err }
+	target, err := base.Parse(location)
+	if err != nil { return nil, fmt.Errorf("Invalid Location: '%s'", location) }
+	target.Fragment = ""
+	target.RawFragment = ""
+	next, err := NewRequest(method, target.String(), nil)
+	if err != nil { return nil, err }
+
+	old_key, _ := poolKey(req.Target)
+	new_key, _ := poolKey(next.Target)
+	cross_origin := !strings.EqualFold(old_key, new_key)
+	for name, value := range req.Headers {
+		switch name {
+		case "host":
+			continue
+		case "authorization", "cookie":
+			// Credentials are not leaked to another origin
+			if cross_origin { continue }
+		case "content-length", "content-type", "content-encoding", "content-language", "content-location", "transfer-encoding":
+			if !keep_body { continue }
+		}
+		next.Headers.Set(name, value)
+	}
+	if keep_body && req.Body != nil {
+		next.Body, err = req.GetBody()
+		if err != nil { return nil, err }
+		next.GetBody = req.GetBody
+		next.Trailers = req.Trailers
+	}
+	return next, nil
+}
+
+// Serializes the request in the form of its target, e.g. to send it on to
+// another server. Without Content-Length a body is sent chunked and
+// followed by the trailers, unless it turns out to be empty.
+// See RFC 9112 3, 6 and 7.1
+func (r *Request) Write(dst io.Writer) error {
+	if err := r.validate(); err != nil { return err }
+	headers := Headers{}
+	for name, value := range r.Headers { headers.Set(name, value) }
+	delete(headers, "transfer-encoding")
+	// Trailers are only sent with a chunked body
+	trailer := headers.Get("trailer")
+	delete(headers, "trailer")
+
+	content_length, err := strconv.ParseInt(headers.Get("content-length"), 10, 64)
+	has_length := err == nil && content_length >= 0
+	first := []byte{}
+	chunked := false
+	if !has_length && r.Body != nil {
+		delete(headers, "content-length")
+		buf := make([]byte, 32 * 1024)
+		n, err := r.Body.Read(buf)
+		for n == 0 && err == nil { n, err = r.Body.Read(buf) }
+		if err != nil && !errors.Is(err, io.EOF) { return err }
+		first = buf[:n]
+		chunked = n > 0
+		if chunked {
+			headers.Set("Transfer-Encoding", "chunked")
+			if trailer != "" { headers.Set("Trailer", trailer) }
+		}
+	}
+
+	target := r.Target.Path
+	switch r.Target.Form {
+	case AuthorityForm:
+		target = r.Target.Authority
+	case AsteriskForm:
+	default:
+		if target == "" { target = "/" }
+		if r.Target.RawQuery != "" { target += "?" + r.Target.RawQuery }
+	}
+	bw := bufio.NewWriter(dst)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", r.StatusLine.Method, target)
+	for name := range headers {
+		for _, value := range headers.Values(name) { fmt.Fprintf(bw, "%s: %s\r\n", name, value) }
+	}
+	bw.WriteString("\r\n")
+
+	if !chunked {
+		if has_length && content_length > 0 {
+			if r.Body == nil { return fmt.Errorf("Request has Content-Length but no body") }
+			n, err := io.Copy(bw, io.LimitReader(r.Body, content_length))
+			if err != nil { return err }
+			if n != content_length {
+				return fmt.Errorf("Body is shorter than Content-Length: %d of %d bytes", n, content_length)
+			}
+		}
+		return bw.Flush()
+	}
+
+	cw := &chunkWriter{bw}
+	if _, err := cw.Write(first); err != nil { return err }
+	if _, err := io.Copy(cw, r.Body); err != nil { return err }
+	bw.WriteString("0\r\n")
+	for name, value := range r.Trailers { fmt.Fprintf(bw, "%s: %s\r\n", name, value) }
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// Frames every write as one chunk. See RFC 9112 7.1
+// Checks what Write puts on the wire, like the server parser does, so
+// values built from user input can not add lines or a second request.
+// See RFC 9110 5.5 and RFC 9112 3
+func (r *Request) validate() error {
+	if r.StatusLine.Method == "" || !isValidHeaderName(r.StatusLine.Method) {
+		return fmt.Errorf("Invalid method: %q", r.StatusLine.Method)
+	}
+	for _, part := range []string{r.Target.Authority, r.Target.Path, r.Target.RawQuery} {
+		if strings.ContainsFunc(part, func(c rune) bool { return c <= ' ' || c == 0x7f }) {
+			return fmt.Errorf("Invalid character in request-target: %q", part)
+		}
+	}
+	for _, fields := range []Headers{r.Headers, r.Trailers} {
+		for name, value := range fields {
+			if name == "" || !isValidHeaderName(name) { return fmt.Errorf("Invalid header name: %q", name) }
+			// Set-Cookie values are joined with newlines and sent as lines
+			// of their own
+			if strings.EqualFold(name, "set-cookie") { value = strings.ReplaceAll(value, "\n", "") }
+			if !isValidHeaderValue(value) {
+				return fmt.Errorf("Invalid character in value of header '%s': %q", name, value)
+			}
+		}
+	}
+	return nil
+}
+
+type chunkWriter struct {
+	w *bufio.Writer
+}
+
+func (cw *chunkWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 { return 0, nil }
+	fmt.Fprintf(cw.w, "%x\r\n", len(data))
+	cw.w.Write(data)
+	_, err := cw.w.WriteString("\r\n")
+	if err != nil { return 0, err }
+	return len(data), nil
+}
+
+// Prefers the context error, since closing the connection on cancellation
+// only surfaces as a closed connection
+func contextError(ctx context.Context, err error) error {
+	if ctx_err := ctx.Err(); ctx_err != nil { return fmt.Errorf("%w: %v", ctx_err, err) }
+	return err
+}
+
+func trimBrackets(host string) string {
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' { return host[1:len(host)-1] }
+	return host
+}
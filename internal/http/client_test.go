@@ -0,0 +1,372 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		data, _ := io.ReadAll(r.Body)
+		w.WriteStatusLine(StatusOK)
+		w.Headers.Set("Content-Type", "text/plain")
+		w.Headers.Set("X-Method", r.StatusLine.Method)
+		w.Headers.Set("X-Target", r.StatusLine.Target)
+		w.Headers.Set("X-Content-Length", r.Headers.Get("content-length"))
+		w.Headers.Set("X-Transfer-Encoding", r.Headers.Get("transfer-encoding"))
+		switch r.Target.Path {
+		case "/chunked":
+			w.Headers.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(nil)
+			w.WriteTrailers(Headers{"x-checksum": "sum-" + r.Trailers.Get("x-checksum")})
+			w.WriteChunkedBody(data)
+			w.WriteChunkedBodyDone()
+		case "/slow":
+			w.Headers.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(nil)
+			w.WriteChunkedBody([]byte("a"))
+			w.Flush()
+			<-block
+		default:
+			w.WriteHeaders(nil)
+			w.WriteBody(data)
+		}
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	base := "http://" + srv.Listener.Addr().String()
+	client := &Client{}
+
+	do := func(client *Client, method string, url string, body io.Reader) (*Response, string) {
+		req, err := NewRequest(method, url, body)
+		require.NoError(t, err)
+		resp, err := client.Do(context.Background(), req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data)
+	}
+
+	t.Run("Fixed Length", func(t *testing.T) {
+		resp, data := do(client, "POST", base + "/echo?q=1", strings.NewReader("hello"))
+		assert.Equal(t, StatusOK, resp.StatusCode)
+		assert.Equal(t, "OK", resp.Reason)
+		assert.Equal(t, "HTTP/1.1", resp.Version)
+		assert.Equal(t, "/echo?q=1", resp.Headers.Get("x-target"))
+		assert.Equal(t, "5", resp.Headers.Get("x-content-length"))
+		assert.Equal(t, "hello", data)
+	})
+
+	t.Run("Chunked Body and Trailers", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("hello "))
+			pw.Write([]byte("world"))
+			pw.Close()
+		}()
+		req, err := NewRequest("PUT", base + "/chunked", pr)
+		require.NoError(t, err)
+		req.Trailers = Headers{"x-checksum": "abc"}
+		resp, err := client.Do(context.Background(), req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "chunked", resp.Headers.Get("x-transfer-encoding"))
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(data))
+		assert.Equal(t, "sum-abc", resp.Trailers.Get("x-checksum"))
+	})
+
+	t.Run("Empty Body", func(t *testing.T) {
+		resp, data := do(client, "POST", base + "/", io.NopCloser(strings.NewReader("")))
+		assert.Empty(t, resp.Headers.Get("x-transfer-encoding"))
+		assert.Empty(t, data)
+	})
+
+	t.Run("Close Delimited", func(t *testing.T) {
+		address := rawBackend(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end")
+		resp, data := do(client, "GET", "http://" + address + "/", nil)
+		assert.Equal(t, "HTTP/1.0", resp.Version)
+		assert.Equal(t, "until the end", data)
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		address := rawBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n")
+		resp, data := do(client, "HEAD", "http://" + address + "/", nil)
+		assert.Equal(t, "5", resp.Headers.Get("content-length"))
+		assert.Empty(t, data)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil { return }
+			<-block
+			conn.Close()
+		}()
+		req, err := NewRequest("GET", "http://" + listener.Addr().String() + "/", nil)
+		require.NoError(t, err)
+		_, err = (&Client{Timeout: 50 * time.Millisecond}).Do(context.Background(), req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// The deadline also covers the body
+		req, err = NewRequest("GET", base + "/slow", nil)
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+		defer cancel()
+		resp, err := client.Do(ctx, req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("HTTPS", func(t *testing.T) {
+		cert_file, key_file, cert := generateCert(t, t.TempDir(), "a.test", 1)
+		tls_srv, err := ListenAndServeTLS("127.0.0.1:0", cert_file, key_file, func(w ResponseWriter, r *Request) {
+			w.WriteStatusLine(StatusOK)
+			w.Headers.Set("Content-Type", "text/plain")
+			w.WriteHeaders(nil)
+			w.WriteBody([]byte(r.TLS.ServerName))
+		})
+		require.NoError(t, err)
+		defer tls_srv.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		_, port, _ := net.SplitHostPort(tls_srv.Listener.Addr().String())
+		tls_client := &Client{Transport: &Transport{
+			TLSConfig: &tls.Config{RootCAs: roots},
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				assert.Equal(t, "a.test:" + port, address)
+				return (&net.Dialer{}).DialContext(ctx, network, tls_srv.Listener.Addr().String())
+			},
+		}}
+		_, data := do(tls_client, "GET", "https://a.test:" + port + "/", nil)
+		assert.Equal(t, "a.test", data)
+	})
+
+	t.Run("Invalid Requests", func(t *testing.T) {
+		_, err := NewRequest("GET", "/relative", nil)
+		require.Error(t, err)
+		_, err = NewRequest("GET", "ftp://example.com/", nil)
+		require.Error(t, err)
+		_, err = NewRequest("get", "http://example.com/", nil)
+		require.Error(t, err)
+
+		// Test: CR, LF and NUL can not add lines or a second request
+		for _, modify := range []func(r *Request){
+			func(r *Request) { r.Headers.Set("X-Name", "a\r\nX-Injected: 1") },
+			func(r *Request) { r.Headers.Set("X-Name", "a\nGET /second HTTP/1.1") },
+			func(r *Request) { r.Headers.Set("X-Name", "a\x00") },
+			func(r *Request) { r.Headers.Set("X-Bad\r\nName", "a") },
+			func(r *Request) { r.Target.RawQuery = "a HTTP/1.1\r\nX-Injected: 1" },
+			func(r *Request) { r.Target.Path = "/a\n" },
+			func(r *Request) { r.Trailers = Headers{"x-checksum": "a\r\nX-Injected: 1"} },
+		} {
+			req, err := NewRequest("POST", base + "/", strings.NewReader("body"))
+			require.NoError(t, err)
+			modify(req)
+			buf := &bytes.Buffer{}
+			require.Error(t, req.Write(buf))
+			assert.Zero(t, buf.Len())
+			_, err = client.Do(context.Background(), req)
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestClientRedirects(t *testing.T) {
+	// Answers /status/<code>?to=<location> with a redirect, /loop with a
+	// redirect to itself and echoes any other request
+	handler := func(w ResponseWriter, r *Request) {
+		data, _ := io.ReadAll(r.Body)
+		w.Headers.Set("Content-Type", "text/plain")
+		if code, ok := strings.CutPrefix(r.Target.Path, "/status/"); ok {
+			n, _ := strconv.Atoi(code)
+			w.WriteStatusLine(ResponseStatusCode(n))
+			w.Headers.Set("Location", strings.TrimPrefix(r.Target.RawQuery, "to="))
+			w.WriteHeaders(nil)
+			w.WriteBody([]byte("redirect"))
+			return
+		}
+		if r.Target.Path == "/loop" {
+			w.WriteStatusLine(StatusFound)
+			w.Headers.Set("Location", "loop")
+			w.WriteHeaders(nil)
+			w.WriteBody(nil)
+			return
+		}
+		if r.Target.Path == "/login" {
+			w.Headers.Add("Set-Cookie", "session=abc; Path=/")
+			w.Headers.Add("Set-Cookie", "theme=dark; Path=/; Expires=Wed, 21 Oct 2099 07:28:00 GMT")
+			w.WriteStatusLine(StatusFound)
+			w.Headers.Set("Location", "/echo")
+			w.WriteHeaders(nil)
+			w.WriteBody(nil)
+			return
+		}
+		w.WriteStatusLine(StatusOK)
+		w.Headers.Set("X-Method", r.StatusLine.Method)
+		w.Headers.Set("X-Host", r.Headers.Get("host"))
+		w.Headers.Set("X-Authorization", r.Headers.Get("authorization"))
+		w.Headers.Set("X-Cookie", r.Headers.Get("cookie"))
+		w.Headers.Set("X-Content-Type", r.Headers.Get("content-type"))
+		w.WriteHeaders(nil)
+		w.WriteBody(data)
+	}
+	srv, err := ListenAndServe("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer srv.Close()
+	other, err := ListenAndServe("127.0.0.1:0", handler)
+	require.NoError(t, err)
+	defer other.Close()
+	base := "http://" + srv.Listener.Addr().String()
+	other_base := "http://" + other.Listener.Addr().String()
+
+	do := func(client *Client, req *Request) (*Response, string) {
+		resp, err := client.Do(context.Background(), req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data)
+	}
+	post := func(url string) *Request {
+		req, err := NewRequest("POST", url, strings.NewReader("payload"))
+		require.NoError(t, err)
+		req.Headers.Set("Content-Type", "text/plain")
+		return req
+	}
+
+	t.Run("Method Rewriting", func(t *testing.T) {
+		tests := []struct {
+			code int
+			method string
+			body string
+		}{
+			{301, "GET", ""},
+			{302, "GET", ""},
+			{303, "GET", ""},
+			{307, "POST", "payload"},
+			{308, "POST", "payload"},
+		}
+		for _, tt := range tests {
+			resp, data := do(&Client{}, post(base + "/status/" + strconv.Itoa(tt.code) + "?to=/echo"))
+			assert.Equal(t, StatusOK, resp.StatusCode, tt.code)
+			assert.Equal(t, tt.method, resp.Headers.Get("x-method"), tt.code)
+			assert.Equal(t, tt.body, data, tt.code)
+			if tt.body == "" {
+				assert.Empty(t, resp.Headers.Get("x-content-type"), tt.code)
+			}
+		}
+
+		req, err := NewRequest("PUT", base + "/status/302?to=/echo", strings.NewReader("put"))
+		require.NoError(t, err)
+		resp, data := do(&Client{}, req)
+		assert.Equal(t, "PUT", resp.Headers.Get("x-method"))
+		assert.Equal(t, "put", data)
+	})
+
+	t.Run("Body Without Replay", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("streamed"))
+			pw.Close()
+		}()
+		req, err := NewRequest("POST", base + "/status/307?to=/echo", pr)
+		require.NoError(t, err)
+		resp, data := do(&Client{}, req)
+		assert.Equal(t, ResponseStatusCode(307), resp.StatusCode)
+		assert.Equal(t, "redirect", data)
+	})
+
+	t.Run("Hop Limit", func(t *testing.T) {
+		req, err := NewRequest("GET", base + "/status/302?to=/status/302?to=/echo", nil)
+		require.NoError(t, err)
+		_, err = (&Client{MaxRedirects: 1}).Do(context.Background(), req)
+		require.ErrorContains(t, err, "Stopped after 1 redirects")
+
+		loop, err := NewRequest("GET", base + "/loop", nil)
+		require.NoError(t, err)
+		_, err = (&Client{}).Do(context.Background(), loop)
+		require.ErrorContains(t, err, "Stopped after 10 redirects")
+	})
+
+	t.Run("Cross Origin", func(t *testing.T) {
+		req, err := NewRequest("GET", base + "/status/302?to=/echo", nil)
+		require.NoError(t, err)
+		req.Headers.Set("Authorization", "Bearer secret")
+		resp, _ := do(&Client{}, req)
+		assert.Equal(t, "Bearer secret", resp.Headers.Get("x-authorization"))
+
+		req, err = NewRequest("GET", base + "/status/302?to=" + other_base + "/echo", nil)
+		require.NoError(t, err)
+		req.Headers.Set("Authorization", "Bearer secret")
+		req.Headers.Set("Cookie", "a=1")
+		resp, _ = do(&Client{}, req)
+		assert.Equal(t, strings.TrimPrefix(other_base, "http://"), resp.Headers.Get("x-host"))
+		assert.Empty(t, resp.Headers.Get("x-authorization"))
+		assert.Empty(t, resp.Headers.Get("x-cookie"))
+	})
+
+	t.Run("Check Redirect", func(t *testing.T) {
+		urls := []string{}
+		client := &Client{CheckRedirect: func(req *Request, via []*Request) error {
+			urls = append(urls, via[len(via)-1].StatusLine.Target + " -> " + req.StatusLine.Target)
+			return nil
+		}}
+		req, err := NewRequest("GET", base + "/status/301?to=/status/302?to=/echo", nil)
+		require.NoError(t, err)
+		do(client, req)
+		assert.Equal(t, []string{
+			base + "/status/301?to=/status/302?to=/echo -> " + base + "/status/302?to=/echo",
+			base + "/status/302?to=/echo -> " + base + "/echo",
+		}, urls)
+
+		client = &Client{CheckRedirect: func(req *Request, via []*Request) error { return ErrUseLastResponse }}
+		req, err = NewRequest("GET", base + "/status/302?to=/echo", nil)
+		require.NoError(t, err)
+		resp, data := do(client, req)
+		assert.Equal(t, StatusFound, resp.StatusCode)
+		assert.Equal(t, "/echo", resp.Headers.Get("location"))
+		assert.Equal(t, "redirect", data)
+	})
+
+	t.Run("Cookie Jar", func(t *testing.T) {
+		client := &Client{Jar: NewCookieJar(nil)}
+		req, err := NewRequest("GET", base + "/login", nil)
+		require.NoError(t, err)
+		resp, _ := do(client, req)
+		assert.Equal(t, "session=abc; theme=dark", resp.Headers.Get("x-cookie"))
+
+		req, err = NewRequest("GET", base + "/echo", nil)
+		require.NoError(t, err)
+		req.Headers.Set("Cookie", "mine=1")
+		resp, _ = do(client, req)
+		assert.Equal(t, "mine=1; session=abc; theme=dark", resp.Headers.Get("x-cookie"))
+
+		// Cookies are per host, the port does not matter
+		req, err = NewRequest("GET", other_base + "/echo", nil)
+		require.NoError(t, err)
+		resp, _ = do(client, req)
+		assert.Equal(t, "session=abc; theme=dark", resp.Headers.Get("x-cookie"))
+	})
+}
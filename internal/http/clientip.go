@@ -0,0 +1,66 @@
+package http
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Finds the client IP. Forwarding headers are only used if the peer is a
+// trusted proxy. The chain is walked from the right, every trusted hop is
+// skipped and the first untrusted address is the client
+func (s *Server) clientIP(r *Request) netip.Addr {
+	addr_port, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil { return netip.Addr{} }
+	client := addr_port.Addr().Unmap()
+	if len(s.TrustedProxies) == 0 || !s.isTrustedProxy(client) { return client }
+
+	// Forwarded replaces X-Forwarded-For. See RFC 7239 1
+	hops := forwardedFor(r.Headers.Get("forwarded"))
+	if hops == nil {
+		for _, hop := range strings.Split(r.Headers.Get("x-forwarded-for"), ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(hops[i])
+		if !ok { break }
+		client = addr
+		if !s.isTrustedProxy(addr) { break }
+	}
+	return client
+}
+
+func (s *Server) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(addr) { return true }
+	}
+	return false
+}
+
+// Returns the for= parameter of every element in a Forwarded header.
+// See RFC 7239 4
+func forwardedFor(value string) []string {
+	if value == "" { return nil }
+	hops := []string{}
+	for _, element := range strings.Split(value, ",") {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") { hop = strings.Trim(v, "\"") }
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// Accepts "192.0.2.1", "192.0.2.1:80", "[2001:db8::1]:80" and "2001:db8::1".
+// Obfuscated identifiers and "unknown" are rejected. See RFC 7239 6
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	if addr_port, err := netip.ParseAddrPort(s); err == nil {
+		return addr_port.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil { return netip.Addr{}, false }
+	return addr.Unmap(), true
+}
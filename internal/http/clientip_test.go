@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	srv := &Server{TrustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}}
+	client := func(remote_addr string, headers Headers) string {
+		return srv.clientIP(&Request{RemoteAddr: remote_addr, Headers: headers}).String()
+	}
+
+	// Test: Untrusted peer, headers are ignored
+	assert.Equal(t, "192.0.2.1", client("192.0.2.1:1234", Headers{"x-forwarded-for": "203.0.113.7"}))
+
+	// Test: Trusted peer without headers
+	assert.Equal(t, "10.0.0.1", client("10.0.0.1:1234", Headers{}))
+
+	// Test: X-Forwarded-For through several trusted proxies
+	assert.Equal(t, "203.0.113.7", client("10.0.0.1:1234", Headers{"x-forwarded-for": "198.51.100.1, 203.0.113.7, 10.0.0.2"}))
+
+	// Test: Spoofed leftmost entry is not used
+	assert.Equal(t, "203.0.113.7", client("10.0.0.1:1234", Headers{"x-forwarded-for": "1.2.3.4, 203.0.113.7"}))
+
+	// Test: Forwarded takes precedence over X-Forwarded-For
+	assert.Equal(t, "198.51.100.17", client("10.0.0.1:1234", Headers{
+		"forwarded": "for=198.51.100.17;proto=https, for=\"[2001:db8:cafe::17]:4711\"",
+		"x-forwarded-for": "203.0.113.7",
+	}))
+
+	// Test: Obfuscated identifier stops the walk
+	assert.Equal(t, "10.0.0.1", client("10.0.0.1:1234", Headers{"forwarded": "for=_hidden"}))
+
+	// Test: IPv4-mapped peer address
+	assert.Equal(t, "203.0.113.7", client("[::ffff:10.0.0.1]:1234", Headers{"x-forwarded-for": "203.0.113.7"}))
+
+	// Test: Trusted proxies disabled
+	srv = &Server{}
+	assert.Equal(t, "10.0.0.1", client("10.0.0.1:1234", Headers{"x-forwarded-for": "203.0.113.7"}))
+}
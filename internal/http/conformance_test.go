@@ -0,0 +1,289 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A case of the conformance suite in testdata/conformance. A file starts
+// with "#" comments and "key: value" lines, followed by a "--" line and
+// the raw message. Every line of the message is sent with CRLF unless it
+// ends with a single "\", and \r, \n, \t, \0, \xHH and \\ are unescaped,
+// so bare CR, LF and other bytes can be written. See the README there
+type conformanceCase struct {
+	name string
+	// Keys in file order, a key can repeat
+	keys [][2]string
+	message string
+}
+
+func (cc conformanceCase) get(key string) string {
+	for _, kv := range cc.keys {
+		if kv[0] == key { return kv[1] }
+	}
+	return ""
+}
+
+func (cc conformanceCase) all(key string) []string {
+	values := []string{}
+	for _, kv := range cc.keys {
+		if kv[0] == key { values = append(values, kv[1]) }
+	}
+	return values
+}
+
+func loadConformanceCases(t testing.TB, dir string) []conformanceCase {
+	paths, err := filepath.Glob(filepath.Join("testdata", "conformance", dir, "*.txt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	cases := []conformanceCase{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		head, message, ok := strings.Cut(string(data), "\n--\n")
+		require.True(t, ok, "%s: missing -- line", path)
+		cc := conformanceCase{name: strings.TrimSuffix(filepath.Base(path), ".txt")}
+		for _, line := range strings.Split(head, "\n") {
+			if line == "" || strings.HasPrefix(line, "#") { continue }
+			key, value, ok := strings.Cut(line, ":")
+			require.True(t, ok, "%s: invalid line '%s'", path, line)
+			cc.keys = append(cc.keys, [2]string{key, unescapeConformance(strings.TrimSpace(value))})
+		}
+		lines := strings.Split(message, "\n")
+		if lines[len(lines)-1] == "" { lines = lines[:len(lines)-1] }
+		raw := strings.Builder{}
+		for _, line := range lines {
+			if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+				raw.WriteString(unescapeConformance(strings.TrimSuffix(line, "\\")))
+			} else {
+				raw.WriteString(unescapeConformance(line) + "\r\n")
+			}
+		}
+		cc.message = raw.String()
+		cases = append(cases, cc)
+	}
+	return cases
+}
+
+func unescapeConformance(s string) string {
+	out := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'r':
+			out = append(out, '\r')
+		case 'n':
+			out = append(out, '\n')
+		case 't':
+			out = append(out, '\t')
+		case '0':
+			out = append(out, 0)
+		case 'x':
+			b, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			out = append(out, byte(b))
+			i += 2
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return string(out)
+}
+
+// Checks "name: value" expectations. An empty value means the field is
+// absent, "*" that it is present with any value
+func assertFields(t *testing.T, headers Headers, expected []string, msg string) {
+	for _, field := range expected {
+		name, value, _ := strings.Cut(field, ":")
+		value = strings.TrimSpace(value)
+		got, ok := headers[strings.ToLower(name)]
+		switch value {
+		case "":
+			assert.False(t, ok, "%s: %s should be absent, got '%s'", msg, name, got)
+		case "*":
+			assert.True(t, ok && got != "", "%s: %s should be present", msg, name)
+		default:
+			assert.Equal(t, value, got, "%s: %s", msg, name)
+		}
+	}
+}
+
+// Runs every request case through RequestFromReader at every read size
+// and against a server over a real socket
+func TestConformanceRequests(t *testing.T) {
+	for _, cc := range loadConformanceCases(t, "requests") {
+		t.Run(cc.name, func(t *testing.T) {
+			expect := cc.get("expect")
+			require.Contains(t, []string{"ok", "error"}, expect)
+			for per_read := 1; per_read <= len(cc.message); per_read++ {
+				msg := fmt.Sprintf("%d bytes per read", per_read)
+				r, err := RequestFromReader(&chunkReader{data: cc.message, numBytesPerRead: per_read})
+				data := []byte{}
+				if err == nil { data, err = io.ReadAll(r.Body) }
+				if expect == "error" {
+					require.Error(t, err, msg)
+					continue
+				}
+				require.NoError(t, err, msg)
+				if v := cc.get("method"); v != "" { assert.Equal(t, v, r.StatusLine.Method, msg) }
+				if v := cc.get("target"); v != "" { assert.Equal(t, v, r.StatusLine.Target, msg) }
+				if v := cc.get("version"); v != "" { assert.Equal(t, v, r.StatusLine.Version, msg) }
+				assertFields(t, r.Headers, cc.all("header"), msg)
+				assertFields(t, r.Trailers, cc.all("trailer"), msg)
+				assert.Equal(t, cc.get("body"), string(data), msg)
+			}
+			serveConformanceCase(t, cc)
+		})
+	}
+}
+
+// Sends the request to a server whose handler answers as the respond-*
+// keys say, or echoes the request body. Unless the server is expected to
+// close the connection, a second request has to get a proper response on
+// it, which catches stray bytes after the first response
+func serveConformanceCase(t *testing.T, cc conformanceCase) {
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		data, err := io.ReadAll(r.Body)
+		if r.Target.Path == "/__next" {
+			w.WriteStatusLine(StatusOK)
+			w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+			w.WriteBody([]byte("next"))
+			return
+		}
+		if err != nil {
+			w.WriteStatusLine(StatusBadRequest)
+			w.WriteHeaders(Headers{"Content-Type": "text/plain", "Connection": "close"})
+			w.WriteBody([]byte(err.Error()))
+			return
+		}
+		status := StatusOK
+		if v := cc.get("respond-status"); v != "" {
+			n, _ := strconv.Atoi(v)
+			status = ResponseStatusCode(n)
+		}
+		w.WriteStatusLine(status)
+		w.Headers.Set("Content-Type", "text/plain")
+		for _, field := range cc.all("respond-header") {
+			name, value, _ := strings.Cut(field, ":")
+			w.Headers.Set(name, strings.TrimSpace(value))
+		}
+		chunks := cc.all("respond-chunk")
+		if len(chunks) > 0 { w.Headers.Set("Transfer-Encoding", "chunked") }
+		w.WriteHeaders(nil)
+		if len(chunks) == 0 {
+			body := []byte(cc.get("respond-body"))
+			if cc.get("respond-body") == "" && len(cc.all("respond-status")) == 0 { body = data }
+			w.WriteBody(body)
+			return
+		}
+		trailers := Headers{}
+		for _, field := range cc.all("respond-trailer") {
+			name, value, _ := strings.Cut(field, ":")
+			trailers.Set(name, strings.TrimSpace(value))
+		}
+		if len(trailers) > 0 { w.WriteTrailers(trailers) }
+		for _, chunk := range chunks { w.WriteChunkedBody([]byte(chunk)) }
+		w.WriteChunkedBodyDone()
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte(cc.message))
+	require.NoError(t, err)
+	// Lets the server see the end of a truncated request
+	if cc.get("half-close") == "true" { require.NoError(t, conn.(*net.TCPConn).CloseWrite()) }
+	method, _, _ := strings.Cut(cc.message, " ")
+	resp, err := ResponseFromReader(io.NopCloser(conn), strings.TrimLeft(method, "\r\n"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	b := resp.Body.(*body)
+	assert.Empty(t, b.rb.buffered(), "bytes after the response")
+
+	status := cc.get("status")
+	if status == "" {
+		status = "200"
+		if cc.get("expect") == "error" { status = "400" }
+	}
+	assert.Equal(t, status, strconv.Itoa(int(resp.StatusCode)))
+	if v := cc.get("response-version"); v != "" { assert.Equal(t, v, resp.Version) }
+	assertFields(t, resp.Headers, cc.all("response-header"), "response")
+	assertFields(t, resp.Trailers, cc.all("response-trailer"), "response")
+	if v := cc.get("response-body"); v != "" || cc.get("expect") == "ok" {
+		expected := v
+		if v == "" && len(cc.all("respond-status")) == 0 && len(cc.all("respond-chunk")) == 0 { expected = cc.get("body") }
+		if v == "-" { expected = "" }
+		assert.Equal(t, expected, string(data))
+	}
+
+	close := cc.get("close")
+	if close == "" {
+		close = "false"
+		if cc.get("expect") == "error" { close = "true" }
+	}
+	if close == "true" {
+		n, err := conn.Read(make([]byte, 1))
+		assert.Zero(t, n)
+		assert.True(t, errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isConnReset(err), "connection should be closed: %v", err)
+		return
+	}
+	_, err = conn.Write([]byte("GET /__next HTTP/1.1\r\nHost: conformance\r\n\r\n"))
+	require.NoError(t, err)
+	next, err := ResponseFromReader(io.NopCloser(conn), "GET")
+	require.NoError(t, err, "connection should stay usable")
+	data, err = io.ReadAll(next.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "next", string(data))
+}
+
+func isConnReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}
+
+// Runs every response case through ResponseFromReader at every read size
+func TestConformanceResponses(t *testing.T) {
+	for _, cc := range loadConformanceCases(t, "responses") {
+		t.Run(cc.name, func(t *testing.T) {
+			expect := cc.get("expect")
+			require.Contains(t, []string{"ok", "error"}, expect)
+			method := cc.get("request-method")
+			if method == "" { method = "GET" }
+			for per_read := 1; per_read <= len(cc.message); per_read++ {
+				msg := fmt.Sprintf("%d bytes per read", per_read)
+				resp, err := ResponseFromReader(&chunkReader{data: cc.message, numBytesPerRead: per_read}, method)
+				data := []byte{}
+				if err == nil { data, err = io.ReadAll(resp.Body) }
+				if expect == "error" {
+					require.Error(t, err, msg)
+					continue
+				}
+				require.NoError(t, err, msg)
+				if v := cc.get("status"); v != "" { assert.Equal(t, v, strconv.Itoa(int(resp.StatusCode)), msg) }
+				if v := cc.get("reason"); v != "" { assert.Equal(t, v, resp.Reason, msg) }
+				if v := cc.get("version"); v != "" { assert.Equal(t, v, resp.Version, msg) }
+				assertFields(t, resp.Headers, cc.all("header"), msg)
+				assertFields(t, resp.Trailers, cc.all("trailer"), msg)
+				assert.True(t, bytes.Equal([]byte(cc.get("body")), data), "%s: body %q", msg, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State of a single client connection
+type conn struct {
+	id uint64
+	rwc net.Conn
+	server *Server
+	r *connReader
+	// Cancelled when the connection closes or the server shuts down
+	ctx context.Context
+	cancel context.CancelFunc
+	// Parses the HTTP/1.x requests, holds bytes read from rwc that are not
+	// consumed yet
+	rr *requestReader
+	// Body of the current request
+	body *body
+	// Responses are written here, see ResponseWriter.writer
+	bw *bufio.Writer
+	hijacked atomic.Bool
+	// Waiting for the next request, such connections are closed first on
+	// shutdown
+	idle atomic.Bool
+	// Whether the connection stays open after the current response. Set
+	// from the request and cleared by the response writer
+	keep_alive bool
+	response_done bool
+}
+
+func newConn(s *Server, rwc net.Conn, ctx context.Context) *conn {
+	c := &conn{rwc: rwc, server: s}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.r = &connReader{conn: c}
+	c.r.cond = sync.NewCond(&c.r.mu)
+	return c
+}
+
+func (c *conn) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !c.hijacked.CompareAndSwap(false, true) {
+		return nil, nil, errors.New("Connection has already been hijacked")
+	}
+	c.r.abortPendingRead()
+	c.server.trackConn(c, false)
+
+	// The parser may have read past the request already
+	buffered := []byte{}
+	if c.rr != nil { buffered = bytes.Clone(c.rr.rb.buffered()) }
+	buffered = append(buffered, c.r.unread...)
+	c.r.unread = nil
+	r := io.MultiReader(bytes.NewReader(buffered), c.rwc)
+	return c.rwc, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(c.rwc)), nil
+}
+
+// Skips the rest of the current request, bytes read past it stay buffered
+// for the next one. Reports false if the request body was not read
+// completely and can not be skipped
+func (c *conn) finishRequest() bool {
+	if c.body == nil { return true }
+	if !c.body.done() {
+		// Skip a small rest of the body, a large one is not worth waiting for
+		n, err := io.Copy(io.Discard, io.LimitReader(c.body, maxDiscardBodySize))
+		if err != nil || n == maxDiscardBodySize || !c.body.done() { return false }
+	}
+
+	// The buffer now belongs to the next request
+	c.body.closed.Store(true)
+	c.body = nil
+	return true
+}
+
+// Closes the connection without losing the last response. Closing with
+// unread data makes the kernel reset the connection, which can discard the
+// response before the client read it. So the write side is closed first
+// and the client gets a moment to close its side. See RFC 9112 9.6
+func (c *conn) close() {
+	type closeWriter interface { CloseWrite() error }
+	if cw, ok := c.rwc.(closeWriter); ok && cw.CloseWrite() == nil {
+		c.r.abortPendingRead()
+		c.rwc.SetReadDeadline(time.Now().Add(lingerTimeout))
+		io.Copy(io.Discard, io.LimitReader(c.r, maxDiscardBodySize))
+	}
+	c.rwc.Close()
+}
+
+// How long close waits for the client to close its side
+const lingerTimeout = 500 * time.Millisecond
+
+// Largest unread request body that is skipped to reuse the connection
+const maxDiscardBodySize = 256 << 10
+
+// Used to abort a blocked read by setting a deadline in the past
+var aLongTimeAgo = time.Unix(1, 0)
+
+// All reads from a client connection go through connReader. While a
+// handler runs, a background read watches the connection so a client
+// hanging up cancels the request context
+type connReader struct {
+	conn *conn
+	mu sync.Mutex
+	cond *sync.Cond
+	in_read bool
+	aborted bool
+	// Bytes returned by the next reads before reading the connection again,
+	// e.g. a pipelined request seen by the background read
+	unread []byte
+	byte_buf [1]byte
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	if len(p) == 0 { return 0, nil }
+
+	cr.mu.Lock()
+	for cr.in_read { cr.cond.Wait() }
+	if len(cr.unread) > 0 {
+		n := copy(p, cr.unread)
+		cr.unread = cr.unread[n:]
+		cr.mu.Unlock()
+		return n, nil
+	}
+	cr.in_read = true
+	cr.mu.Unlock()
+
+	n, err := cr.conn.rwc.Read(p)
+
+	cr.mu.Lock()
+	cr.in_read = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+	return n, err
+}
+
+// Reads the HTTP/2 connection preface if the client starts with it. Any
+// other bytes are kept for the next read
+func (cr *connReader) readH2Preface() bool {
+	buf := make([]byte, 0, len(h2Preface))
+	for len(buf) < len(h2Preface) {
+		n, err := cr.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil || !strings.HasPrefix(h2Preface, string(buf)) {
+			cr.mu.Lock()
+			cr.unread = append(buf, cr.unread...)
+			cr.mu.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+func (cr *connReader) startBackgroundRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.in_read || len(cr.unread) > 0 { return }
+	cr.in_read = true
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.conn.rwc.Read(cr.byte_buf[:])
+
+	cr.mu.Lock()
+	if n == 1 { cr.unread = append(cr.unread, cr.byte_buf[0]) }
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() && cr.aborted {
+		// Aborted on purpose, the client is still there
+	} else if err != nil {
+		cr.conn.cancel()
+	}
+	cr.aborted = false
+	cr.in_read = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+}
+
+// Stops a running background read, so the connection can be read directly
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.in_read { return }
+	cr.aborted = true
+	cr.conn.rwc.SetReadDeadline(aLongTimeAgo)
+	for cr.in_read { cr.cond.Wait() }
+	cr.conn.rwc.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,277 @@
+package http
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Date formats accepted in Expires
+var cookieTimeFormats = []string{
+	TimeFormat,
+	"Mon, 02-Jan-2006 15:04:05 GMT",
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+	"Mon, 02 Jan 06 15:04:05 GMT",
+}
+
+// Cookies kept per domain and in total, like browsers do. The oldest are
+// evicted first. See RFC 6265 6.1
+const (
+	maxCookiesPerDomain = 180
+	maxCookies = 3000
+)
+
+// Cookies expire after at most 400 days. See RFC 6265bis 5.5
+const maxCookieAge = 400 * 24 * time.Hour
+
+// Stores cookies from Set-Cookie and returns the ones that belong to a
+// request. Cookies for public suffixes like "co.uk" are rejected, so one
+// site can not set cookies for others. See RFC 6265
+type CookieJar struct {
+	suffixes map[string]bool
+	wildcards map[string]bool
+	exceptions map[string]bool
+	mu sync.Mutex
+	cookies []*cookie
+	// Orders cookies of the same path length by creation
+	seq uint64
+	now func() time.Time
+}
+
+type cookie struct {
+	name string
+	value string
+	domain string
+	path string
+	// Zero for session cookies
+	expires time.Time
+	host_only bool
+	secure bool
+	created uint64
+}
+
+// Creates a jar with the rules of the public suffix list, one per entry,
+// e.g. "com", "*.ck" or "!www.ck". Empty entries and "//" comments are
+// skipped, so the lines of the list can be passed as they are. A single
+// label is always a public suffix. See https://publicsuffix.org/list/
+func NewCookieJar(public_suffixes []string) *CookieJar {
+	j := &CookieJar{
+		suffixes: map[string]bool{},
+		wildcards: map[string]bool{},
+		exceptions: map[string]bool{},
+		now: time.Now,
+	}
+	for _, rule := range public_suffixes {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case rule == "" || strings.HasPrefix(rule, "//"):
+		case strings.HasPrefix(rule, "!"):
+			j.exceptions[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			j.wildcards[rule[2:]] = true
+		default:
+			j.suffixes[rule] = true
+		}
+	}
+	return j
+}
+
+func (j *CookieJar) isPublicSuffix(domain string) bool {
+	if j.exceptions[domain] { return false }
+	if j.suffixes[domain] { return true }
+	dot := strings.IndexByte(domain, '.')
+	if dot == -1 { return true }
+	return j.wildcards[domain[dot+1:]]
+}
+
+// Stores the cookies of Set-Cookie values received for target. Invalid
+// cookies are ignored. See RFC 6265 5.2 and 5.3
+func (j *CookieJar) SetCookies(target RequestTarget, set_cookies []string) {
+	if len(set_cookies) == 0 { return }
+	host := cookieHost(target.Authority)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	for _, set_cookie := range set_cookies {
+		c, ok := parseSetCookie(set_cookie, now)
+		if !ok { continue }
+
+		if c.domain != "" && j.isPublicSuffix(c.domain) {
+			// Only the public suffix itself may set it, as a host-only cookie
+			if c.domain != host { continue }
+			c.domain = ""
+		}
+		if c.domain == "" {
+			c.host_only = true
+			c.domain = host
+		} else if !domainMatch(host, c.domain) {
+			continue
+		}
+		if c.path == "" { c.path = defaultCookiePath(target.Path) }
+
+		c.created = j.seq
+		j.seq++
+		idx := slices.IndexFunc(j.cookies, func(old *cookie) bool {
+			return old.name == c.name && old.domain == c.domain && old.path == c.path
+		})
+		if idx != -1 {
+			c.created = j.cookies[idx].created
+			j.cookies = slices.Delete(j.cookies, idx, idx+1)
+		}
+		// An expiry in the past removes the cookie
+		if !c.expires.IsZero() && !c.expires.After(now) { continue }
+		j.cookies = append(j.cookies, c)
+		j.evict(c.domain, now)
+	}
+}
+
+// Removes expired cookies once the jar is over a limit, then the oldest
+// ones of domain and of the whole jar. See RFC 6265 5.3 step 12
+func (j *CookieJar) evict(domain string, now time.Time) {
+	in_domain := 0
+	for _, c := range j.cookies {
+		if c.domain == domain { in_domain++ }
+	}
+	if in_domain <= maxCookiesPerDomain && len(j.cookies) <= maxCookies { return }
+
+	j.cookies = slices.DeleteFunc(j.cookies, func(c *cookie) bool {
+		return !c.expires.IsZero() && !c.expires.After(now)
+	})
+	// Cookies are appended as they are created, replaced ones keep their
+	// creation but move to the end
+	slices.SortStableFunc(j.cookies, func(a, b *cookie) int { return cmp.Compare(a.created, b.created) })
+	for i := 0; i < len(j.cookies) && in_domain > maxCookiesPerDomain; {
+		if j.cookies[i].domain != domain {
+			i++
+			continue
+		}
+		j.cookies = slices.Delete(j.cookies, i, i+1)
+		in_domain--
+	}
+	if len(j.cookies) > maxCookies { j.cookies = slices.Delete(j.cookies, 0, len(j.cookies) - maxCookies) }
+}
+
+// Returns the Cookie header value for a request to target, longer paths
+// first. Empty if no cookie matches. See RFC 6265 5.4
+func (j *CookieJar) Cookies(target RequestTarget) string {
+	host := cookieHost(target.Authority)
+	path := target.Path
+	if path == "" { path = "/" }
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+
+	matched := []*cookie{}
+	j.cookies = slices.DeleteFunc(j.cookies, func(c *cookie) bool {
+		return !c.expires.IsZero() && !c.expires.After(now)
+	})
+	for _, c := range j.cookies {
+		if c.host_only && host != c.domain { continue }
+		if !c.host_only && !domainMatch(host, c.domain) { continue }
+		if !pathMatch(path, c.path) { continue }
+		if c.secure && target.Scheme != "https" { continue }
+		matched = append(matched, c)
+	}
+	slices.SortFunc(matched, func(a, b *cookie) int {
+		if len(a.path) != len(b.path) { return len(b.path) - len(a.path) }
+		return int(a.created) - int(b.created)
+	})
+
+	pairs := make([]string, len(matched))
+	for i, c := range matched { pairs[i] = c.name + "=" + c.value }
+	return strings.Join(pairs, "; ")
+}
+
+// Returns a copy of req with the cookies of the jar added to its Cookie
+// header
+func (j *CookieJar) addCookies(req *Request) *Request {
+	cookies := j.Cookies(req.Target)
+	if cookies == "" { return req }
+	out := *req
+	out.Headers = Headers{}
+	for name, value := range req.Headers { out.Headers.Set(name, value) }
+	if existing := out.Headers.Get("cookie"); existing != "" { cookies = existing + "; " + cookies }
+	out.Headers.Set("Cookie", cookies)
+	return &out
+}
+
+// See RFC 6265 5.2
+func parseSetCookie(set_cookie string, now time.Time) (*cookie, bool) {
+	parts := strings.Split(set_cookie, ";")
+	name, value, ok := strings.Cut(parts[0], "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" { return nil, false }
+	c := &cookie{name: name, value: strings.TrimSpace(value)}
+
+	has_max_age := false
+	for _, attribute := range parts[1:] {
+		key, value, _ := strings.Cut(attribute, "=")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "expires":
+			if has_max_age { continue }
+			for _, format := range cookieTimeFormats {
+				if t, err := time.Parse(format, value); err == nil {
+					c.expires = t
+					if max_expires := now.Add(maxCookieAge); t.After(max_expires) { c.expires = max_expires }
+					break
+				}
+			}
+		case "max-age":
+			// Takes precedence over Expires. See RFC 6265 5.3 step 3
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if (err != nil && !errors.Is(err, strconv.ErrRange)) || value[0] == '+' { continue }
+			has_max_age = true
+			if seconds <= 0 {
+				c.expires = time.Unix(0, 0)
+			} else {
+				// Clamped before the multiplication can overflow. See RFC
+				// 6265bis 5.6.2
+				c.expires = now.Add(time.Duration(min(seconds, int64(maxCookieAge / time.Second))) * time.Second)
+			}
+		case "domain":
+			c.domain = strings.ToLower(strings.TrimPrefix(value, "."))
+		case "path":
+			if strings.HasPrefix(value, "/") { c.path = value }
+		case "secure":
+			c.secure = true
+		}
+	}
+	return c, true
+}
+
+// Lower case host without port or brackets
+func cookieHost(authority string) string {
+	host, _, err := net.SplitHostPort(authority)
+	if err != nil { host = trimBrackets(authority) }
+	return strings.ToLower(host)
+}
+
+// See RFC 6265 5.1.3
+func domainMatch(host string, domain string) bool {
+	if host == domain { return true }
+	if _, err := netip.ParseAddr(host); err == nil { return false }
+	return strings.HasSuffix(host, "." + domain)
+}
+
+// See RFC 6265 5.1.4
+func pathMatch(path string, cookie_path string) bool {
+	if path == cookie_path { return true }
+	if !strings.HasPrefix(path, cookie_path) { return false }
+	return strings.HasSuffix(cookie_path, "/") || path[len(cookie_path)] == '/'
+}
+
+// Directory of the request path. See RFC 6265 5.1.4
+func defaultCookiePath(path string) string {
+	if !strings.HasPrefix(path, "/") { return "/" }
+	idx := strings.LastIndexByte(path, '/')
+	if idx == 0 { return "/" }
+	return path[:idx]
+}
@@ -0,0 +1,123 @@
+package http
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieJar(t *testing.T) {
+	target := func(url string) RequestTarget {
+		target, err := parseRequestTarget("GET", url)
+		require.NoError(t, err)
+		return target
+	}
+	suffixes := []string{"// comment", "", "com", "co.uk", "*.ck", "!www.ck"}
+
+	t.Run("Domain Matching", func(t *testing.T) {
+		j := NewCookieJar(suffixes)
+		j.SetCookies(target("http://www.example.com/"), []string{
+			"host=1",
+			"domain=2; Domain=.Example.com",
+			"other=3; Domain=other.com",
+			"suffix=4; Domain=com",
+		})
+		assert.Equal(t, "host=1; domain=2", j.Cookies(target("http://www.example.com/")))
+		assert.Equal(t, "domain=2", j.Cookies(target("http://api.example.com/")))
+		assert.Equal(t, "domain=2", j.Cookies(target("http://example.com:8080/")))
+		assert.Equal(t, "", j.Cookies(target("http://badexample.com/")))
+		assert.Equal(t, "", j.Cookies(target("http://other.com/")))
+	})
+
+	t.Run("Public Suffixes", func(t *testing.T) {
+		j := NewCookieJar(suffixes)
+		j.SetCookies(target("http://a.co.uk/"), []string{"a=1; Domain=co.uk"})
+		j.SetCookies(target("http://b.foo.ck/"), []string{"b=1; Domain=foo.ck"})
+		j.SetCookies(target("http://www.ck/"), []string{"c=1; Domain=www.ck"})
+		j.SetCookies(target("http://localhost/"), []string{"d=1; Domain=localhost"})
+		assert.Equal(t, "", j.Cookies(target("http://b.co.uk/")))
+		assert.Equal(t, "", j.Cookies(target("http://c.foo.ck/")))
+		assert.Equal(t, "c=1", j.Cookies(target("http://sub.www.ck/")))
+		// The suffix itself gets a host-only cookie
+		assert.Equal(t, "d=1", j.Cookies(target("http://localhost/")))
+	})
+
+	t.Run("Paths", func(t *testing.T) {
+		j := NewCookieJar(suffixes)
+		j.SetCookies(target("http://example.com/docs/page"), []string{"default=1", "root=2; Path=/", "deep=3; Path=/docs/api"})
+		assert.Equal(t, "deep=3; default=1; root=2", j.Cookies(target("http://example.com/docs/api/x")))
+		assert.Equal(t, "default=1; root=2", j.Cookies(target("http://example.com/docs")))
+		assert.Equal(t, "root=2", j.Cookies(target("http://example.com/docsx")))
+		assert.Equal(t, "root=2", j.Cookies(target("http://example.com")))
+	})
+
+	t.Run("Secure and IP Hosts", func(t *testing.T) {
+		j := NewCookieJar(suffixes)
+		j.SetCookies(target("https://example.com/"), []string{"s=1; Secure; HttpOnly", "p=2"})
+		assert.Equal(t, "s=1; p=2", j.Cookies(target("https://example.com/")))
+		assert.Equal(t, "p=2", j.Cookies(target("http://example.com/")))
+
+		j.SetCookies(target("http://127.0.0.1/"), []string{"ip=1", "bad=2; Domain=0.0.1"})
+		assert.Equal(t, "ip=1", j.Cookies(target("http://127.0.0.1:8080/")))
+		j.SetCookies(target("http://[::1]:8080/"), []string{"v6=1"})
+		assert.Equal(t, "v6=1", j.Cookies(target("http://[::1]/")))
+	})
+
+	t.Run("Expiry and Replacement", func(t *testing.T) {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		j := NewCookieJar(suffixes)
+		j.now = func() time.Time { return now }
+		j.SetCookies(target("http://example.com/"), []string{
+			"a=1",
+			"b=2; Max-Age=60",
+			"c=3; Expires=Wed, 01 Jan 2025 01:00:00 GMT",
+			"d=4; Expires=Tue, 31-Dec-2024 00:00:00 GMT",
+			"e=5; Expires=Tue, 31 Dec 2024 00:00:00 GMT; Max-Age=60",
+			"invalid",
+			"=empty",
+		})
+		assert.Equal(t, "a=1; b=2; c=3; e=5", j.Cookies(target("http://example.com/")))
+
+		// Replacing keeps the position, Max-Age=0 removes
+		j.SetCookies(target("http://example.com/"), []string{"a=changed", "b=gone; Max-Age=0"})
+		assert.Equal(t, "a=changed; c=3; e=5", j.Cookies(target("http://example.com/")))
+
+		now = now.Add(2 * time.Minute)
+		assert.Equal(t, "a=changed; c=3", j.Cookies(target("http://example.com/")))
+		now = now.Add(time.Hour)
+		assert.Equal(t, "a=changed", j.Cookies(target("http://example.com/")))
+
+		// Large Max-Age and Expires are clamped to 400 days
+		j.SetCookies(target("http://example.com/"), []string{
+			"f=6; Max-Age=9999999999",
+			"g=7; Max-Age=99999999999999999999",
+			"h=8; Expires=Fri, 31 Dec 9999 23:59:59 GMT",
+		})
+		now = now.Add(399 * 24 * time.Hour)
+		assert.Equal(t, "a=changed; f=6; g=7; h=8", j.Cookies(target("http://example.com/")))
+		now = now.Add(2 * 24 * time.Hour)
+		assert.Equal(t, "a=changed", j.Cookies(target("http://example.com/")))
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		j := NewCookieJar(suffixes)
+		set_cookies := []string{}
+		for i := range maxCookiesPerDomain + 10 { set_cookies = append(set_cookies, "c" + strconv.Itoa(i) + "=1") }
+		j.SetCookies(target("http://example.com/"), set_cookies)
+		cookies := strings.Split(j.Cookies(target("http://example.com/")), "; ")
+		require.Len(t, cookies, maxCookiesPerDomain)
+		// The oldest are evicted first
+		assert.Equal(t, "c10=1", cookies[0])
+
+		for i := range maxCookies / maxCookiesPerDomain + 2 {
+			j.SetCookies(target("http://site" + strconv.Itoa(i) + ".com/"), set_cookies)
+		}
+		assert.Len(t, j.cookies, maxCookies)
+		assert.Equal(t, "", j.Cookies(target("http://example.com/")))
+		assert.NotEqual(t, "", j.Cookies(target("http://site17.com/")))
+	})
+}
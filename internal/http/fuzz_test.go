@@ -0,0 +1,205 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Parsed request with its body and trailers, all read with the given
+// number of bytes per read of the source and of the body
+type fuzzRequest struct {
+	method, target, version string
+	headers Headers
+	body []byte
+	trailers Headers
+	chunked bool
+}
+
+func parseFuzzRequest(data []byte, per_read int) (fuzzRequest, error) {
+	r, err := RequestFromReader(&chunkReader{data: string(data), numBytesPerRead: per_read})
+	if err != nil { return fuzzRequest{}, err }
+	content := []byte{}
+	buf := make([]byte, per_read)
+	for {
+		n, err := r.Body.Read(buf)
+		content = append(content, buf[:n]...)
+		if errors.Is(err, io.EOF) { break }
+		if err != nil { return fuzzRequest{}, err }
+	}
+	return fuzzRequest{
+		method: r.StatusLine.Method,
+		target: r.StatusLine.Target,
+		version: r.StatusLine.Version,
+		headers: r.Headers,
+		body: content,
+		trailers: r.Trailers,
+		chunked: r.Body.(*body).is_chunked,
+	}, nil
+}
+
+// Writes the request back with the parsed headers unchanged, so it is
+// framed the same way. A chunked body is sent as a single chunk
+func (fr fuzzRequest) serialize() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %s %s\r\n", fr.method, fr.target, fr.version)
+	writeFuzzFields(buf, fr.headers)
+	if !fr.chunked {
+		buf.Write(fr.body)
+		return buf.Bytes()
+	}
+	if len(fr.body) > 0 {
+		buf.WriteString(strconv.FormatInt(int64(len(fr.body)), 16) + "\r\n")
+		buf.Write(fr.body)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("0\r\n")
+	writeFuzzFields(buf, fr.trailers)
+	return buf.Bytes()
+}
+
+func writeFuzzFields(buf *bytes.Buffer, headers Headers) {
+	for name := range headers {
+		for _, value := range headers.Values(name) { fmt.Fprintf(buf, "%s: %s\r\n", name, value) }
+	}
+	buf.WriteString("\r\n")
+}
+
+// Invariants: no panics, the result does not depend on how the input is
+// split into reads, and a parsed request parses the same when written back
+func FuzzRequestFromReader(f *testing.F) {
+	for _, cc := range loadConformanceCases(f, "requests") { f.Add([]byte(cc.message)) }
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	f.Add([]byte("POST /upload HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabc"))
+	f.Add([]byte("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3;x=y\r\nabc\r\n0\r\nT: 1\r\n\r\n"))
+	f.Add([]byte("OPTIONS * HTTP/1.1\r\nHost: a\r\n\r\n"))
+	f.Add([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	f.Add([]byte("GET http://example.com/x?y HTTP/1.0\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		whole, err := parseFuzzRequest(data, max(len(data), 1))
+		single, single_err := parseFuzzRequest(data, 1)
+		require.Equal(t, err == nil, single_err == nil, "whole: %v, byte by byte: %v", err, single_err)
+		if err != nil { return }
+		assert.Equal(t, whole, single)
+
+		again, err := parseFuzzRequest(whole.serialize(), 7)
+		require.NoError(t, err, "%q", whole.serialize())
+		assert.Equal(t, whole, again)
+	})
+}
+
+// Invariants: no panics, a parsed field line is consumed up to its CRLF,
+// and it parses to the same field when written back
+func FuzzHeadersParse(f *testing.F) {
+	f.Add([]byte("Host: example.com\r\n"))
+	f.Add([]byte("  X-Leading: value\r\n"))
+	f.Add([]byte("X-Empty:\r\n"))
+	f.Add([]byte("Set-Cookie: a=1\r\n"))
+	f.Add([]byte("X-Tab:\tvalue\t\r\n"))
+	f.Add([]byte("\r\n"))
+	f.Add([]byte("Bad Name: x\r\n"))
+	f.Add([]byte("X: a\rb\r\n"))
+	f.Add([]byte("No-CRLF: x"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		headers := Headers{}
+		n, done, err := headers.parse(data)
+		if err != nil || n == 0 { return }
+		require.LessOrEqual(t, n, len(data))
+		require.True(t, bytes.HasSuffix(data[:n], []byte("\r\n")))
+		require.Equal(t, -1, bytes.Index(data[:n-2], []byte("\r\n")))
+		if done {
+			require.Equal(t, 2, n)
+			return
+		}
+
+		buf := &bytes.Buffer{}
+		writeFuzzFields(buf, headers)
+		again := Headers{}
+		m, _, err := again.parse(buf.Bytes())
+		require.NoError(t, err)
+		if len(headers) == 0 {
+			// Fields with an empty value are dropped
+			assert.Equal(t, 2, m)
+			return
+		}
+		assert.Equal(t, headers, again)
+	})
+}
+
+// Invariants: no panics, and a parsed request-line is written back byte
+// for byte
+func FuzzStatusLineParse(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+	f.Add([]byte("POST /a?b=c HTTP/1.0\r\n"))
+	f.Add([]byte("get / HTTP/1.1\r\n"))
+	f.Add([]byte("GET  / HTTP/1.1\r\n"))
+	f.Add([]byte("GET / HTTP/2.0\r\n"))
+	f.Add([]byte("GET / HTTP/1.1"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sl := StatusLine{}
+		n, err := sl.parse(data)
+		if err != nil || n == 0 { return }
+		require.LessOrEqual(t, n, len(data))
+		assert.Equal(t, string(data[:n]), sl.Method + " " + sl.Target + " " + sl.Version + "\r\n")
+	})
+}
+
+// Invariants: no panics, the body and trailers do not depend on how the
+// input is split into reads or how small the reads of the body are, and a
+// decoded body decodes the same when encoded again
+func FuzzChunkedBody(f *testing.F) {
+	f.Add([]byte("5\r\nhello\r\n0\r\n\r\n"), uint8(3))
+	f.Add([]byte("5;a=b\r\nhello\r\n6 ; c\r\n world\r\n0\r\nX-Sum: 1\r\n\r\n"), uint8(1))
+	f.Add([]byte("A\r\n0123456789\r\n0\r\n\r\n"), uint8(4))
+	f.Add([]byte("5\r\nhelloXX\r\n0\r\n\r\n"), uint8(2))
+	f.Add([]byte("ffffffffffffffff\r\n"), uint8(5))
+	f.Add([]byte("-1\r\n\r\n"), uint8(5))
+	f.Add([]byte("5\r\nhel"), uint8(2))
+	f.Add([]byte("0\r\nBad Trailer\r\n\r\n"), uint8(8))
+
+	decode := func(data []byte, per_read int, buf_size int) ([]byte, Headers, error) {
+		rc := &chunkReader{data: string(data), numBytesPerRead: per_read}
+		b := &body{
+			rc: rc,
+			rb: &readBuffer{rd: rc, buf: make([]byte, buffer_size)},
+			is_chunked: true,
+			trailers: Headers{},
+		}
+		decoded := []byte{}
+		buf := make([]byte, buf_size)
+		for {
+			n, err := b.Read(buf)
+			decoded = append(decoded, buf[:n]...)
+			if errors.Is(err, io.EOF) { return decoded, b.trailers, nil }
+			if err != nil { return nil, nil, err }
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, per_read uint8) {
+		per_read = max(per_read, 1)
+		decoded, trailers, err := decode(data, max(len(data), 1), 32 * 1024)
+		split, split_trailers, split_err := decode(data, int(per_read), 1)
+		require.Equal(t, err == nil, split_err == nil, "whole: %v, split: %v", err, split_err)
+		if err != nil { return }
+		assert.Equal(t, decoded, split)
+		assert.Equal(t, trailers, split_trailers)
+
+		buf := &bytes.Buffer{}
+		if len(decoded) > 0 { fmt.Fprintf(buf, "%x\r\n%s\r\n", len(decoded), decoded) }
+		buf.WriteString("0\r\n")
+		writeFuzzFields(buf, trailers)
+		again, again_trailers, err := decode(buf.Bytes(), int(per_read), 5)
+		require.NoError(t, err)
+		assert.Equal(t, decoded, again)
+		assert.Equal(t, trailers, again_trailers)
+	})
+}
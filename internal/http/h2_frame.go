@@ -0,0 +1,158 @@
+package http
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Sent by the client to start HTTP/2. See RFC 9113 3.4
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+type h2FrameType uint8
+const (
+	h2FrameData h2FrameType = 0x0
+	h2FrameHeaders h2FrameType = 0x1
+	h2FramePriority h2FrameType = 0x2
+	h2FrameRSTStream h2FrameType = 0x3
+	h2FrameSettings h2FrameType = 0x4
+	h2FramePushPromise h2FrameType = 0x5
+	h2FramePing h2FrameType = 0x6
+	h2FrameGoAway h2FrameType = 0x7
+	h2FrameWindowUpdate h2FrameType = 0x8
+	h2FrameContinuation h2FrameType = 0x9
+)
+
+const (
+	h2FlagEndStream = 0x1
+	h2FlagAck = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded = 0x8
+	h2FlagPriority = 0x20
+)
+
+// Error codes. See RFC 9113 7
+type h2ErrCode uint32
+const (
+	h2ErrNoError h2ErrCode = 0x0
+	h2ErrProtocol h2ErrCode = 0x1
+	h2ErrInternal h2ErrCode = 0x2
+	h2ErrFlowControl h2ErrCode = 0x3
+	h2ErrStreamClosed h2ErrCode = 0x5
+	h2ErrFrameSize h2ErrCode = 0x6
+	h2ErrRefusedStream h2ErrCode = 0x7
+	h2ErrCancel h2ErrCode = 0x8
+	h2ErrCompression h2ErrCode = 0x9
+)
+
+// Settings. See RFC 9113 6.5.2
+const (
+	h2SettingHeaderTableSize = 0x1
+	h2SettingEnablePush = 0x2
+	h2SettingMaxConcurrentStreams = 0x3
+	h2SettingInitialWindowSize = 0x4
+	h2SettingMaxFrameSize = 0x5
+	h2SettingMaxHeaderListSize = 0x6
+)
+
+const (
+	h2DefaultMaxFrameSize = 16384
+	h2DefaultWindowSize = 65535
+	h2MaxWindowSize = 1<<31 - 1
+	h2MaxConcurrentStreams = 100
+	// Limit for a header block spread over HEADERS and CONTINUATION frames
+	h2MaxHeaderBlockSize = 1 << 20
+)
+
+type h2Frame struct {
+	typ h2FrameType
+	flags uint8
+	stream_id uint32
+	payload []byte
+}
+
+// Makes the peer close the connection
+type h2ConnError struct {
+	code h2ErrCode
+	reason string
+}
+
+func (e h2ConnError) Error() string {
+	return fmt.Sprintf("HTTP/2 connection error %d: %s", e.code, e.reason)
+}
+
+// Resets a single stream
+type h2StreamError struct {
+	stream_id uint32
+	code h2ErrCode
+	reason string
+}
+
+func (e h2StreamError) Error() string {
+	return fmt.Sprintf("HTTP/2 stream %d error %d: %s", e.stream_id, e.code, e.reason)
+}
+
+// See RFC 9113 4.1
+func readH2Frame(r io.Reader, max_size uint32) (h2Frame, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil { return h2Frame{}, err }
+
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	f := h2Frame{
+		typ: h2FrameType(header[3]),
+		flags: header[4],
+		// The reserved bit is ignored
+		stream_id: binary.BigEndian.Uint32(header[5:]) & 0x7fffffff,
+	}
+	if length > max_size {
+		return f, h2ConnError{h2ErrFrameSize, "Frame exceeds maximum size"}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil { return f, err }
+	return f, nil
+}
+
+func appendH2Frame(dst []byte, typ h2FrameType, flags uint8, stream_id uint32, payload []byte) []byte {
+	length := len(payload)
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, stream_id & 0x7fffffff)
+	return append(dst, payload...)
+}
+
+// Strips padding from DATA and HEADERS payloads. See RFC 9113 6.1
+func h2StripPadding(f h2Frame) ([]byte, error) {
+	if f.flags & h2FlagPadded == 0 { return f.payload, nil }
+	if len(f.payload) < 1 { return nil, h2ConnError{h2ErrFrameSize, "Missing pad length"} }
+	pad_length := int(f.payload[0])
+	if pad_length >= len(f.payload) {
+		return nil, h2ConnError{h2ErrProtocol, "Padding exceeds payload"}
+	}
+	return f.payload[1 : len(f.payload)-pad_length], nil
+}
+
+type h2Setting struct {
+	id uint16
+	value uint32
+}
+
+func parseH2Settings(payload []byte) ([]h2Setting, error) {
+	if len(payload) % 6 != 0 {
+		return nil, h2ConnError{h2ErrFrameSize, "Invalid SETTINGS length"}
+	}
+	settings := []h2Setting{}
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, h2Setting{
+			id: binary.BigEndian.Uint16(payload[i:]),
+			value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendH2Settings(dst []byte, settings ...h2Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, s.id)
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+	return dst
+}
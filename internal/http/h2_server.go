@@ -0,0 +1,535 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/lieberdev/http/internal/hpack"
+)
+
+var (
+	errH2StreamReset = errors.New("HTTP/2 stream was reset")
+	errH2ConnClosed = errors.New("HTTP/2 connection is closed")
+)
+
+// Serves HTTP/2 on a single connection. See RFC 9113
+type h2Conn struct {
+	srv *Server
+	c *conn
+	br *bufio.Reader
+	dec *hpack.Decoder
+	// Header block of a HEADERS frame waiting for CONTINUATION frames
+	header_stream uint32
+	header_flags uint8
+	header_block []byte
+
+	// Serializes frame writes and the header encoder
+	write_mu sync.Mutex
+	enc *hpack.Encoder
+
+	mu sync.Mutex
+	// Signalled when send windows grow, streams are reset or the
+	// connection closes
+	cond *sync.Cond
+	streams map[uint32]*h2Stream
+	// Handlers still running, streams reset by the client included
+	running_handlers int
+	last_stream_id uint32
+	peer_max_frame_size uint32
+	peer_initial_window int64
+	send_window int64
+	recv_window int64
+	going_away bool
+	closed bool
+	handlers sync.WaitGroup
+}
+
+// Serves HTTP/2 until the connection closes. upgrade is the request of an
+// h2c upgrade, which becomes stream 1, and buffered holds bytes already
+// read past it
+func (s *Server) serveH2(c *conn, upgrade *Request, settings []h2Setting, buffered []byte) {
+	hc := &h2Conn{
+		srv: s,
+		c: c,
+		br: bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), c.r)),
+		dec: hpack.NewDecoder(hpack.DefaultTableSize),
+		enc: hpack.NewEncoder(),
+		streams: map[uint32]*h2Stream{},
+		peer_max_frame_size: h2DefaultMaxFrameSize,
+		peer_initial_window: h2DefaultWindowSize,
+		send_window: h2DefaultWindowSize,
+		recv_window: h2DefaultWindowSize,
+	}
+	hc.cond = sync.NewCond(&hc.mu)
+	hc.dec.MaxStringLength = h2MaxHeaderBlockSize
+	// Decoded header lists are limited like HTTP/1.x heads
+	hc.dec.MaxHeaderListSize = maxHeadSize
+	defer hc.close()
+
+	// The server preface is a SETTINGS frame. See RFC 9113 3.4
+	preface := appendH2Settings(nil,
+		h2Setting{h2SettingMaxConcurrentStreams, h2MaxConcurrentStreams},
+		h2Setting{h2SettingMaxHeaderListSize, maxHeadSize},
+	)
+	if err := hc.writeFrames(appendH2Frame(nil, h2FrameSettings, 0, 0, preface)); err != nil { return }
+
+	// Close idle connections once the server shuts down
+	go func() {
+		<-c.ctx.Done()
+		hc.goAway(h2ErrNoError)
+	}()
+
+	if upgrade != nil {
+		if err := hc.applySettings(settings); err != nil { return }
+		hc.serveUpgrade(upgrade)
+
+		// The client sends its preface after the 101 response
+		prefix := make([]byte, len(h2Preface))
+		if _, err := io.ReadFull(hc.br, prefix); err != nil || string(prefix) != h2Preface { return }
+	}
+
+	err := hc.readFrames()
+	var ce h2ConnError
+	if errors.As(err, &ce) { hc.goAway(ce.code) }
+}
+
+func (hc *h2Conn) readFrames() error {
+	first := true
+	for {
+		f, err := readH2Frame(hc.br, h2DefaultMaxFrameSize)
+		if err != nil { return err }
+		// The client preface ends with a SETTINGS frame
+		if first && (f.typ != h2FrameSettings || f.flags & h2FlagAck != 0) {
+			return h2ConnError{h2ErrProtocol, "Expected SETTINGS frame"}
+		}
+		first = false
+
+		err = hc.processFrame(f)
+		var se h2StreamError
+		if errors.As(err, &se) {
+			hc.resetStream(se.stream_id, se.code)
+			continue
+		}
+		if err != nil { return err }
+	}
+}
+
+func (hc *h2Conn) processFrame(f h2Frame) error {
+	// A header block must not be interleaved with other frames
+	if hc.header_stream != 0 && f.typ != h2FrameContinuation {
+		return h2ConnError{h2ErrProtocol, "Expected CONTINUATION frame"}
+	}
+
+	switch f.typ {
+	case h2FrameData:
+		return hc.processData(f)
+	case h2FrameHeaders:
+		return hc.processHeaders(f)
+	case h2FrameContinuation:
+		return hc.processContinuation(f)
+	case h2FramePriority:
+		if f.stream_id == 0 { return h2ConnError{h2ErrProtocol, "PRIORITY on stream 0"} }
+		if len(f.payload) != 5 {
+			return h2StreamError{f.stream_id, h2ErrFrameSize, "Invalid PRIORITY length"}
+		}
+		// Prioritization is deprecated and not implemented
+		return nil
+	case h2FrameRSTStream:
+		return hc.processRSTStream(f)
+	case h2FrameSettings:
+		return hc.processSettings(f)
+	case h2FramePushPromise:
+		return h2ConnError{h2ErrProtocol, "Clients must not send PUSH_PROMISE"}
+	case h2FramePing:
+		if f.stream_id != 0 { return h2ConnError{h2ErrProtocol, "PING on a stream"} }
+		if len(f.payload) != 8 { return h2ConnError{h2ErrFrameSize, "Invalid PING length"} }
+		if f.flags & h2FlagAck != 0 { return nil }
+		return hc.writeFrames(appendH2Frame(nil, h2FramePing, h2FlagAck, 0, f.payload))
+	case h2FrameGoAway:
+		if f.stream_id != 0 { return h2ConnError{h2ErrProtocol, "GOAWAY on a stream"} }
+		// Running streams are finished, the client closes the connection
+		return nil
+	case h2FrameWindowUpdate:
+		return hc.processWindowUpdate(f)
+	default:
+		// Unknown frame types are ignored. See RFC 9113 4.1
+		return nil
+	}
+}
+
+func (hc *h2Conn) processHeaders(f h2Frame) error {
+	if f.stream_id == 0 { return h2ConnError{h2ErrProtocol, "HEADERS on stream 0"} }
+	block, err := h2StripPadding(f)
+	if err != nil { return err }
+	if f.flags & h2FlagPriority != 0 {
+		if len(block) < 5 { return h2ConnError{h2ErrFrameSize, "Missing priority fields"} }
+		block = block[5:]
+	}
+
+	if f.flags & h2FlagEndHeaders == 0 {
+		hc.header_stream = f.stream_id
+		hc.header_flags = f.flags
+		hc.header_block = bytes.Clone(block)
+		return nil
+	}
+	return hc.processHeaderBlock(f.stream_id, f.flags, block)
+}
+
+func (hc *h2Conn) processContinuation(f h2Frame) error {
+	if hc.header_stream == 0 || f.stream_id != hc.header_stream {
+		return h2ConnError{h2ErrProtocol, "Unexpected CONTINUATION frame"}
+	}
+	hc.header_block = append(hc.header_block, f.payload...)
+	if len(hc.header_block) > h2MaxHeaderBlockSize {
+		return h2ConnError{h2ErrProtocol, "Header block is too large"}
+	}
+	if f.flags & h2FlagEndHeaders == 0 { return nil }
+
+	stream_id, flags, block := hc.header_stream, hc.header_flags, hc.header_block
+	hc.header_stream = 0
+	hc.header_block = nil
+	return hc.processHeaderBlock(stream_id, flags, block)
+}
+
+func (hc *h2Conn) processHeaderBlock(stream_id uint32, flags uint8, block []byte) error {
+	// Decoding keeps the decoder state in sync even for ignored streams
+	fields, err := hc.dec.Decode(block)
+	too_large := errors.Is(err, hpack.ErrHeaderListTooLarge)
+	if err != nil && !too_large { return h2ConnError{h2ErrCompression, err.Error()} }
+	end_stream := flags & h2FlagEndStream != 0
+
+	hc.mu.Lock()
+	st := hc.streams[stream_id]
+	if st != nil {
+		hc.mu.Unlock()
+		if too_large { return h2StreamError{st.id, h2ErrProtocol, "Trailers are too large"} }
+		return hc.processTrailers(st, fields, end_stream)
+	}
+	if stream_id % 2 == 0 {
+		hc.mu.Unlock()
+		return h2ConnError{h2ErrProtocol, "Client stream IDs must be odd"}
+	}
+	if stream_id <= hc.last_stream_id {
+		// Frames in flight for a stream that was already closed
+		hc.mu.Unlock()
+		return nil
+	}
+	hc.last_stream_id = stream_id
+	// A reset stream is forgotten right away but its handler may keep
+	// running, so opening and resetting streams must not start more
+	active := hc.running_handlers
+	going_away := hc.going_away
+	hc.mu.Unlock()
+
+	// Streams after GOAWAY are not processed. See RFC 9113 6.8
+	if going_away { return nil }
+	if active >= h2MaxConcurrentStreams {
+		return h2StreamError{stream_id, h2ErrRefusedStream, "Too many concurrent streams"}
+	}
+
+	if too_large {
+		// See RFC 9113 10.5.1
+		st = hc.newStream(stream_id, -1, end_stream)
+		hc.writeHeaders(st, StatusRequestHeaderFieldsTooLarge, Headers{}, true)
+		if !end_stream { hc.resetStream(stream_id, h2ErrNoError) }
+		return nil
+	}
+
+	r, content_length, err := newH2Request(fields)
+	if err != nil { return h2StreamError{stream_id, h2ErrProtocol, err.Error()} }
+	if end_stream && content_length > 0 {
+		return h2StreamError{stream_id, h2ErrProtocol, "Body does not match Content-Length"}
+	}
+
+	st = hc.newStream(stream_id, content_length, end_stream)
+	hc.srv.initRequest(hc.c, r)
+	r.ctx = st.ctx
+	r.Body = st.body
+	r.Trailers = st.body.trailers
+	hc.startHandler(st, r)
+	return nil
+}
+
+func (hc *h2Conn) processTrailers(st *h2Stream, fields []hpack.HeaderField, end_stream bool) error {
+	if st.remote_closed { return h2StreamError{st.id, h2ErrStreamClosed, "HEADERS on closed stream"} }
+	if !end_stream { return h2StreamError{st.id, h2ErrProtocol, "Trailers must end the stream"} }
+
+	st.body.mu.Lock()
+	for _, hf := range fields {
+		if strings.HasPrefix(hf.Name, ":") {
+			st.body.mu.Unlock()
+			return h2StreamError{st.id, h2ErrProtocol, "Pseudo-header in trailers"}
+		}
+		st.body.trailers.Add(hf.Name, hf.Value)
+	}
+	st.body.mu.Unlock()
+	return hc.endRemote(st)
+}
+
+func (hc *h2Conn) processData(f h2Frame) error {
+	if f.stream_id == 0 { return h2ConnError{h2ErrProtocol, "DATA on stream 0"} }
+	data, err := h2StripPadding(f)
+	if err != nil { return err }
+
+	// Flow control counts the whole payload, padding included. See RFC 9113 6.9.1
+	size := len(f.payload)
+	hc.mu.Lock()
+	hc.recv_window -= int64(size)
+	if hc.recv_window < 0 {
+		hc.mu.Unlock()
+		return h2ConnError{h2ErrFlowControl, "Connection flow control window exceeded"}
+	}
+	st := hc.streams[f.stream_id]
+	if st == nil {
+		idle := f.stream_id > hc.last_stream_id
+		hc.mu.Unlock()
+		if idle { return h2ConnError{h2ErrProtocol, "DATA on idle stream"} }
+		// Nobody reads the data, so its window is returned right away
+		hc.returnWindow(nil, size)
+		return nil
+	}
+	if st.remote_closed {
+		hc.mu.Unlock()
+		hc.returnWindow(nil, size)
+		return h2StreamError{st.id, h2ErrStreamClosed, "DATA on closed stream"}
+	}
+	st.recv_window -= int64(size)
+	if st.recv_window < 0 {
+		hc.mu.Unlock()
+		// The stream is reset, but the connection still counts the data
+		hc.returnWindow(nil, size)
+		return h2StreamError{st.id, h2ErrFlowControl, "Stream flow control window exceeded"}
+	}
+	st.received += int64(len(data))
+	hc.mu.Unlock()
+
+	if padding := size - len(data); padding > 0 { hc.returnWindow(st, padding) }
+	if st.content_length >= 0 && st.received > st.content_length {
+		hc.returnWindow(nil, len(data))
+		return h2StreamError{st.id, h2ErrProtocol, "Body exceeds Content-Length"}
+	}
+	st.body.write(data)
+
+	if f.flags & h2FlagEndStream != 0 { return hc.endRemote(st) }
+	return nil
+}
+
+func (hc *h2Conn) processRSTStream(f h2Frame) error {
+	if f.stream_id == 0 { return h2ConnError{h2ErrProtocol, "RST_STREAM on stream 0"} }
+	if len(f.payload) != 4 { return h2ConnError{h2ErrFrameSize, "Invalid RST_STREAM length"} }
+
+	hc.mu.Lock()
+	st := hc.streams[f.stream_id]
+	idle := f.stream_id > hc.last_stream_id
+	hc.mu.Unlock()
+	if idle { return h2ConnError{h2ErrProtocol, "RST_STREAM on idle stream"} }
+	if st != nil { hc.abortStream(st) }
+	return nil
+}
+
+func (hc *h2Conn) processSettings(f h2Frame) error {
+	if f.stream_id != 0 { return h2ConnError{h2ErrProtocol, "SETTINGS on a stream"} }
+	if f.flags & h2FlagAck != 0 {
+		if len(f.payload) != 0 { return h2ConnError{h2ErrFrameSize, "SETTINGS ACK with payload"} }
+		return nil
+	}
+
+	settings, err := parseH2Settings(f.payload)
+	if err != nil { return err }
+	if err := hc.applySettings(settings); err != nil { return err }
+	return hc.writeFrames(appendH2Frame(nil, h2FrameSettings, h2FlagAck, 0, nil))
+}
+
+// Unknown settings are ignored. See RFC 9113 6.5.2
+func (hc *h2Conn) applySettings(settings []h2Setting) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case h2SettingEnablePush:
+			if s.value > 1 { return h2ConnError{h2ErrProtocol, "Invalid SETTINGS_ENABLE_PUSH"} }
+		case h2SettingInitialWindowSize:
+			if s.value > h2MaxWindowSize {
+				return h2ConnError{h2ErrFlowControl, "Invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			// Applies to the windows of all open streams. See RFC 9113 6.9.2
+			delta := int64(s.value) - hc.peer_initial_window
+			hc.peer_initial_window = int64(s.value)
+			for _, st := range hc.streams {
+				st.send_window += delta
+				if st.send_window > h2MaxWindowSize {
+					return h2ConnError{h2ErrFlowControl, "Stream flow control window overflow"}
+				}
+			}
+			hc.cond.Broadcast()
+		case h2SettingMaxFrameSize:
+			if s.value < h2DefaultMaxFrameSize || s.value > 1<<24 - 1 {
+				return h2ConnError{h2ErrProtocol, "Invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			hc.peer_max_frame_size = s.value
+		}
+		// SETTINGS_HEADER_TABLE_SIZE needs no handling, the encoder never
+		// uses the dynamic table
+	}
+	return nil
+}
+
+func (hc *h2Conn) processWindowUpdate(f h2Frame) error {
+	if len(f.payload) != 4 { return h2ConnError{h2ErrFrameSize, "Invalid WINDOW_UPDATE length"} }
+	increment := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if f.stream_id == 0 {
+		if increment == 0 { return h2ConnError{h2ErrProtocol, "WINDOW_UPDATE with zero increment"} }
+		hc.send_window += increment
+		if hc.send_window > h2MaxWindowSize {
+			return h2ConnError{h2ErrFlowControl, "Connection flow control window overflow"}
+		}
+		hc.cond.Broadcast()
+		return nil
+	}
+
+	if increment == 0 { return h2StreamError{f.stream_id, h2ErrProtocol, "WINDOW_UPDATE with zero increment"} }
+	st := hc.streams[f.stream_id]
+	if st == nil { return nil }
+	st.send_window += increment
+	if st.send_window > h2MaxWindowSize {
+		return h2StreamError{st.id, h2ErrFlowControl, "Stream flow control window overflow"}
+	}
+	hc.cond.Broadcast()
+	return nil
+}
+
+// Gives n consumed bytes back to the client's connection window and, while
+// the client still sends, to the stream's window
+func (hc *h2Conn) returnWindow(st *h2Stream, n int) {
+	if n <= 0 { return }
+	increment := binary.BigEndian.AppendUint32(nil, uint32(n))
+
+	hc.mu.Lock()
+	hc.recv_window += int64(n)
+	frames := appendH2Frame(nil, h2FrameWindowUpdate, 0, 0, increment)
+	if st != nil && !st.remote_closed && !st.reset {
+		st.recv_window += int64(n)
+		frames = appendH2Frame(frames, h2FrameWindowUpdate, 0, st.id, increment)
+	}
+	hc.mu.Unlock()
+	hc.writeFrames(frames)
+}
+
+func (hc *h2Conn) writeFrames(frames []byte) error {
+	hc.write_mu.Lock()
+	defer hc.write_mu.Unlock()
+	_, err := hc.c.rwc.Write(frames)
+	return err
+}
+
+// Sends a RST_STREAM frame and forgets the stream
+func (hc *h2Conn) resetStream(stream_id uint32, code h2ErrCode) {
+	hc.writeFrames(appendH2Frame(nil, h2FrameRSTStream, 0, stream_id, binary.BigEndian.AppendUint32(nil, uint32(code))))
+	hc.mu.Lock()
+	st := hc.streams[stream_id]
+	hc.mu.Unlock()
+	if st != nil { hc.abortStream(st) }
+}
+
+// Fails pending reads and writes of the stream and cancels its context
+func (hc *h2Conn) abortStream(st *h2Stream) {
+	hc.mu.Lock()
+	st.reset = true
+	hc.mu.Unlock()
+	hc.cond.Broadcast()
+	st.cancel()
+	st.body.finish(errH2StreamReset)
+	hc.removeStream(st)
+}
+
+// Tells the client to stop opening streams. Running streams are finished,
+// then the connection is closed. See RFC 9113 6.8
+func (hc *h2Conn) goAway(code h2ErrCode) {
+	hc.mu.Lock()
+	if hc.going_away {
+		hc.mu.Unlock()
+		return
+	}
+	hc.going_away = true
+	payload := binary.BigEndian.AppendUint32(nil, hc.last_stream_id)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	idle := len(hc.streams) == 0
+	hc.mu.Unlock()
+
+	hc.writeFrames(appendH2Frame(nil, h2FrameGoAway, 0, 0, payload))
+	if idle { hc.c.rwc.Close() }
+}
+
+// Fails all streams and waits for their handlers
+func (hc *h2Conn) close() {
+	hc.mu.Lock()
+	hc.closed = true
+	// No GOAWAY on a connection that is gone
+	hc.going_away = true
+	streams := []*h2Stream{}
+	for _, st := range hc.streams { streams = append(streams, st) }
+	hc.mu.Unlock()
+	hc.cond.Broadcast()
+
+	for _, st := range streams {
+		st.cancel()
+		st.body.finish(errH2ConnClosed)
+	}
+	hc.handlers.Wait()
+}
+
+// An h2c upgrade needs HTTP2-Settings and a request without body, which
+// would otherwise have to be read before switching. Upgrades are only
+// done without TLS. See RFC 7540 3.2
+func h2cUpgradeSettings(c *conn, r *Request) ([]h2Setting, bool) {
+	if _, ok := c.rwc.(*tls.Conn); ok { return nil, false }
+	if !HeaderHasToken(r.Headers.Get("upgrade"), "h2c") { return nil, false }
+	connection := r.Headers.Get("connection")
+	if !HeaderHasToken(connection, "upgrade") || !HeaderHasToken(connection, "http2-settings") {
+		return nil, false
+	}
+	if c.body != nil && !c.body.done() { return nil, false }
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.Headers.Get("http2-settings"), "="))
+	if err != nil { return nil, false }
+	settings, err := parseH2Settings(payload)
+	if err != nil { return nil, false }
+	return settings, true
+}
+
+func (s *Server) upgradeH2C(c *conn, r *Request, settings []h2Setting) {
+	_, err := c.rwc.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+	if err != nil { return }
+
+	// The parser may have read past the request already
+	buffered := bytes.Clone(c.rr.rb.buffered())
+	s.serveH2(c, r, settings, buffered)
+}
+
+// Serves the upgrade request as stream 1, which the client already closed
+func (hc *h2Conn) serveUpgrade(r *Request) {
+	for _, name := range []string{"connection", "upgrade", "http2-settings"} {
+		delete(r.Headers, name)
+	}
+	r.StatusLine.Version = "HTTP/2.0"
+	r.Proto = "HTTP/2.0"
+
+	hc.mu.Lock()
+	hc.last_stream_id = 1
+	hc.mu.Unlock()
+	st := hc.newStream(1, 0, true)
+	r.ctx = st.ctx
+	r.Body = st.body
+	r.Trailers = st.body.trailers
+	hc.startHandler(st, r)
+}
@@ -0,0 +1,433 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lieberdev/http/internal/hpack"
+)
+
+// A single request and response exchange on an HTTP/2 connection.
+// Fields below body are guarded by hc.mu
+type h2Stream struct {
+	id uint32
+	hc *h2Conn
+	// Cancelled when the stream is reset or the handler returns
+	ctx context.Context
+	cancel context.CancelFunc
+	body *h2Body
+	send_window int64
+	recv_window int64
+	// END_STREAM was received from the client
+	remote_closed bool
+	// END_STREAM was sent to the client
+	local_closed bool
+	reset bool
+	// From the Content-Length header, -1 if not sent
+	content_length int64
+	received int64
+}
+
+func (hc *h2Conn) newStream(id uint32, content_length int64, end_stream bool) *h2Stream {
+	st := &h2Stream{
+		id: id,
+		hc: hc,
+		remote_closed: end_stream,
+		recv_window: h2DefaultWindowSize,
+		content_length: content_length,
+	}
+	st.ctx, st.cancel = context.WithCancel(hc.c.ctx)
+	st.body = &h2Body{st: st, trailers: Headers{}}
+	st.body.cond = sync.NewCond(&st.body.mu)
+	if end_stream { st.body.finish(nil) }
+
+	hc.mu.Lock()
+	st.send_window = hc.peer_initial_window
+	hc.streams[id] = st
+	hc.mu.Unlock()
+	return st
+}
+
+// Forgets the stream. Its unread body is discarded, so the client gets the
+// connection window back
+func (hc *h2Conn) removeStream(st *h2Stream) {
+	st.body.Close()
+	hc.mu.Lock()
+	delete(hc.streams, st.id)
+	// Finish a graceful shutdown once the last stream is done
+	idle := hc.going_away && !hc.closed && len(hc.streams) == 0
+	hc.mu.Unlock()
+	if idle { hc.c.rwc.Close() }
+}
+
+// The client finished sending the request
+func (hc *h2Conn) endRemote(st *h2Stream) error {
+	if st.content_length >= 0 && st.received != st.content_length {
+		return h2StreamError{st.id, h2ErrProtocol, "Body does not match Content-Length"}
+	}
+	hc.mu.Lock()
+	st.remote_closed = true
+	closed := st.local_closed
+	hc.mu.Unlock()
+
+	st.body.finish(nil)
+	if closed { hc.removeStream(st) }
+	return nil
+}
+
+// The response was sent completely
+func (hc *h2Conn) endLocal(st *h2Stream) {
+	hc.mu.Lock()
+	st.local_closed = true
+	closed := st.remote_closed
+	hc.mu.Unlock()
+	if closed { hc.removeStream(st) }
+}
+
+func (hc *h2Conn) startHandler(st *h2Stream, r *Request) {
+	hc.handlers.Add(1)
+	hc.mu.Lock()
+	hc.running_handlers++
+	hc.mu.Unlock()
+	go func() {
+		defer hc.handlers.Done()
+		defer func() {
+			hc.mu.Lock()
+			hc.running_handlers--
+			hc.mu.Unlock()
+		}()
+		defer st.cancel()
+
+		w := ResponseWriter{
+			Headers: Headers{},
+			state: writingStatusLine,
+			stream: st,
+			head: r.StatusLine.Method == "HEAD",
+		}
+		hc.srv.Handler(w, r)
+		// The window of a body the handler did not read is returned
+		st.body.Close()
+
+		hc.mu.Lock()
+		local_closed, remote_closed, reset := st.local_closed, st.remote_closed, st.reset
+		hc.mu.Unlock()
+		switch {
+		case reset:
+		case !local_closed:
+			// The handler did not finish the response
+			hc.resetStream(st.id, h2ErrInternal)
+		case !remote_closed:
+			// The rest of the request body is not needed. See RFC 9113 8.1
+			hc.resetStream(st.id, h2ErrNoError)
+		}
+	}()
+}
+
+func (st *h2Stream) writable() error {
+	if st.reset { return errH2StreamReset }
+	if st.hc.closed { return errH2ConnClosed }
+	if st.local_closed { return fmt.Errorf("HTTP/2 stream %d is closed", st.id) }
+	return nil
+}
+
+// Headers that only apply to a single HTTP/1.1 connection. See RFC 9113 8.2.2
+var h2ConnectionHeaders = map[string]bool{
+	"connection": true,
+	"keep-alive": true,
+	"proxy-connection": true,
+	"transfer-encoding": true,
+	"upgrade": true,
+}
+
+// Sends headers in a HEADERS frame and as many CONTINUATION frames as
+// needed. A status of 0 sends trailers
+func (hc *h2Conn) writeHeaders(st *h2Stream, status ResponseStatusCode, headers Headers, end_stream bool) error {
+	fields := []hpack.HeaderField{}
+	if status != 0 {
+		fields = append(fields, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(int(status))})
+	}
+	for name, value := range headers {
+		name = strings.ToLower(name)
+		if h2ConnectionHeaders[name] { continue }
+		for _, value := range strings.Split(value, "\n") {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: value})
+		}
+	}
+
+	// The frames of a header block must not be interleaved with others
+	hc.write_mu.Lock()
+	defer hc.write_mu.Unlock()
+	hc.mu.Lock()
+	err := st.writable()
+	max_frame_size := int(hc.peer_max_frame_size)
+	hc.mu.Unlock()
+	if err != nil { return err }
+
+	block := hc.enc.Encode(nil, fields)
+	frames := []byte{}
+	typ := h2FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		fragment := block[:min(len(block), max_frame_size)]
+		block = block[len(fragment):]
+		flags := uint8(0)
+		if first && end_stream { flags |= h2FlagEndStream }
+		if len(block) == 0 { flags |= h2FlagEndHeaders }
+		frames = appendH2Frame(frames, typ, flags, st.id, fragment)
+		typ = h2FrameContinuation
+	}
+	if _, err := hc.c.rwc.Write(frames); err != nil { return err }
+
+	if end_stream { hc.endLocal(st) }
+	return nil
+}
+
+// Sends data in DATA frames as the flow control windows allow. An empty
+// data with end_stream only ends the stream
+func (hc *h2Conn) writeData(st *h2Stream, data []byte, end_stream bool) (int, error) {
+	total_written := 0
+	for len(data) > 0 || end_stream {
+		hc.mu.Lock()
+		for len(data) > 0 && (hc.send_window <= 0 || st.send_window <= 0) && !st.reset && !hc.closed {
+			hc.cond.Wait()
+		}
+		if err := st.writable(); err != nil {
+			hc.mu.Unlock()
+			return total_written, err
+		}
+		n := min(int64(len(data)), hc.send_window, st.send_window, int64(hc.peer_max_frame_size))
+		hc.send_window -= n
+		st.send_window -= n
+		hc.mu.Unlock()
+
+		last := end_stream && int(n) == len(data)
+		flags := uint8(0)
+		if last { flags = h2FlagEndStream }
+		if err := hc.writeFrames(appendH2Frame(nil, h2FrameData, flags, st.id, data[:n])); err != nil {
+			return total_written, err
+		}
+		total_written += int(n)
+		data = data[n:]
+
+		if last {
+			hc.endLocal(st)
+			break
+		}
+	}
+	return total_written, nil
+}
+
+// Request body of a stream, filled by the connection's read loop
+type h2Body struct {
+	st *h2Stream
+	mu sync.Mutex
+	cond *sync.Cond
+	buf []byte
+	eof bool
+	err error
+	closed bool
+	trailers Headers
+}
+
+func (b *h2Body) Read(data []byte) (int, error) {
+	if len(data) == 0 { return 0, nil }
+
+	b.mu.Lock()
+	for len(b.buf) == 0 && !b.eof && b.err == nil && !b.closed { b.cond.Wait() }
+	if b.closed {
+		// A reset stream reports why the body ended
+		err := b.err
+		b.mu.Unlock()
+		if err != nil { return 0, err }
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.buf) == 0 {
+		err := b.err
+		b.mu.Unlock()
+		if err != nil { return 0, err }
+		return 0, io.EOF
+	}
+	n := copy(data, b.buf)
+	b.buf = b.buf[n:]
+	b.mu.Unlock()
+
+	// The client may send more once the data is consumed
+	b.st.hc.returnWindow(b.st, n)
+	return n, nil
+}
+
+// Discards the unread body
+func (b *h2Body) Close() error {
+	b.mu.Lock()
+	n := len(b.buf)
+	b.closed = true
+	b.buf = nil
+	b.mu.Unlock()
+	b.cond.Broadcast()
+
+	b.st.hc.returnWindow(b.st, n)
+	return nil
+}
+
+func (b *h2Body) write(data []byte) {
+	if len(data) == 0 { return }
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		b.st.hc.returnWindow(b.st, len(data))
+		return
+	}
+	b.buf = append(b.buf, data...)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Ends the body with io.EOF, or err if the stream failed
+func (b *h2Body) finish(err error) {
+	b.mu.Lock()
+	if err != nil && !b.eof {
+		b.err = err
+	}
+	b.eof = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Builds a request from the header block that opens a stream. Returns the
+// Content-Length, -1 if it was not sent. See RFC 9113 8.3.1
+func newH2Request(fields []hpack.HeaderField) (*Request, int64, error) {
+	r := &Request{
+		StatusLine: StatusLine{Version: "HTTP/2.0"},
+		Headers: Headers{},
+		Proto: "HTTP/2.0",
+		state: Done,
+	}
+
+	authority, scheme := "", ""
+	has_path := false
+	seen := map[string]bool{}
+	regular := false
+	cookies := []string{}
+	for _, hf := range fields {
+		if strings.ContainsAny(hf.Value, "\r\n\x00") {
+			return nil, 0, fmt.Errorf("Invalid value for header '%s'", hf.Name)
+		}
+
+		if strings.HasPrefix(hf.Name, ":") {
+			if regular { return nil, 0, fmt.Errorf("Pseudo-header after regular header: '%s'", hf.Name) }
+			if seen[hf.Name] { return nil, 0, fmt.Errorf("Duplicate pseudo-header: '%s'", hf.Name) }
+			seen[hf.Name] = true
+			switch hf.Name {
+			case ":method":
+				r.StatusLine.Method = hf.Value
+			case ":path":
+				r.StatusLine.Target = hf.Value
+				has_path = true
+			case ":scheme":
+				scheme = hf.Value
+			case ":authority":
+				authority = hf.Value
+			default:
+				return nil, 0, fmt.Errorf("Unknown pseudo-header: '%s'", hf.Name)
+			}
+			continue
+		}
+
+		regular = true
+		if hf.Name == "" || !isValidHeaderName(hf.Name) || strings.ToLower(hf.Name) != hf.Name {
+			return nil, 0, fmt.Errorf("Invalid header name: '%s'", hf.Name)
+		}
+		if h2ConnectionHeaders[hf.Name] {
+			return nil, 0, fmt.Errorf("Connection-specific header: '%s'", hf.Name)
+		}
+		if hf.Name == "te" && hf.Value != "trailers" {
+			return nil, 0, fmt.Errorf("TE header must be 'trailers'")
+		}
+		// Cookies may be split into several fields. See RFC 9113 8.2.3
+		if hf.Name == "cookie" {
+			cookies = append(cookies, hf.Value)
+			continue
+		}
+		r.Headers.Add(hf.Name, hf.Value)
+	}
+	if len(cookies) > 0 { r.Headers.Set("cookie", strings.Join(cookies, "; ")) }
+
+	if r.StatusLine.Method == "" { return nil, 0, fmt.Errorf("Missing :method pseudo-header") }
+	if r.StatusLine.Method == "CONNECT" {
+		if scheme != "" || has_path || authority == "" {
+			return nil, 0, fmt.Errorf("CONNECT needs only :authority")
+		}
+		r.StatusLine.Target = authority
+		r.Target = RequestTarget{Form: AuthorityForm, Authority: authority}
+	} else {
+		if scheme == "" || r.StatusLine.Target == "" {
+			return nil, 0, fmt.Errorf("Missing :scheme or :path pseudo-header")
+		}
+		// :path is in origin-form or asterisk-form. See RFC 9113 8.3.1
+		target, err := parseRequestTarget(r.StatusLine.Method, r.StatusLine.Target)
+		if err != nil || target.Form == AbsoluteForm { return nil, 0, fmt.Errorf("Invalid :path pseudo-header") }
+		r.Target = target
+	}
+	if authority != "" && r.Headers.Get("host") == "" { r.Headers.Set("host", authority) }
+
+	content_length := int64(-1)
+	if value := r.Headers.Get("content-length"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 { return nil, 0, fmt.Errorf("Invalid Content-Length: '%s'", value) }
+		content_length = n
+	}
+	return r, content_length, nil
+}
+
+// Sends the status and headers of the response once
+func (w *ResponseWriter) writeH2Headers(end_stream bool) error {
+	w.setDateHeader()
+	return w.stream.hc.writeHeaders(w.stream, w.status, w.Headers, end_stream)
+}
+
+// Ends the stream with the trailers, or an empty DATA frame without them
+func (w *ResponseWriter) finishH2() error {
+	if len(w.Trailers) > 0 { return w.stream.hc.writeHeaders(w.stream, 0, w.Trailers, true) }
+	_, err := w.stream.hc.writeData(w.stream, nil, true)
+	return err
+}
+
+func (w *ResponseWriter) writeH2Body(data []byte) (int, error) {
+	w.state = done
+	// HEADERS alone end the stream. See RFC 9110 6.4.1
+	if !w.bodyAllowed() { return 0, w.writeH2Headers(true) }
+	has_trailers := len(w.Trailers) > 0
+	if err := w.writeH2Headers(len(data) == 0 && !has_trailers); err != nil { return 0, err }
+	if len(data) == 0 && !has_trailers { return 0, nil }
+
+	n, err := w.stream.hc.writeData(w.stream, data, !has_trailers)
+	if err != nil { return n, err }
+	if has_trailers {
+		return n, w.stream.hc.writeHeaders(w.stream, 0, w.Trailers, true)
+	}
+	return n, nil
+}
+
+func (w *ResponseWriter) writeH2BodyFrom(src io.Reader, size int64) (int64, error) {
+	w.state = done
+	if !w.bodyAllowed() { return 0, w.writeH2Headers(true) }
+	if err := w.writeH2Headers(false); err != nil { return 0, err }
+
+	n, err := io.Copy(h2DataWriter{w.stream}, src)
+	if err != nil { return n, err }
+	if n != size {
+		return n, fmt.Errorf("Body is shorter than size: %d of %d bytes", n, size)
+	}
+	return n, w.finishH2()
+}
+
+type h2DataWriter struct {
+	st *h2Stream
+}
+
+func (dw h2DataWriter) Write(data []byte) (int, error) {
+	return dw.st.hc.writeData(dw.st, data, false)
+}
@@ -0,0 +1,443 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lieberdev/http/internal/hpack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func h2Client() *nethttp.Client {
+	protocols := &nethttp.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	return &nethttp.Client{Transport: &nethttp.Transport{Protocols: protocols}}
+}
+
+func TestH2PriorKnowledge(t *testing.T) {
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil { return }
+		w.WriteStatusLine(StatusOK)
+		switch r.StatusLine.Target {
+		case "/trailers":
+			w.WriteHeaders(Headers{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"})
+			w.WriteTrailers(Headers{"x-checksum": r.Trailers.Get("x-checksum")})
+			w.WriteChunkedBody(data[:2])
+			w.WriteChunkedBody(data[2:])
+			w.WriteChunkedBodyDone()
+		case "/conn":
+			w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+			w.WriteBody([]byte(strconv.FormatUint(r.ConnID, 10)))
+		default:
+			w.WriteHeaders(Headers{
+				"Content-Type": "text/plain",
+				"X-Version": r.StatusLine.Version,
+				"X-Host": r.Headers.Get("host"),
+			})
+			w.WriteBody(data)
+		}
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	url := "http://" + srv.Listener.Addr().String()
+	client := h2Client()
+
+	t.Run("Get", func(t *testing.T) {
+		resp, err := client.Get(url + "/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Version"))
+		assert.Equal(t, srv.Listener.Addr().String(), resp.Header.Get("X-Host"))
+	})
+
+	t.Run("Large Body", func(t *testing.T) {
+		// Larger than the default flow control windows in both directions
+		data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+		resp, err := client.Post(url + "/", "application/octet-stream", bytes.NewReader(data))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		echoed, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.True(t, bytes.Equal(data, echoed))
+	})
+
+	t.Run("Trailers", func(t *testing.T) {
+		req, err := nethttp.NewRequest("POST", url + "/trailers", strings.NewReader("hello"))
+		require.NoError(t, err)
+		req.ContentLength = -1
+		req.Trailer = nethttp.Header{"X-Checksum": {"abc"}}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+		assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	})
+
+	t.Run("Multiplexing", func(t *testing.T) {
+		ids := make([]string, 20)
+		wg := sync.WaitGroup{}
+		for i := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(url + "/conn")
+				if !assert.NoError(t, err) { return }
+				defer resp.Body.Close()
+				data, _ := io.ReadAll(resp.Body)
+				ids[i] = string(data)
+			}()
+		}
+		wg.Wait()
+		// All requests share one connection
+		for _, id := range ids { assert.Equal(t, ids[0], id) }
+	})
+}
+
+// Minimal HTTP/2 client speaking raw frames
+type h2TestConn struct {
+	t *testing.T
+	conn net.Conn
+	br *bufio.Reader
+	enc *hpack.Encoder
+}
+
+func dialH2(t *testing.T, addr string) *h2TestConn {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &h2TestConn{
+		t: t,
+		conn: conn,
+		br: bufio.NewReader(conn),
+		enc: hpack.NewEncoder(),
+	}
+}
+
+func (tc *h2TestConn) writeFrame(typ h2FrameType, flags uint8, stream_id uint32, payload []byte) {
+	_, err := tc.conn.Write(appendH2Frame(nil, typ, flags, stream_id, payload))
+	require.NoError(tc.t, err)
+}
+
+func (tc *h2TestConn) writeHeaders(stream_id uint32, end_stream bool, fields ...string) {
+	hfs := []hpack.HeaderField{}
+	for i := 0; i < len(fields); i += 2 {
+		hfs = append(hfs, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	flags := uint8(h2FlagEndHeaders)
+	if end_stream { flags |= h2FlagEndStream }
+	tc.writeFrame(h2FrameHeaders, flags, stream_id, tc.enc.Encode(nil, hfs))
+}
+
+// Skips frames until one of the given type arrives
+func (tc *h2TestConn) readFrame(typ h2FrameType) h2Frame {
+	for {
+		f, err := readH2Frame(tc.br, 1<<24 - 1)
+		require.NoError(tc.t, err)
+		if f.typ == typ { return f }
+	}
+}
+
+// The server encodes without the dynamic table, so blocks decode alone
+func (tc *h2TestConn) decodeHeaders(f h2Frame) map[string]string {
+	fields, err := hpack.NewDecoder(hpack.DefaultTableSize).Decode(f.payload)
+	require.NoError(tc.t, err)
+	headers := map[string]string{}
+	for _, hf := range fields { headers[hf.Name] = hf.Value }
+	return headers
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+		w.WriteBody([]byte(r.StatusLine.Version + " " + r.StatusLine.Target + " " + r.Headers.Get("upgrade")))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	tc := dialH2(t, srv.Listener.Addr().String())
+	settings := appendH2Settings(nil, h2Setting{h2SettingInitialWindowSize, 1 << 20})
+	_, err = fmt.Fprintf(tc.conn, "GET /upgrade HTTP/1.1\r\nHost: localhost\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\n",
+		base64.RawURLEncoding.EncodeToString(settings))
+	require.NoError(t, err)
+
+	status, err := tc.br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for {
+		line, err := tc.br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" { break }
+	}
+
+	tc.conn.Write([]byte(h2Preface))
+	tc.writeFrame(h2FrameSettings, 0, 0, nil)
+
+	// The upgrade request is answered on stream 1
+	f := tc.readFrame(h2FrameSettings)
+	assert.Zero(t, f.flags & h2FlagAck)
+	f = tc.readFrame(h2FrameHeaders)
+	assert.Equal(t, uint32(1), f.stream_id)
+	f = tc.readFrame(h2FrameData)
+	assert.Equal(t, uint32(1), f.stream_id)
+	assert.Equal(t, "HTTP/2.0 /upgrade ", string(f.payload))
+	assert.NotZero(t, f.flags & h2FlagEndStream)
+}
+
+func TestH2Frames(t *testing.T) {
+	reset := make(chan error, 1)
+	blocked, release := make(chan struct{}, h2MaxConcurrentStreams), make(chan struct{})
+	defer close(release)
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		switch r.StatusLine.Target {
+		case "/wait":
+			<-r.Context().Done()
+			reset <- r.Context().Err()
+			return
+		case "/block":
+			// Keeps running after the stream is reset
+			blocked <- struct{}{}
+			<-release
+			return
+		case "/no-content":
+			w.WriteStatusLine(StatusNoContent)
+			w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+			w.WriteBody([]byte("dropped"))
+			return
+		case "/chunked":
+			w.WriteStatusLine(StatusOK)
+			w.WriteHeaders(Headers{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"})
+			w.WriteChunkedBody([]byte("dropped"))
+			w.WriteChunkedBodyDone()
+			return
+		case "/length":
+			data, err := io.ReadAll(r.Body)
+			if err != nil { return }
+			w.WriteStatusLine(StatusOK)
+			w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+			w.WriteBody([]byte(strconv.Itoa(len(data))))
+			return
+		}
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+		w.WriteBody([]byte("ok"))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	start := func(t *testing.T) *h2TestConn {
+		tc := dialH2(t, addr)
+		tc.conn.Write([]byte(h2Preface))
+		tc.writeFrame(h2FrameSettings, 0, 0, nil)
+		f := tc.readFrame(h2FrameSettings)
+		settings, err := parseH2Settings(f.payload)
+		require.NoError(t, err)
+		assert.Contains(t, settings, h2Setting{h2SettingMaxConcurrentStreams, h2MaxConcurrentStreams})
+		assert.Contains(t, settings, h2Setting{h2SettingMaxHeaderListSize, maxHeadSize})
+		return tc
+	}
+
+	t.Run("Ping", func(t *testing.T) {
+		tc := start(t)
+		tc.writeFrame(h2FramePing, 0, 0, []byte("12345678"))
+		f := tc.readFrame(h2FramePing)
+		assert.Equal(t, uint8(h2FlagAck), f.flags)
+		assert.Equal(t, "12345678", string(f.payload))
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		tc := start(t)
+		tc.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost")
+		f := tc.readFrame(h2FrameHeaders)
+		assert.Equal(t, "200", tc.decodeHeaders(f)[":status"])
+		assert.Equal(t, "2", tc.decodeHeaders(f)["content-length"])
+		assert.NotContains(t, tc.decodeHeaders(f), "connection")
+		f = tc.readFrame(h2FrameData)
+		assert.Equal(t, "ok", string(f.payload))
+	})
+
+	t.Run("No Body", func(t *testing.T) {
+		tc := start(t)
+		tc.writeHeaders(1, true, ":method", "HEAD", ":scheme", "http", ":path", "/", ":authority", "localhost")
+		tc.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/no-content", ":authority", "localhost")
+		tc.writeHeaders(5, true, ":method", "HEAD", ":scheme", "http", ":path", "/chunked", ":authority", "localhost")
+		ended := map[uint32]bool{}
+		ping_sent := false
+		for {
+			f, err := readH2Frame(tc.br, 1<<24 - 1)
+			require.NoError(t, err)
+			require.NotEqual(t, h2FrameData, f.typ, "DATA on stream %d", f.stream_id)
+			if f.typ == h2FramePing && ping_sent { break }
+			if f.typ != h2FrameHeaders { continue }
+			assert.NotZero(t, f.flags & h2FlagEndStream)
+			ended[f.stream_id] = true
+			// Anything sent after the headers arrives before the ping ack
+			if len(ended) == 3 {
+				tc.writeFrame(h2FramePing, 0, 0, []byte("12345678"))
+				ping_sent = true
+			}
+		}
+	})
+
+	t.Run("Rapid Reset", func(t *testing.T) {
+		tc := start(t)
+		id := uint32(1)
+		for range h2MaxConcurrentStreams {
+			tc.writeHeaders(id, true, ":method", "GET", ":scheme", "http", ":path", "/block", ":authority", "localhost")
+			tc.writeFrame(h2FrameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(h2ErrCancel)))
+			id += 2
+		}
+		for range h2MaxConcurrentStreams { <-blocked }
+
+		// Reset streams count while their handlers run
+		tc.writeHeaders(id, true, ":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost")
+		f := tc.readFrame(h2FrameRSTStream)
+		assert.Equal(t, id, f.stream_id)
+		assert.Equal(t, uint32(h2ErrRefusedStream), binary.BigEndian.Uint32(f.payload))
+	})
+
+	t.Run("Ignored Bodies", func(t *testing.T) {
+		tc := start(t)
+		window := h2DefaultWindowSize
+		// Sends a body in frames of up to 16 KiB, each once the connection
+		// window has room for it
+		post := func(id uint32, path string, size int, fields ...string) {
+			tc.writeHeaders(id, false, append([]string{":method", "POST", ":scheme", "http", ":path", path, ":authority", "localhost"}, fields...)...)
+			for size > 0 {
+				n := min(size, h2DefaultMaxFrameSize)
+				for window < n {
+					f := tc.readFrame(h2FrameWindowUpdate)
+					if f.stream_id == 0 { window += int(binary.BigEndian.Uint32(f.payload)) }
+				}
+				size -= n
+				window -= n
+				flags := uint8(0)
+				if size == 0 { flags = h2FlagEndStream }
+				tc.writeFrame(h2FrameData, flags, id, make([]byte, n))
+			}
+		}
+
+		// Unread bodies give their window back, so a later body gets through
+		for id := uint32(1); id < 11; id += 2 { post(id, "/", 20000) }
+		// So do bodies of streams reset for exceeding their Content-Length
+		for id := uint32(11); id < 21; id += 2 { post(id, "/length", 20000, "content-length", "1") }
+		post(21, "/length", 20000)
+		for {
+			f := tc.readFrame(h2FrameData)
+			if f.stream_id != 21 { continue }
+			assert.Equal(t, "20000", string(f.payload))
+			break
+		}
+	})
+
+	t.Run("Large Header List", func(t *testing.T) {
+		tc := start(t)
+		hfs := []hpack.HeaderField{
+			{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"}, {Name: ":authority", Value: "localhost"},
+		}
+		for i := range 20 { hfs = append(hfs, hpack.HeaderField{Name: "x-large-" + strconv.Itoa(i), Value: strings.Repeat("v", 4000)}) }
+		block := tc.enc.Encode(nil, hfs)
+		typ, flags := h2FrameHeaders, uint8(h2FlagEndStream)
+		for len(block) > 0 {
+			fragment := block[:min(len(block), h2DefaultMaxFrameSize)]
+			block = block[len(fragment):]
+			if len(block) == 0 { flags |= h2FlagEndHeaders }
+			tc.writeFrame(typ, flags, 1, fragment)
+			typ, flags = h2FrameContinuation, 0
+		}
+		f := tc.readFrame(h2FrameHeaders)
+		assert.Equal(t, uint32(1), f.stream_id)
+		assert.Equal(t, "431", tc.decodeHeaders(f)[":status"])
+		assert.NotZero(t, f.flags & h2FlagEndStream)
+
+		// The connection is still usable
+		tc.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost")
+		f = tc.readFrame(h2FrameData)
+		assert.Equal(t, uint32(3), f.stream_id)
+		assert.Equal(t, "ok", string(f.payload))
+	})
+
+	t.Run("Malformed Request", func(t *testing.T) {
+		tc := start(t)
+		tc.writeHeaders(1, true, ":method", "GET", ":path", "/")
+		f := tc.readFrame(h2FrameRSTStream)
+		assert.Equal(t, uint32(1), f.stream_id)
+		assert.Equal(t, uint32(h2ErrProtocol), binary.BigEndian.Uint32(f.payload))
+	})
+
+	t.Run("Reset Stream", func(t *testing.T) {
+		tc := start(t)
+		tc.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/wait")
+		tc.writeFrame(h2FrameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(h2ErrCancel)))
+		select {
+		case err := <-reset:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(time.Second):
+			t.Fatal("Handler context was not cancelled")
+		}
+	})
+
+	t.Run("Protocol Error", func(t *testing.T) {
+		tc := start(t)
+		// Clients must use odd stream IDs
+		tc.writeHeaders(2, true, ":method", "GET", ":scheme", "http", ":path", "/")
+		f := tc.readFrame(h2FrameGoAway)
+		assert.Equal(t, uint32(h2ErrProtocol), binary.BigEndian.Uint32(f.payload[4:]))
+		_, err := tc.br.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Missing Settings", func(t *testing.T) {
+		tc := dialH2(t, addr)
+		tc.conn.Write([]byte(h2Preface))
+		tc.writeFrame(h2FramePing, 0, 0, []byte("12345678"))
+		f := tc.readFrame(h2FrameGoAway)
+		assert.Equal(t, uint32(h2ErrProtocol), binary.BigEndian.Uint32(f.payload[4:]))
+	})
+}
+
+func TestH2Shutdown(t *testing.T) {
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+		w.WriteBody([]byte("ok"))
+	})
+	require.NoError(t, err)
+
+	tc := dialH2(t, srv.Listener.Addr().String())
+	tc.conn.Write([]byte(h2Preface))
+	tc.writeFrame(h2FrameSettings, 0, 0, nil)
+	tc.writeHeaders(1, true, ":method", "GET", ":scheme", "http", ":path", "/")
+	tc.readFrame(h2FrameData)
+
+	// Idle connections get a GOAWAY and are closed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	f := tc.readFrame(h2FrameGoAway)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.payload))
+	assert.Equal(t, uint32(h2ErrNoError), binary.BigEndian.Uint32(f.payload[4:]))
+}
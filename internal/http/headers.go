@@ -28,39 +28,105 @@ func (h *Headers) Add(key string, value string) {
 	// There can be multiple header lines with the same key
 	name := strings.ToLower(key)
 	if existing_value, ok := (*h)[name]; ok {
-		(*h)[name] = existing_value + ", " + value
+		// Set-Cookie values can not be combined with commas and are kept on
+		// separate lines instead. See RFC 9110 5.3
+		separator := ", "
+		if name == "set-cookie" { separator = "\n" }
+		(*h)[name] = existing_value + separator + value
 	} else {
 		(*h)[name] = value
 	}
 }
 
+// Returns the separate values of a header. Only Set-Cookie can have more
+// than one, since other headers are combined into a single value
+func (h Headers) Values(key string) []string {
+	value := h.Get(key)
+	if value == "" { return nil }
+	return strings.Split(value, "\n")
+}
+
+// Reports if a comma-separated list like Connection has token, ignoring
+// case. See RFC 9110 5.6.1
+func HeaderHasToken(value string, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) { return true }
+	}
+	return false
+}
+
+// Hop-by-hop headers only apply to a single connection, including the ones
+// listed in Connection. Proxies drop them before passing a message on, the
+// body is framed again for the next connection, which declares its own
+// trailers. Proxy-Authenticate and Proxy-Authorization are meant for the
+// proxy. See RFC 9110 7.6.1 and 11.7
+func HopByHopHeaders(connection string) map[string]bool {
+	hop := map[string]bool{
+		"connection": true,
+		"keep-alive": true,
+		"proxy-authenticate": true,
+		"proxy-authorization": true,
+		"proxy-connection": true,
+		"te": true,
+		"trailer": true,
+		"transfer-encoding": true,
+		"upgrade": true,
+	}
+	for _, token := range strings.Split(connection, ",") {
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token != "" && token != "content-length" && token != "host" { hop[token] = true }
+	}
+	return hop
+}
+
 func (h *Headers) parse(data []byte) (int, bool, error) {
+	return h.parseWith(data, nil)
+}
+
+// Parses a field line like parse, names and values are taken from strs
+// when it has them
+func (h *Headers) parseWith(data []byte, strs *stringTable) (int, bool, error) {
 	idx  := bytes.Index(data, []byte("\r\n"))
 	if idx == -1 { return 0, false, nil }
 	if idx == 0 { return 2, true, nil } // found end of headers, consume crlf
 
-	parts := strings.SplitN(string(data[:idx]), ":", 2)
-	if len(parts) != 2 {
-		return 0, false, fmt.Errorf("Invalid header: '%s'", string(data[:idx]))
+	key, value, ok := bytes.Cut(data[:idx], []byte(":"))
+	if !ok {
+		return 0, false, fmt.Errorf("Invalid header: '%s'", data[:idx])
 	}
 
-	key := strings.TrimLeft(parts[0], " ")
-	value := strings.TrimSpace(parts[1])
-	if strings.TrimRight(key, " ") != key { 
+	key = bytes.TrimLeft(key, " ")
+	value = bytes.TrimSpace(value)
+	if len(bytes.TrimRight(key, " ")) != len(key) { 
 		return 0, false, fmt.Errorf("Invalid header key: '%s'", key)
 	}
 	if !isValidHeaderName(key) {
 		return 0, false, fmt.Errorf("Invalid character in header name: '%s'", key)
 	}
+	if !isValidHeaderValue(value) {
+		return 0, false, fmt.Errorf("Invalid character in header value: %q", value)
+	}
 
-	h.Add(key, value)
+	h.Add(fieldName(key, strs), strs.str(value))
 	return idx + 2, false, nil
 }
 
+// Lower case name of a field. Names are tokens, so only ASCII letters
+// change. Short names are lowered on the stack and taken from strs
+func fieldName(key []byte, strs *stringTable) string {
+	var lower [64]byte
+	if len(key) > len(lower) { return strings.ToLower(string(key)) }
+	for i, c := range key {
+		if c >= 'A' && c <= 'Z' { c += 'a' - 'A' }
+		lower[i] = c
+	}
+	return strs.str(lower[:len(key)])
+}
+
 // See RFC 9910 5.1 and 5.6.2
-func isValidHeaderName(s string) bool {
-	for _, r := range s {
-		switch {
+func isValidHeaderName[T string | []byte](s T) bool {
+	for i := 0; i < len(s); i++ {
+		switch r := s[i]; {
 		case r >= 'A' && r <= 'Z':
 		case r >= 'a' && r <= 'z':
 		case r >= '0' && r <= '9':
@@ -74,3 +140,12 @@ func isValidHeaderName(s string) bool {
 	}
 	return true
 }
+
+// Control characters other than HTAB are not allowed, bare CR, LF and NUL
+// must be rejected. See RFC 9110 5.5
+func isValidHeaderValue[T string | []byte](s T) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < ' ' && s[i] != '\t') || s[i] == 0x7f { return false }
+	}
+	return true
+}
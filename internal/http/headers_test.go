@@ -87,4 +87,13 @@ func TestHeadersParse(t *testing.T) {
 	require.Empty(t, headers)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: Set-Cookie values are kept apart
+	headers = Headers{}
+	data = []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2099 07:28:00 GMT\r\nSet-Cookie: b=2\r\n\r\n")
+	n, _, err = headers.parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2099 07:28:00 GMT", "b=2"}, headers.Values("set-cookie"))
 }
@@ -32,8 +32,8 @@ func (cr *chunkReader) Close() error {
 	return nil
 }
 
-func isUpper(s string) bool {
-    for _, r := range s {
+func isUpper[T string | []byte](s T) bool {
+    for _, r := range string(s) {
         if !unicode.IsUpper(r) && unicode.IsLetter(r) {
             return false
         }
@@ -42,7 +42,7 @@ func isUpper(s string) bool {
 }
 
 func grow(buf []byte) []byte {
-	temp := make([]byte, len(buf)*2)
+	temp := make([]byte, max(len(buf)*2, buffer_size))
 	copy(temp, buf)
 	return temp
 }
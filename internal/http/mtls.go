@@ -0,0 +1,98 @@
+package http
+
+import (
+	"crypto/x509"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Identities allowed to access a route. A certificate is allowed if its
+// subject common name, a DNS SAN or a SPIFFE ID matches any entry. SPIFFE
+// IDs ending in "/*" match by prefix. An empty policy allows any verified
+// certificate
+type ClientCertPolicy struct {
+	Subjects []string
+	DNSNames []string
+	SPIFFEIDs []string
+}
+
+// Matches PathPrefix and everything below it by whole segments, "/admin"
+// matches "/admin" and "/admin/users" but not "/administrator"
+type ClientCertRoute struct {
+	PathPrefix string
+	Policy ClientCertPolicy
+	// Requests to the route need no certificate
+	Public bool
+}
+
+// Middleware that checks the verified client certificate against the
+// policy of the longest matching route. Paths are decoded and cleaned
+// before matching. Requests to paths without a route are denied, a public
+// "/" route passes them through. Needs Server.ClientCAs to be set
+func RequireClientCert(routes []ClientCertRoute, next Handler) Handler {
+	prefixes := make([]string, len(routes))
+	for i, route := range routes { prefixes[i] = cleanPath(route.PathPrefix) }
+
+	return func(w ResponseWriter, r *Request) {
+		route := -1
+		p, err := url.PathUnescape(r.Target.Path)
+		if err == nil {
+			p = cleanPath(p)
+			for i, prefix := range prefixes {
+				if !pathHasPrefix(p, prefix) { continue }
+				if route == -1 || len(prefix) > len(prefixes[route]) { route = i }
+			}
+		}
+		if route != -1 && routes[route].Public {
+			next(w, r)
+			return
+		}
+
+		chain := r.VerifiedChain()
+		if route == -1 || len(chain) == 0 || !routes[route].Policy.allows(chain[0]) {
+			w.WriteStatusLine(StatusForbidden)
+			w.Headers.Set("Content-Type", "text/plain")
+			w.WriteHeaders(nil)
+			w.WriteBody([]byte("Client certificate not allowed"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Resolves dot segments so "/public/../admin" is matched as "/admin"
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") { p = "/" + p }
+	return path.Clean(p)
+}
+
+func pathHasPrefix(p string, prefix string) bool {
+	if prefix == "/" { return true }
+	return p == prefix || strings.HasPrefix(p, prefix + "/")
+}
+
+func (p ClientCertPolicy) allows(cert *x509.Certificate) bool {
+	if len(p.Subjects) == 0 && len(p.DNSNames) == 0 && len(p.SPIFFEIDs) == 0 { return true }
+
+	for _, subject := range p.Subjects {
+		if cert.Subject.CommonName == subject { return true }
+	}
+	for _, name := range p.DNSNames {
+		for _, san := range cert.DNSNames {
+			if strings.EqualFold(san, name) { return true }
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" { continue }
+		id := uri.String()
+		for _, allowed := range p.SPIFFEIDs {
+			if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasSuffix(prefix, "/") {
+				if strings.HasPrefix(id, prefix) { return true }
+			} else if id == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
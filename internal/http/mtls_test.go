@@ -0,0 +1,104 @@
+package http
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertPolicy(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/ns/prod/sa/api")
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "api"},
+		DNSNames: []string{"api.internal"},
+		URIs: []*url.URL{spiffe},
+	}
+
+	assert.True(t, ClientCertPolicy{}.allows(cert))
+	assert.True(t, ClientCertPolicy{Subjects: []string{"api"}}.allows(cert))
+	assert.True(t, ClientCertPolicy{DNSNames: []string{"API.internal"}}.allows(cert))
+	assert.True(t, ClientCertPolicy{SPIFFEIDs: []string{"spiffe://example.org/ns/prod/sa/api"}}.allows(cert))
+	assert.True(t, ClientCertPolicy{SPIFFEIDs: []string{"spiffe://example.org/ns/prod/*"}}.allows(cert))
+	assert.False(t, ClientCertPolicy{SPIFFEIDs: []string{"spiffe://example.org/ns/dev/*"}}.allows(cert))
+	assert.False(t, ClientCertPolicy{Subjects: []string{"web"}, DNSNames: []string{"web.internal"}}.allows(cert))
+}
+
+func TestRequireClientCert(t *testing.T) {
+	dir := t.TempDir()
+	server_cert, server_key, server_ca := generateCert(t, dir, "server.test", 1)
+	client_cert, client_key, client_ca := generateCert(t, dir, "client.test", 2)
+	other_cert, other_key, _ := generateCert(t, dir, "other.test", 3)
+
+	client_cas := x509.NewCertPool()
+	client_cas.AddCert(client_ca)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &Server{
+		Listener: ln,
+		ClientCAs: client_cas,
+		Handler: RequireClientCert([]ClientCertRoute{
+			{PathPrefix: "/admin", Policy: ClientCertPolicy{DNSNames: []string{"client.test"}}},
+			{PathPrefix: "/admin/public"},
+			{PathPrefix: "/public", Public: true},
+		}, func(w ResponseWriter, r *Request) {
+			w.WriteStatusLine(StatusOK)
+			w.Headers.Set("Content-Type", "text/plain")
+			w.WriteHeaders(nil)
+			w.WriteBody([]byte("ok"))
+		}),
+	}
+	go srv.ServeTLS(server_cert, server_key)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server_ca)
+	get := func(target string, cert_file string, key_file string) string {
+		config := &tls.Config{ServerName: "server.test", RootCAs: roots}
+		if cert_file != "" {
+			cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+			require.NoError(t, err)
+			config.Certificates = []tls.Certificate{cert}
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), config)
+		if err != nil { return err.Error() }
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: server.test\r\n\r\n"))
+		require.NoError(t, err)
+		status, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil { return err.Error() }
+		return status
+	}
+
+	// Test: Paths without a route are denied
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", get("/", client_cert, client_key))
+
+	// Test: Public route without certificate
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", get("/public/index.html", "", ""))
+
+	// Test: Routes match whole segments
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", get("/publicity", "", ""))
+
+	// Test: Protected route without certificate
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", get("/admin", "", ""))
+
+	// Test: Protected route with allowed certificate
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", get("/admin/users?page=2", client_cert, client_key))
+
+	// Test: Paths are cleaned and decoded before matching
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", get("/public/../admin", "", ""))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", get("/public/%2e%2e/admin", "", ""))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", get("/%61dmin/users", client_cert, client_key))
+
+	// Test: Longest prefix wins, any verified certificate is fine
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", get("/admin/public", "", ""))
+
+	// Test: Certificate from an unknown CA fails the handshake
+	assert.NotEqual(t, "HTTP/1.1 200 OK\r\n", get("/admin", other_cert, other_key))
+}
@@ -0,0 +1,206 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format of HTTP-date. See RFC 9110 5.6.7
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+var errNoOverlap = errors.New("Invalid range: failed to overlap")
+
+type byteRange struct {
+	start int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// Serves content with support for Range and If-Range requests. The
+// Content-Type and ETag headers are taken from w.Headers if set.
+// See RFC 9110 14
+func ServeContent(w *ResponseWriter, r *Request, modtime time.Time, content io.ReadSeeker, size int64) error {
+	content_type := w.Headers.Get("content-type")
+	if content_type == "" {
+		content_type = "application/octet-stream"
+		w.Headers.Set("Content-Type", content_type)
+	}
+	w.Headers.Set("Accept-Ranges", "bytes")
+	if !modtime.IsZero() {
+		w.Headers.Set("Last-Modified", modtime.UTC().Format(TimeFormat))
+	}
+
+	// RFC 9110 14.2
+	// A server MUST ignore a Range header field received with a request
+	// method that is unrecognized or for which range handling is not defined
+	range_header := r.Headers.Get("range")
+	if range_header == "" || r.StatusLine.Method != "GET" || !checkIfRange(w, r, modtime) {
+		return serveFull(w, content, size)
+	}
+
+	ranges, err := parseRange(range_header, size)
+	if errors.Is(err, errNoOverlap) {
+		w.Headers.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		if err := w.WriteStatusLine(StatusRequestedRangeNotSatisfiable); err != nil { return err }
+		if err := w.WriteHeaders(nil); err != nil { return err }
+		_, err := w.WriteBody(nil)
+		return err
+	}
+	// Invalid ranges are ignored. See RFC 9110 14.2
+	if err != nil { return serveFull(w, content, size) }
+
+	// Clients asking for more bytes than the whole content get the whole
+	// content instead. Protects against many small overlapping ranges
+	total_length := int64(0)
+	for _, br := range ranges { total_length += br.length }
+	if total_length > size { return serveFull(w, content, size) }
+
+	if len(ranges) == 1 {
+		if _, err := content.Seek(ranges[0].start, io.SeekStart); err != nil { return err }
+		w.Headers.Set("Content-Range", ranges[0].contentRange(size))
+		if err := w.WriteStatusLine(StatusPartialContent); err != nil { return err }
+		if err := w.WriteHeaders(nil); err != nil { return err }
+		_, err = w.WriteBodyFrom(content, ranges[0].length)
+		return err
+	}
+
+	// Multiple ranges are sent as multipart/byteranges. See RFC 9110 14.6
+	boundary, err := randomBoundary()
+	if err != nil { return err }
+	// Parts are read from content as they are sent, Content-Length is known
+	// from the part heads and range lengths
+	parts := []io.Reader{}
+	length := int64(0)
+	for _, br := range ranges {
+		head := "--" + boundary + "\r\n" +
+			"Content-Type: " + content_type + "\r\n" +
+			"Content-Range: " + br.contentRange(size) + "\r\n\r\n"
+		parts = append(parts, strings.NewReader(head), &rangeReader{content: content, br: br}, strings.NewReader("\r\n"))
+		length += int64(len(head)) + br.length + 2
+	}
+	tail := "--" + boundary + "--\r\n"
+	parts = append(parts, strings.NewReader(tail))
+	length += int64(len(tail))
+
+	w.Headers.Set("Content-Type", "multipart/byteranges; boundary=" + boundary)
+	if err := w.WriteStatusLine(StatusPartialContent); err != nil { return err }
+	if err := w.WriteHeaders(nil); err != nil { return err }
+	_, err = w.WriteBodyFrom(io.MultiReader(parts...), length)
+	return err
+}
+
+func serveFull(w *ResponseWriter, content io.ReadSeeker, size int64) error {
+	if _, err := content.Seek(0, io.SeekStart); err != nil { return err }
+	if err := w.WriteStatusLine(StatusOK); err != nil { return err }
+	if err := w.WriteHeaders(nil); err != nil { return err }
+	_, err := w.WriteBodyFrom(content, size)
+	return err
+}
+
+// Reads a range of content, seeking to it on the first read
+type rangeReader struct {
+	content io.ReadSeeker
+	br byteRange
+	seeked bool
+}
+
+func (rr *rangeReader) Read(data []byte) (int, error) {
+	if !rr.seeked {
+		if _, err := rr.content.Seek(rr.br.start, io.SeekStart); err != nil { return 0, err }
+		rr.seeked = true
+	}
+	if rr.br.length == 0 { return 0, io.EOF }
+	n, err := rr.content.Read(data[:min(int64(len(data)), rr.br.length)])
+	rr.br.length -= int64(n)
+	if errors.Is(err, io.EOF) && rr.br.length > 0 { return n, io.ErrUnexpectedEOF }
+	return n, err
+}
+
+// RFC 9110 13.1.5
+// If-Range only allows the range request if the validator still matches.
+// Weak entity tags can not be used
+func checkIfRange(w *ResponseWriter, r *Request, modtime time.Time) bool {
+	if_range := r.Headers.Get("if-range")
+	if if_range == "" { return true }
+
+	if strings.HasPrefix(if_range, "\"") {
+		return if_range == w.Headers.Get("etag")
+	}
+	if strings.HasPrefix(if_range, "W/") { return false }
+
+	if modtime.IsZero() { return false }
+	t, err := time.Parse(TimeFormat, if_range)
+	if err != nil { return false }
+	return modtime.Truncate(time.Second).Equal(t)
+}
+
+// Parses a Range header like "bytes=0-499, -500". Ranges that start past
+// the end of the content are dropped. See RFC 9110 14.1.2
+func parseRange(s string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok { return nil, fmt.Errorf("Invalid range unit: '%s'", s) }
+
+	ranges := []byteRange{}
+	no_overlap := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" { continue }
+
+		first, last, ok := strings.Cut(part, "-")
+		if !ok { return nil, fmt.Errorf("Invalid range: '%s'", part) }
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		br := byteRange{}
+		if first == "" {
+			// suffix-range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 { return nil, fmt.Errorf("Invalid range: '%s'", part) }
+			// Empty content has no last bytes to send
+			if n == 0 || size == 0 {
+				no_overlap = true
+				continue
+			}
+			n = min(n, size)
+			br.start = size - n
+			br.length = n
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 { return nil, fmt.Errorf("Invalid range: '%s'", part) }
+			if start >= size {
+				no_overlap = true
+				continue
+			}
+			br.start = start
+			if last == "" {
+				br.length = size - start
+			} else {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start { return nil, fmt.Errorf("Invalid range: '%s'", part) }
+				end = min(end, size-1)
+				br.length = end - start + 1
+			}
+		}
+		ranges = append(ranges, br)
+	}
+
+	if len(ranges) == 0 {
+		if no_overlap { return nil, errNoOverlap }
+		return nil, fmt.Errorf("Invalid range: '%s'", s)
+	}
+	return ranges, nil
+}
+
+func randomBoundary() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil { return "", err }
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	// Test: Single range
+	ranges, err := parseRange("bytes=0-4", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 0, length: 5}}, ranges)
+
+	// Test: Open ended range
+	ranges, err = parseRange("bytes=7-", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 7, length: 3}}, ranges)
+
+	// Test: Suffix range
+	ranges, err = parseRange("bytes=-3", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 7, length: 3}}, ranges)
+
+	// Test: Suffix range bigger than content
+	ranges, err = parseRange("bytes=-30", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 0, length: 10}}, ranges)
+
+	// Test: End past content is clamped
+	ranges, err = parseRange("bytes=5-100", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{start: 5, length: 5}}, ranges)
+
+	// Test: Multiple ranges
+	ranges, err = parseRange("bytes=0-1, 4-5 ,-2", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 2}, {4, 2}, {8, 2}}, ranges)
+
+	// Test: Unsatisfiable range
+	_, err = parseRange("bytes=10-20", 10)
+	require.ErrorIs(t, err, errNoOverlap)
+
+	// Test: Suffix range of empty content
+	_, err = parseRange("bytes=-5", 0)
+	require.ErrorIs(t, err, errNoOverlap)
+
+	// Test: Invalid unit
+	_, err = parseRange("items=0-4", 10)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errNoOverlap)
+
+	// Test: Invalid range
+	_, err = parseRange("bytes=5-1", 10)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errNoOverlap)
+}
+
+func TestServeContent(t *testing.T) {
+	content := "0123456789"
+	modtime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	serve := func(headers Headers) string {
+		buf := &bytes.Buffer{}
+		w := NewResponseWriter(buf)
+		w.Headers.Set("Content-Type", "text/plain")
+		r := &Request{StatusLine: StatusLine{Method: "GET"}, Headers: headers}
+		err := ServeContent(&w, r, modtime, strings.NewReader(content), int64(len(content)))
+		require.NoError(t, err)
+		return buf.String()
+	}
+
+	// Test: No range
+	resp := serve(Headers{})
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "accept-ranges: bytes\r\n")
+	assert.Contains(t, resp, "last-modified: Thu, 02 Jan 2025 03:04:05 GMT\r\n")
+	assert.Contains(t, resp, "\r\n\r\n0123456789")
+
+	// Test: Single range
+	resp = serve(Headers{"range": "bytes=2-5"})
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, resp, "content-range: bytes 2-5/10\r\n")
+	assert.Contains(t, resp, "content-length: 4\r\n")
+	assert.Contains(t, resp, "\r\n\r\n2345")
+
+	// Test: Multiple ranges
+	resp = serve(Headers{"range": "bytes=0-1,-2"})
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, resp, "content-type: multipart/byteranges; boundary=")
+	assert.Contains(t, resp, "Content-Type: text/plain\r\nContent-Range: bytes 0-1/10\r\n\r\n01\r\n")
+	assert.Contains(t, resp, "Content-Type: text/plain\r\nContent-Range: bytes 8-9/10\r\n\r\n89\r\n")
+	parsed, err := ResponseFromReader(strings.NewReader(resp), "GET")
+	require.NoError(t, err)
+	data, err := io.ReadAll(parsed.Body)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(data), "--\r\n"))
+	assert.Equal(t, resp[len(resp)-len(data):], string(data))
+
+	// Test: Unsatisfiable range
+	resp = serve(Headers{"range": "bytes=20-"})
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, resp, "content-range: bytes */10\r\n")
+
+	// Test: Suffix range of empty content
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	r := &Request{StatusLine: StatusLine{Method: "GET"}, Headers: Headers{"range": "bytes=-5"}}
+	require.NoError(t, ServeContent(&w, r, modtime, strings.NewReader(""), 0))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, buf.String(), "content-range: bytes */0\r\n")
+
+	// Test: If-Range with matching date
+	resp = serve(Headers{"range": "bytes=2-5", "if-range": "Thu, 02 Jan 2025 03:04:05 GMT"})
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 206 Partial Content\r\n"))
+
+	// Test: If-Range with outdated date
+	resp = serve(Headers{"range": "bytes=2-5", "if-range": "Wed, 01 Jan 2025 03:04:05 GMT"})
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "\r\n\r\n0123456789")
+
+	// Test: If-Range with weak etag
+	resp = serve(Headers{"range": "bytes=2-5", "if-range": "W/\"abc\""})
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+}
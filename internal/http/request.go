@@ -1,10 +1,15 @@
 package http
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
+	"net/netip"
+	"strings"
 )
 
 type State int
@@ -17,74 +22,151 @@ const (
 
 type Request struct {
 	StatusLine  StatusLine
+	// Parsed from StatusLine.Target
+	Target      RequestTarget
 	Headers     Headers
+	// Protocol the request is served with, "HTTP/1.0", "HTTP/1.1" or
+	// "HTTP/2.0". Higher HTTP/1.x versions are served as "HTTP/1.1"
+	Proto       string
 	Body        io.ReadCloser
+	// Returns a new copy of Body, so the client can send it again after a
+	// redirect. Set by NewRequest for bytes and strings readers
+	GetBody     func() (io.ReadCloser, error)
+	// Sent after a chunked or HTTP/2 body. Filled once Body returned io.EOF
+	Trailers    Headers
+	// Address of the peer and of the listening side, set by the server
+	RemoteAddr  string
+	LocalAddr   string
+	// Unique per connection, requests on the same connection share it
+	ConnID      uint64
+	// IP of the client. The peer's IP unless Server.TrustedProxies
+	// resolved it from forwarding headers
+	ClientIP    netip.Addr
+	// nil for connections without TLS
+	TLS         *tls.ConnectionState
 	state       State
+	ctx         context.Context
+	// Set while parsing, see requestReader
+	strs        *stringTable
 }
 
-const buffer_size = 8
+// The context is cancelled when the client disconnects, the handler
+// returns or the server shuts down. Defaults to context.Background()
+func (r *Request) Context() context.Context {
+	if r.ctx != nil { return r.ctx }
+	return context.Background()
+}
+
+// Returns the verified client certificate chain, leaf first. nil if the
+// client did not send a certificate or it was not verified
+func (r *Request) VerifiedChain() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 { return nil }
+	return r.TLS.VerifiedChains[0]
+}
+
+// Returns a shallow copy of r with its context changed to ctx
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil { panic("nil context") }
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
 
 func RequestFromReader(reader io.ReadCloser) (*Request, error) {
-	r := &Request{
-		StatusLine: StatusLine{},
-		Headers: Headers{},
-		Body: reader,
-		state: ParsingStatusLine,
-	}
+	rr := &requestReader{rc: reader, rb: readBuffer{rd: reader, buf: make([]byte, buffer_size)}}
+	r := &Request{}
+	if err := rr.readInto(r); err != nil { return nil, err }
+	return r, nil
+}
+
+// Reads the requests of a connection. They share a read buffer and the
+// strings of earlier requests, so parsing a request like the last one
+// does not allocate
+type requestReader struct {
+	rc io.ReadCloser
+	rb readBuffer
+	strs stringTable
+	// Buffer from bufferPool, nil if rb.buf was not taken from it
+	pooled *[]byte
+}
+
+func newRequestReader(rc io.ReadCloser) *requestReader {
+	pooled := bufferPool.Get().(*[]byte)
+	return &requestReader{rc: rc, rb: readBuffer{rd: rc, buf: *pooled}, pooled: pooled}
+}
+
+// Returns the buffer to the pool. Neither the reader nor the body of its
+// last request can be used afterwards
+func (rr *requestReader) release() {
+	if rr.pooled != nil { bufferPool.Put(rr.pooled) }
+	rr.pooled = nil
+	rr.rb = readBuffer{}
+}
 
-	unconsumed_bytes := 0
-	buf := make([]byte, buffer_size)
+// Parses the next request into r. The headers map and body of r are
+// reused if it came from this reader before. Bytes after the head stay
+// buffered for the body and the next request
+func (rr *requestReader) readInto(r *Request) error {
+	headers := r.Headers
+	if headers == nil { headers = Headers{} }
+	clear(headers)
+	b, ok := r.Body.(*body)
+	if !ok || b.rb != &rr.rb { b = &body{} }
+	*r = Request{Headers: headers, Body: rr.rc, state: ParsingStatusLine, strs: &rr.strs}
+
+	head_size := 0
 	for r.state != Done {
-		if unconsumed_bytes == len(buf) {
-			// buffer is full, double size of buffer
-			temp := make([]byte, len(buf)*2)
-			copy(temp, buf)
-			buf = temp
-		}
+		parsed_bytes, err := r.parse(rr.rb.buffered())
+		if err != nil { return err }
+		rr.rb.consume(parsed_bytes)
+		head_size += parsed_bytes
+		if r.state == Done { break }
 
-		new_bytes, err := reader.Read(buf[unconsumed_bytes:])
-		if errors.Is(err, io.EOF) { 
-			if r.state != Done {
-				return nil, fmt.Errorf("incomplete request, reached EOF while parsing headers")
-			}
-			break
-		} else if err != nil { 
-			return nil, err 
-		}
-		unconsumed_bytes += new_bytes
-
-		parsed_bytes, err := r.parse(buf[:unconsumed_bytes])
-		if err != nil { return nil, err }
-		if parsed_bytes > 0 { 
-			// successful parsed. remove parsed bytes from buffer
-			copy(buf, buf[parsed_bytes:])
-			unconsumed_bytes -= parsed_bytes
-			// buf = buf[:unconsumed_bytes] // TODO
+		// A client must not make us buffer without bound. See RFC 6585 5
+		if head_size + len(rr.rb.buffered()) >= maxHeadSize { return errHeadTooLarge }
+		err = rr.rb.fill()
+		if errors.Is(err, io.EOF) {
+			// The connection closed before a new request started
+			if r.state == ParsingStatusLine && len(rr.rb.buffered()) == 0 { return io.EOF }
+			return fmt.Errorf("incomplete request, reached EOF while parsing headers")
+		} else if err != nil {
+			return err
 		}
 	}
 
-	if r.Headers.Get("transfer-encoding") == "chunked" {
-		r.Body = &body{
-			rc: r.Body,
-			buf: buf,
-			unconsumed_bytes: len(buf[:unconsumed_bytes]),
-			is_chunked: true,
+	r.strs = nil
+	// Higher minor versions get the semantics of the highest one we know.
+	// See RFC 9112 2.3
+	r.Proto = "HTTP/1.1"
+	if r.StatusLine.Version == "HTTP/1.0" { r.Proto = "HTTP/1.0" }
+	*b = body{rc: r.Body, rb: &rr.rb}
+	r.Body = b
+	// See RFC 9112 6.1 and 6.3
+	transfer_encoding := r.Headers.Get("transfer-encoding")
+	switch {
+	case transfer_encoding != "":
+		if r.Proto == "HTTP/1.0" { return fmt.Errorf("Transfer-Encoding is not allowed in HTTP/1.0 requests") }
+		// Transfer-Encoding wins. The message may be an attempt at request
+		// smuggling, so the connection is closed after the response
+		if r.Headers.Get("content-length") != "" {
+			delete(r.Headers, "content-length")
+			r.Headers.Add("Connection", "close")
 		}
-	} else {
-		content_length, err := strconv.Atoi(r.Headers.Get("content-length"))
-		if err != nil { 
-			// No body
-			content_length = 0
-		}
-		r.Body = &body{
-			rc: r.Body,
-			buf: buf,
-			content_length: content_length,
-			unconsumed_bytes: len(buf[:unconsumed_bytes]),
+		codings := strings.Split(transfer_encoding, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return fmt.Errorf("Chunked must be the final transfer coding: '%s'", transfer_encoding)
 		}
+		if len(codings) > 1 { return fmt.Errorf("%w: '%s'", errNotImplemented, transfer_encoding) }
+		r.Trailers = Headers{}
+		b.is_chunked = true
+		b.trailers = r.Trailers
+	case r.Headers.Get("content-length") != "":
+		content_length, err := parseContentLength(r.Headers.Get("content-length"))
+		if err != nil { return err }
+		b.content_length = content_length
 	}
 
-	return r, nil
+	return nil
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -101,15 +183,30 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.state {
 	case ParsingStatusLine:
-		consumed_bytes, err := r.StatusLine.parse(data)
+		// Empty lines before the request-line are ignored. See RFC 9112 2.2
+		if bytes.HasPrefix(data, []byte("\r\n")) { return 2, nil }
+		consumed_bytes, err := r.StatusLine.parseWith(data, r.strs)
 		if err != nil { return 0, err }
 		if consumed_bytes == 0 { return 0, nil } // no bytes consumed, need more data
+		r.Target, err = parseRequestTarget(r.StatusLine.Method, r.StatusLine.Target)
+		if err != nil { return 0, err }
 		r.state = ParsingHeaders
 		return consumed_bytes, nil
 	case ParsingHeaders: 
-		consumed_bytes, done, err := r.Headers.parse(data)
+		// Either obs-fold or a line that could be taken as part of the
+		// request-line. See RFC 9112 2.2 and 5.2
+		if len(data) > 0 && (data[0] == ' ' || data[0] == '\t') {
+			return 0, fmt.Errorf("Header line must not start with whitespace")
+		}
+		// Multiple Host headers would be joined into one
+		host, had_host := r.Headers["host"]
+		consumed_bytes, done, err := r.Headers.parseWith(data, r.strs)
 		if err != nil { return 0, err }
-		if done { r.state = Done }
+		if had_host && r.Headers["host"] != host { return 0, fmt.Errorf("Multiple Host headers") }
+		if done {
+			if err := r.resolveHost(); err != nil { return 0, err }
+			r.state = Done
+		}
 		return consumed_bytes, nil
 	default:
 		return 0, fmt.Errorf("Request is in unknown state. Request should not be parsed")
@@ -1,8 +1,12 @@
 package http
 
 import (
+	"bytes"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -67,7 +71,39 @@ func TestStatusLineParseFromReader(t *testing.T) {
 		numBytesPerRead: 1,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, errVersionNotSupported)
+
+	// Test: Higher minor version is served as HTTP/1.1
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.2\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.2", r.StatusLine.Version)
+	assert.Equal(t, "HTTP/1.1", r.Proto)
+
+	// Test: HTTP/1.0 Request line
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0", r.StatusLine.Version)
+	assert.Equal(t, "HTTP/1.0", r.Proto)
+
+	// Test: Unsupported version in Request line
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/2.0\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, errVersionNotSupported)
+
+	// Test: No request before EOF
+	_, err = RequestFromReader(&chunkReader{data: "", numBytesPerRead: 1})
+	require.ErrorIs(t, err, io.EOF)
 }
 
 func TestHeadersParseFromReader(t *testing.T) {
@@ -83,9 +119,9 @@ func TestHeadersParseFromReader(t *testing.T) {
 	assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
 	assert.Equal(t, "*/*", r.Headers.Get("accept"))
 
-	// Test: Empty Headers
+	// Test: Empty Headers, only HTTP/1.1 requires Host
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\n\r\n",
+		data:            "GET / HTTP/1.0\r\n\r\n",
 		numBytesPerRead: 1,
 	}
 	r, err = RequestFromReader(reader)
@@ -103,7 +139,7 @@ func TestHeadersParseFromReader(t *testing.T) {
 
 	// Test: Duplicate Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nX-Test: first\r\nX-Test: second\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Test: first\r\nX-Test: second\r\n\r\n",
 		numBytesPerRead: 20,
 	}
 	r, err = RequestFromReader(reader)
@@ -113,7 +149,7 @@ func TestHeadersParseFromReader(t *testing.T) {
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nX-Mixed-Case: Value1\r\nx-mixed-case: Value2\r\nX-MIXED-CASE: Value3\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Mixed-Case: Value1\r\nx-mixed-case: Value2\r\nX-MIXED-CASE: Value3\r\n\r\n",
 		numBytesPerRead: 5,
 	}
 	r, err = RequestFromReader(reader)
@@ -128,6 +164,16 @@ func TestHeadersParseFromReader(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
+
+	// Test: Endless heads are not buffered
+	for _, reader := range []io.Reader{
+		io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\n"), &repeatReader{data: []byte(strings.Repeat("X-Field: value\r\n", 256))}),
+		io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\nX-Field: "), &repeatReader{data: []byte(strings.Repeat("value", 1024))}),
+		&repeatReader{data: []byte(strings.Repeat("a", 1024))},
+	} {
+		_, err = RequestFromReader(io.NopCloser(reader))
+		require.ErrorIs(t, err, errHeadTooLarge)
+	}
 }
 
 func TestBodyParseFromReader(t *testing.T) {
@@ -229,4 +275,166 @@ func TestChunkedBodyParseFromReader(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, "hello world!\n-more", string(body))
 	})
+
+	t.Run("Chunk Extensions and Trailers", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"5;name=value\r\n" +
+				"hello\r\n" +
+				"0\r\n" +
+				"X-Checksum: abc\r\n" +
+				"\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+		assert.Equal(t, "abc", r.Trailers.Get("X-Checksum"))
+	})
+
+	t.Run("Truncated Chunked Body", func(t *testing.T) {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Host: localhost:42069\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"d\r\n" +
+				"hello",
+			numBytesPerRead: 4,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("Endless Chunk Size And Trailers", func(t *testing.T) {
+		head := "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n"
+		for _, reader := range []io.Reader{
+			io.MultiReader(strings.NewReader(head + "5;ext="), &repeatReader{data: []byte(strings.Repeat("a", 1024))}),
+			io.MultiReader(strings.NewReader(head + "0\r\n"), &repeatReader{data: []byte(strings.Repeat("X-Field: value\r\n", 256))}),
+		} {
+			r, err := RequestFromReader(io.NopCloser(reader))
+			require.NoError(t, err)
+			_, err = io.ReadAll(r.Body)
+			require.ErrorIs(t, err, errHeadTooLarge)
+		}
+	})
+}
+
+
+// A typical browser GET
+const benchmarkGET = "GET /api/items?page=2 HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Accept-Language: en-US,en;q=0.5\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Connection: keep-alive\r\n" +
+	"Cookie: session=8f14e45fceea167a5a36dedd4bea2543\r\n" +
+	"\r\n"
+
+type benchmarkReader struct {
+	bytes.Reader
+}
+
+func (r *benchmarkReader) Close() error { return nil }
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	post := "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/octet-stream\r\n" +
+		"Content-Length: 1024\r\n\r\n" + strings.Repeat("x", 1024)
+	for _, bc := range []struct{ name, data string }{{"GET", benchmarkGET}, {"POST", post}} {
+		b.Run(bc.name, func(b *testing.B) {
+			reader := &benchmarkReader{}
+			buf := make([]byte, 512)
+			b.SetBytes(int64(len(bc.data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				reader.Reset([]byte(bc.data))
+				r, err := RequestFromReader(reader)
+				if err != nil { b.Fatal(err) }
+				for {
+					_, err := r.Body.Read(buf)
+					if err == io.EOF { break }
+					if err != nil { b.Fatal(err) }
+				}
+			}
+		})
+	}
+}
+
+// Returns data over and over, like a client sending the same request
+type repeatReader struct {
+	data []byte
+	pos int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+// Requests on one connection, as the server reads them. Only a reused
+// Request parses without allocating. The server allocates a new Request,
+// its headers and body for every request, since handlers may keep them, so
+// "New Request" is its path
+func BenchmarkRequestReader(b *testing.B) {
+	rr := newRequestReader(io.NopCloser(&repeatReader{data: []byte(benchmarkGET)}))
+	defer rr.release()
+	buf := make([]byte, 512)
+	b.Run("New Request", func(b *testing.B) {
+		b.SetBytes(int64(len(benchmarkGET)))
+		b.ReportAllocs()
+		for b.Loop() {
+			r := &Request{}
+			if err := rr.readInto(r); err != nil { b.Fatal(err) }
+			if _, err := r.Body.Read(buf); err != io.EOF { b.Fatal(err) }
+		}
+	})
+	b.Run("Reused Request", func(b *testing.B) {
+		r := &Request{}
+		b.SetBytes(int64(len(benchmarkGET)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := rr.readInto(r); err != nil { b.Fatal(err) }
+			if _, err := r.Body.Read(buf); err != io.EOF { b.Fatal(err) }
+		}
+	})
+}
+
+func TestRequestReader(t *testing.T) {
+	// Test: Pipelined requests share the buffer, the body stays in order
+	data := "POST /a HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /b HTTP/1.1\r\nHost: example.com\r\nX-Id: 1\r\n\r\n" +
+		"GET /b HTTP/1.1\r\nHost: example.com\r\nX-Id: 1\r\n\r\n"
+	rr := newRequestReader(&chunkReader{data: data, numBytesPerRead: 7})
+	defer rr.release()
+	r := &Request{}
+	require.NoError(t, rr.readInto(r))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+
+	first := &Request{}
+	require.NoError(t, rr.readInto(first))
+	assert.Equal(t, "/b", first.StatusLine.Target)
+	second := &Request{}
+	require.NoError(t, rr.readInto(second))
+	assert.Equal(t, first.Headers, second.Headers)
+	// Strings of the earlier request are reused
+	assert.Same(t, unsafe.StringData(first.Headers["x-id"]), unsafe.StringData(second.Headers["x-id"]))
+	assert.Same(t, unsafe.StringData(first.StatusLine.Target), unsafe.StringData(second.StatusLine.Target))
+	require.ErrorIs(t, rr.readInto(&Request{}), io.EOF)
+
+	// Test: The string table does not grow without bound
+	st := &stringTable{}
+	for i := range 2 * maxTableStrings { st.str([]byte(strconv.Itoa(i + 1000))) }
+	st.str(bytes.Repeat([]byte("x"), maxTableStringLen + 1))
+	assert.Len(t, st.strs, maxTableStrings)
 }
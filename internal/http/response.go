@@ -1,19 +1,62 @@
 package http
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ResponseStatusCode int
 const (
 	StatusOK ResponseStatusCode = 200
+	StatusNoContent ResponseStatusCode = 204
+	StatusPartialContent ResponseStatusCode = 206
+	StatusMovedPermanently ResponseStatusCode = 301
+	StatusFound ResponseStatusCode = 302
+	StatusSeeOther ResponseStatusCode = 303
+	StatusNotModified ResponseStatusCode = 304
+	StatusTemporaryRedirect ResponseStatusCode = 307
+	StatusPermanentRedirect ResponseStatusCode = 308
 	StatusBadRequest ResponseStatusCode = 400
+	StatusForbidden ResponseStatusCode = 403
+	StatusProxyAuthRequired ResponseStatusCode = 407
+	StatusRequestedRangeNotSatisfiable ResponseStatusCode = 416
+	StatusRequestHeaderFieldsTooLarge ResponseStatusCode = 431
 	StatusInternalServerError ResponseStatusCode = 500
+	StatusNotImplemented ResponseStatusCode = 501
+	StatusBadGateway ResponseStatusCode = 502
+	StatusServiceUnavailable ResponseStatusCode = 503
+	StatusHTTPVersionNotSupported ResponseStatusCode = 505
 )
 
+var statusText = map[ResponseStatusCode]string{
+	StatusOK: "OK",
+	StatusNoContent: "No Content",
+	StatusPartialContent: "Partial Content",
+	StatusMovedPermanently: "Moved Permanently",
+	StatusFound: "Found",
+	StatusSeeOther: "See Other",
+	StatusNotModified: "Not Modified",
+	StatusTemporaryRedirect: "Temporary Redirect",
+	StatusPermanentRedirect: "Permanent Redirect",
+	StatusBadRequest: "Bad Request",
+	StatusForbidden: "Forbidden",
+	StatusProxyAuthRequired: "Proxy Authentication Required",
+	StatusRequestedRangeNotSatisfiable: "Range Not Satisfiable",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError: "Internal Server Error",
+	StatusNotImplemented: "Not Implemented",
+	StatusBadGateway: "Bad Gateway",
+	StatusServiceUnavailable: "Service Unavailable",
+	StatusHTTPVersionNotSupported: "HTTP Version Not Supported",
+}
+
 type responseWriterState int
 const (
 	writingStatusLine responseWriterState = iota
@@ -21,13 +64,59 @@ const (
 	writingBody
 	writingChunkedBody
 	done
+	hijacked
 )
 
 type ResponseWriter struct {
 	Headers Headers
 	Trailers Headers
-	writer io.Writer
+	// Collects the response, so the head and small bodies go out in one
+	// write. Flushed when the response is complete and on Flush
+	writer *bufio.Writer
 	state responseWriterState
+	// nil if the writer is not backed by a server connection
+	conn *conn
+	// Version of the request, empty means HTTP/1.1
+	proto string
+	// The body is sent without framing and ends when the connection closes
+	close_delimited bool
+	// Set for HTTP/2 responses, which send the status with the headers
+	stream *h2Stream
+	status ResponseStatusCode
+	// Response to a HEAD request, only the headers are sent
+	head bool
+}
+
+// Creates a writer for an HTTP/1.1 response to dst, e.g. to record what a
+// handler writes. It is not backed by a connection, so the response asks
+// for the connection to be closed and can not be hijacked
+func NewResponseWriter(dst io.Writer) ResponseWriter {
+	return ResponseWriter{Headers: Headers{}, writer: bufio.NewWriter(dst), state: writingStatusLine}
+}
+
+// Sends what has been written so far, e.g. each event of a stream. A
+// response is flushed anyway once it is complete
+func (w *ResponseWriter) Flush() error {
+	if w.stream != nil || w.writer == nil { return nil }
+	return w.writer.Flush()
+}
+
+// Lets the handler take over the connection, e.g. for protocol upgrades.
+// Bytes the server has already read past the request are available from
+// the returned reader. After hijacking the server no longer closes or
+// otherwise manages the connection
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.conn == nil {
+		return nil, nil, fmt.Errorf("Response writer is not backed by a connection")
+	}
+	if w.state != writingStatusLine {
+		return nil, nil, fmt.Errorf("Invalid state for hijacking: %d", w.state)
+	}
+
+	rwc, brw, err := w.conn.hijack()
+	if err != nil { return nil, nil, err }
+	w.state = hijacked
+	return rwc, brw, nil
 }
 
 func (w *ResponseWriter) WriteStatusLine(sc ResponseStatusCode) error {
@@ -35,22 +124,29 @@ func (w *ResponseWriter) WriteStatusLine(sc ResponseStatusCode) error {
 		return fmt.Errorf("Invalid state for writing status line: %d", w.state)
 	}
 
-	switch sc {
-	case StatusOK:
-		_, err := w.writer.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		w.state = writingHeaders
-		return err
-	case StatusBadRequest:
-		_, err := w.writer.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		w.state = writingHeaders
-		return err
-	case StatusInternalServerError:
-		_, err := w.writer.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
+	text, ok := statusText[sc]
+	if !ok { return fmt.Errorf("Invalid response status code: %d", sc) }
+	return w.writeStatusLine(sc, text)
+}
+
+// Writes any status code with the given reason phrase, e.g. one passed on
+// from an upstream server
+func (w *ResponseWriter) writeStatusLine(sc ResponseStatusCode, text string) error {
+	if w.stream != nil {
+		w.status = sc
 		w.state = writingHeaders
-		return err
-	default:
-		return fmt.Errorf("Invalid response status code: %d", sc)
+		return nil
 	}
+	// HTTP/1.0 clients get a status line they know
+	w.status = sc
+	version := "HTTP/1.1"
+	if w.proto == "HTTP/1.0" { version = w.proto }
+	line := append(w.writer.AvailableBuffer(), version...)
+	line = append(strconv.AppendInt(append(line, ' '), int64(sc), 10), ' ')
+	line = append(append(line, text...), "\r\n"...)
+	_, err := w.writer.Write(line)
+	w.state = writingHeaders
+	return err
 }
 
 // Does not write headers to data. Good for adding headers after writing body
@@ -84,74 +180,163 @@ func (w *ResponseWriter) WriteBody(data []byte) (int, error) {
 		return 0, fmt.Errorf("Content-Type header is required to write to body")
 	}
 
-	// Set default headers
-	if _, ok := w.Headers["transfer-encoding"]; !ok {
-		w.Headers.Set("Content-Length", strconv.Itoa(len(data)))
-	}
-	if _, ok := w.Headers["connection"]; !ok {
-		w.Headers.Set("Connection", "close")
+	// Trailers need chunked encoding, so the body is sent as a single chunk
+	if w.Headers.Get("transfer-encoding") == "chunked" {
+		total_written, err := w.WriteChunkedBody(data)
+		if err != nil { return total_written, err }
+		n, err := w.WriteChunkedBodyDone()
+		return total_written + n, err
 	}
 
-	total_written := 0
+	// A 304 keeps the length of the response it stands for
+	if w.status != StatusNotModified { w.Headers.Set("Content-Length", strconv.Itoa(len(data))) }
+	if w.stream != nil { return w.writeH2Body(data) }
 
 	// Write headers
-	for name, value := range w.Headers {
-		n, err := w.writer.Write([]byte(name + ": " + value + "\r\n"))
-		if err != nil { return 0, err }
-		total_written += n
-	}
-	n, err := w.writer.Write([]byte("\r\n"))
+	total_written, err := w.flushHeaders()
 	if err != nil { return 0, err }
-	total_written += n
 	
 	// Write body
-	n, err = w.writer.Write(data)
-	if err != nil { return 0, err }
-	total_written += n
-
-	// Write trailers
-	for name, value := range w.Headers {
-		n, err := w.writer.Write([]byte(name + ": " + value + "\r\n"))
+	if w.bodyAllowed() {
+		n, err := w.writer.Write(data)
 		if err != nil { return 0, err }
 		total_written += n
 	}
-	n, err = w.writer.Write([]byte("\r\n"))
+
+	return total_written, w.finish()
+}
+
+// Streams size bytes from src as the body. The headers are written before
+// the body is copied with io.Copy, so when src is an *os.File and the
+// connection a *net.TCPConn the kernel can use sendfile/splice. Any other
+// combination falls back to a regular copy. Chunked responses are framed
+// chunk by chunk and end with WriteChunkedBodyDone
+func (w *ResponseWriter) WriteBodyFrom(src io.Reader, size int64) (int64, error) {
+	if w.state != writingBody {
+		return 0, fmt.Errorf("Invalid state for writing body: %d", w.state)
+	}
+	if _, ok := w.Headers["content-type"]; !ok {
+		return 0, fmt.Errorf("Content-Type header is required to write to body")
+	}
+	return w.writeBodyFrom(src, size)
+}
+
+func (w *ResponseWriter) writeBodyFrom(src io.Reader, size int64) (int64, error) {
+	src = io.LimitReader(src, size)
+	if w.Headers.Get("transfer-encoding") == "chunked" {
+		total_written := int64(0)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				written, err := w.WriteChunkedBody(buf[:n])
+				if err != nil { return total_written, err }
+				total_written += int64(written)
+				// Data of unknown length may be a stream, e.g. passed on by
+				// a proxy, and is sent as it arrives
+				if err := w.Flush(); err != nil { return total_written, err }
+			}
+			if errors.Is(err, io.EOF) { break }
+			if err != nil { return total_written, err }
+		}
+		// Nothing was read, headers still have to be written
+		if w.state == writingBody {
+			written, err := w.WriteChunkedBody(nil)
+			if err != nil { return total_written, err }
+			total_written += int64(written)
+		}
+		written, err := w.WriteChunkedBodyDone()
+		return total_written + int64(written), err
+	}
+
+	w.Headers.Set("Content-Length", strconv.FormatInt(size, 10))
+	if w.stream != nil { return w.writeH2BodyFrom(src, size) }
+
+	total_written, err := w.flushHeaders()
 	if err != nil { return 0, err }
-	total_written += n
+	if !w.bodyAllowed() { return int64(total_written), w.finish() }
 
+	// A small body goes out with the head in one write. A larger one is
+	// copied once the head is flushed, then bufio.Writer hands the source to
+	// the connection's ReadFrom, which sends files with sendfile
+	if size > int64(w.writer.Available()) {
+		if err := w.writer.Flush(); err != nil { return int64(total_written), err }
+	}
+	n, err := io.Copy(w.writer, src)
 	w.state = done
-	return total_written, nil
+	if err == nil && n != size {
+		err = fmt.Errorf("Body is shorter than size: %d of %d bytes", n, size)
+	}
+	if err != nil { return int64(total_written) + n, err }
+	return int64(total_written) + n, w.finish()
+}
+
+// Sends the headers of a response that has no body, e.g. one to HEAD or
+// with status 204 or 304. Content-Length is left as it is
+func (w *ResponseWriter) writeNoBody() error {
+	if w.state != writingBody {
+		return fmt.Errorf("Invalid state for writing body: %d", w.state)
+	}
+	if w.stream != nil {
+		w.state = done
+		return w.writeH2Headers(true)
+	}
+	if _, err := w.flushHeaders(); err != nil { return err }
+	return w.finish()
 }
 
 func (w *ResponseWriter) WriteChunkedBody(data []byte) (int, error) {
 	if w.state != writingBody && w.state != writingChunkedBody {
 		return 0, fmt.Errorf("Invalid state for writing body: %d", w.state)
 	}
-	if enc := w.Headers.Get("transfer-encoding"); enc != "chunked" {
+	if enc := w.Headers.Get("transfer-encoding"); enc != "chunked" && !w.close_delimited {
 		return 0, fmt.Errorf("Transfer-Encoding must be set to chunked to write chunked body")
 	}
 
+	if w.stream != nil {
+		if w.state == writingBody {
+			if err := w.writeH2Headers(!w.bodyAllowed()); err != nil { return 0, err }
+			w.state = writingChunkedBody
+		}
+		if len(data) == 0 || !w.bodyAllowed() { return 0, nil }
+		return w.stream.hc.writeData(w.stream, data, false)
+	}
+
 	total_written := 0
 
 	// Write headers once
 	if w.state == writingBody {
-		for name, value := range w.Headers {
-			n, err := w.writer.Write([]byte(name + ": " + value + "\r\n"))
-			if err != nil { return 0, err }
-			total_written += n
+		// HTTP/1.0 has no chunked encoding, the body ends when the
+		// connection closes instead. See RFC 9112 6.3
+		if w.proto == "HTTP/1.0" {
+			delete(w.Headers, "transfer-encoding")
+			delete(w.Headers, "trailer")
+			w.close_delimited = true
 		}
-		n, err := w.writer.Write([]byte("\r\n"))
+		n, err := w.flushHeaders()
 		if err != nil { return 0, err }
 		total_written += n
 	}
 
-	// Write data len in hex
-	hex := strconv.FormatInt(int64(len(data)), 16)
-	w.writer.Write([]byte(hex + "\r\n"))
-	w.writer.Write(data)
-	w.writer.Write([]byte("\r\n"))
-
 	w.state = writingChunkedBody
+	// A zero length chunk would end the body
+	if len(data) == 0 || !w.bodyAllowed() { return total_written, nil }
+	if w.close_delimited {
+		n, err := w.writer.Write(data)
+		return total_written + n, err
+	}
+
+	// Write data len in hex
+	size := strconv.AppendInt(w.writer.AvailableBuffer(), int64(len(data)), 16)
+	n, err := w.writer.Write(append(size, "\r\n"...))
+	if err != nil { return total_written, err }
+	total_written += n
+	n, err = w.writer.Write(data)
+	if err != nil { return total_written, err }
+	total_written += n
+	n, err = w.writer.WriteString("\r\n")
+	if err != nil { return total_written, err }
+	total_written += n
 
 	return total_written, nil
 }
@@ -160,25 +345,115 @@ func (w *ResponseWriter) WriteChunkedBodyDone() (int, error) {
 	if w.state != writingChunkedBody {
 		return 0, fmt.Errorf("Invalid state for writing chunked body done: %d", w.state)
 	}
+	if w.stream != nil {
+		w.state = done
+		// The stream already ended with the headers
+		if !w.bodyAllowed() { return 0, nil }
+		return 0, w.finishH2()
+	}
+	// Trailers can not be sent without chunked encoding
+	if w.close_delimited || !w.bodyAllowed() { return 0, w.finish() }
 
-	total_written := 0
-
-	// Write chunked body end
-	n, err := w.writer.Write([]byte("0\r\n"))
+	// Write chunked body end and trailers
+	n, err := w.writer.WriteString("0\r\n")
 	if err != nil { return 0, err }
-	total_written += n
+	total_written, err := w.writeFields(w.Trailers)
+	if err != nil { return 0, err }
+	return n + total_written, w.finish()
+}
 
-	// Write trailers
-	for name, value := range w.Headers {
-		n, err := w.writer.Write([]byte(name + ": " + value + "\r\n"))
-		if err != nil { return 0, err }
-		total_written += n
+// Passes on a response that ResponseFromReader read for a request with
+// the given method, e.g. in a proxy. Hop-by-hop headers are dropped and
+// the body is framed for this connection as it arrives. See RFC 9110 7.6
+func (w *ResponseWriter) WriteResponse(resp *Response, method string) error {
+	resp_body, ok := resp.Body.(*body)
+	if !ok { return fmt.Errorf("Response was not read by ResponseFromReader") }
+
+	hop := HopByHopHeaders(resp.Headers.Get("connection"))
+	headers := Headers{}
+	for name, value := range resp.Headers {
+		if !hop[name] { headers.Set(name, value) }
 	}
-	n, err = w.writer.Write([]byte("\r\n"))
-	if err != nil { return 0, err }
-	total_written += n
+	if err := w.writeStatusLine(resp.StatusCode, resp.Reason); err != nil { return err }
+	if err := w.WriteHeaders(headers); err != nil { return err }
 
+	switch {
+	case method == "HEAD" || resp.StatusCode == StatusNoContent || resp.StatusCode == StatusNotModified:
+		return w.writeNoBody()
+	case !resp_body.is_chunked && !resp_body.until_eof:
+		_, err := w.writeBodyFrom(resp_body, int64(resp_body.content_length))
+		return err
+	default:
+		// Unknown length, the body is streamed and ends with the trailers
+		delete(w.Headers, "content-length")
+		w.Headers.Set("Transfer-Encoding", "chunked")
+		if trailer := resp.Headers.Get("trailer"); trailer != "" { w.Headers.Set("Trailer", trailer) }
+		w.Trailers = resp.Trailers
+		_, err := w.writeBodyFrom(resp_body, math.MaxInt64)
+		return err
+	}
+}
+
+// Marks the response as completely written and sends it
+func (w *ResponseWriter) finish() error {
 	w.state = done
+	if w.conn != nil { w.conn.response_done = true }
+	return w.writer.Flush()
+}
 
-	return total_written, nil
+// Persistent connections are the default for HTTP/1.1, HTTP/1.0 clients
+// have to ask for them with Connection: keep-alive. See RFC 9112 9.3
+func (w *ResponseWriter) setConnectionHeader() {
+	keep_alive := w.conn != nil && w.conn.keep_alive && !w.close_delimited &&
+		!HeaderHasToken(w.Headers.Get("connection"), "close")
+	if !keep_alive {
+		w.Headers.Set("Connection", "close")
+		if w.conn != nil { w.conn.keep_alive = false }
+	} else if w.proto == "HTTP/1.0" {
+		w.Headers.Set("Connection", "keep-alive")
+	}
+}
+
+// Responses to HEAD and with status 1xx, 204 or 304 have no content.
+// See RFC 9110 9.3.2 and RFC 9112 6.3
+func (w *ResponseWriter) bodyAllowed() bool {
+	return !w.head && w.status >= 200 && w.status != StatusNoContent && w.status != StatusNotModified
+}
+
+// Origin servers with a clock send Date. See RFC 9110 6.6.1
+func (w *ResponseWriter) setDateHeader() {
+	if w.Headers.Get("date") == "" { w.Headers.Set("Date", time.Now().UTC().Format(TimeFormat)) }
+}
+
+// Writes the headers followed by the empty line that ends them
+func (w *ResponseWriter) flushHeaders() (int, error) {
+	w.setConnectionHeader()
+	w.setDateHeader()
+	// See RFC 9110 8.6 and RFC 9112 6.1
+	if w.status < 200 || w.status == StatusNoContent {
+		delete(w.Headers, "content-length")
+		delete(w.Headers, "transfer-encoding")
+	}
+	return w.writeFields(w.Headers)
+}
+
+// Writes a field line per value followed by the empty line that ends the
+// section. Only Set-Cookie has more than one value
+func (w *ResponseWriter) writeFields(fields Headers) (int, error) {
+	total_written := 0
+	for name, value := range fields {
+		for value != "" {
+			line, rest, _ := strings.Cut(value, "\n")
+			value = rest
+			// bufio.Writer keeps the first error, the last write reports it
+			n1, _ := w.writer.WriteString(name)
+			n2, _ := w.writer.WriteString(": ")
+			n3, _ := w.writer.WriteString(line)
+			n4, err := w.writer.WriteString("\r\n")
+			total_written += n1 + n2 + n3 + n4
+			if err != nil { return total_written, err }
+		}
+	}
+	n, err := w.writer.WriteString("\r\n")
+	return total_written + n, err
 }
@@ -0,0 +1,163 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Response read from an upstream server
+type Response struct {
+	Version string
+	StatusCode ResponseStatusCode
+	// Reason phrase of the status line, may be empty
+	Reason string
+	Headers Headers
+	Body io.ReadCloser
+	// Sent after a chunked body. Filled once Body returned io.EOF
+	Trailers Headers
+	// Name of the last parsed field, for obs-fold
+	last_field string
+}
+
+// Parses an HTTP/1.1 response to a request with the given method, which
+// decides whether a body follows. Interim responses other than 101 are
+// skipped. Closing the body closes reader if it is an io.Closer.
+// See RFC 9110 15.2
+func ResponseFromReader(r io.Reader, method string) (*Response, error) {
+	reader, ok := r.(io.ReadCloser)
+	if !ok { reader = io.NopCloser(r) }
+	resp := &Response{Headers: Headers{}}
+	rb := &readBuffer{rd: reader, buf: make([]byte, buffer_size)}
+	head_size := 0
+	for {
+		parsed_bytes, done, err := resp.parseHead(rb.buffered())
+		if err != nil { return nil, err }
+		rb.consume(parsed_bytes)
+		head_size += parsed_bytes
+		if done {
+			if resp.StatusCode >= 200 || resp.StatusCode == 101 { break }
+			resp = &Response{Headers: Headers{}}
+			continue
+		}
+
+		// An upstream server must not make us buffer without bound
+		if head_size + len(rb.buffered()) >= maxHeadSize { return nil, errHeadTooLarge }
+		err = rb.fill()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("incomplete response, reached EOF while parsing headers")
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	b := &body{rc: reader, rb: rb}
+	resp.Body = b
+	// See RFC 9112 6.3
+	transfer_encoding := resp.Headers.Get("transfer-encoding")
+	switch {
+	case method == "HEAD" || resp.StatusCode < 200 || resp.StatusCode == 204 || resp.StatusCode == 304:
+	case transfer_encoding != "":
+		codings := strings.Split(transfer_encoding, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			b.until_eof = true
+			break
+		}
+		resp.Trailers = Headers{}
+		b.is_chunked = true
+		b.trailers = resp.Trailers
+	case resp.Headers.Get("content-length") != "":
+		content_length, err := parseContentLength(resp.Headers.Get("content-length"))
+		if err != nil { return nil, err }
+		b.content_length = content_length
+	default:
+		b.until_eof = true
+	}
+	return resp, nil
+}
+
+// Parses as much of the status line and headers as data holds. Reports
+// true once the empty line after the headers was consumed
+func (resp *Response) parseHead(data []byte) (int, bool, error) {
+	total_consumed_bytes := 0
+	for {
+		if resp.StatusCode == 0 {
+			n, err := resp.parseStatusLine(data[total_consumed_bytes:])
+			if err != nil || n == 0 { return total_consumed_bytes, false, err }
+			total_consumed_bytes += n
+			continue
+		}
+		rest := data[total_consumed_bytes:]
+		if len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t') {
+			n, err := resp.parseObsFold(rest)
+			if err != nil || n == 0 { return total_consumed_bytes, false, err }
+			total_consumed_bytes += n
+			continue
+		}
+		n, done, err := resp.Headers.parse(rest)
+		if n > 0 && !done {
+			name, _, _ := strings.Cut(string(rest[:n]), ":")
+			resp.last_field = strings.ToLower(strings.TrimSpace(name))
+		}
+		if err != nil { return 0, false, err }
+		total_consumed_bytes += n
+		if done || n == 0 { return total_consumed_bytes, done, nil }
+	}
+}
+
+// A line starting with whitespace continues the previous field and is
+// joined with a space. Directly after the status line it is rejected.
+// See RFC 9112 2.2 and 5.2
+func (resp *Response) parseObsFold(data []byte) (int, error) {
+	idx := bytes.Index(data, []byte("\r\n"))
+	if idx == -1 { return 0, nil }
+	if resp.last_field == "" { return 0, fmt.Errorf("Header line must not start with whitespace") }
+	value := strings.TrimSpace(string(data[:idx]))
+	if !isValidHeaderValue(value) { return 0, fmt.Errorf("Invalid character in header value: %q", value) }
+	if value != "" { resp.Headers[resp.last_field] += " " + value }
+	return idx + 2, nil
+}
+
+// See RFC 9112 4
+func (resp *Response) parseStatusLine(data []byte) (int, error) {
+	idx := bytes.Index(data, []byte("\r\n"))
+	if idx == -1 { return 0, nil }
+
+	line := string(data[:idx])
+	version, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	if version != "HTTP/1.1" && version != "HTTP/1.0" {
+		return 0, fmt.Errorf("%w: '%s'", errVersionNotSupported, version)
+	}
+	status_code, err := strconv.Atoi(code)
+	if len(code) != 3 || err != nil || status_code < 100 {
+		return 0, fmt.Errorf("Invalid status code: '%s'", code)
+	}
+
+	resp.Version = version
+	resp.StatusCode = ResponseStatusCode(status_code)
+	resp.Reason = reason
+	return idx + 2, nil
+}
+
+// Repeated Content-Length headers are combined by Headers.Add and have to
+// be identical. Content-Length = 1*DIGIT, signs like in "-0" are invalid.
+// See RFC 9110 8.6
+func parseContentLength(value string) (int, error) {
+	values := strings.Split(value, ",")
+	for _, v := range values[1:] {
+		if strings.TrimSpace(v) != strings.TrimSpace(values[0]) {
+			return 0, fmt.Errorf("Conflicting Content-Length: '%s'", value)
+		}
+	}
+	digits := strings.TrimSpace(values[0])
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, fmt.Errorf("Invalid Content-Length: '%s'", value)
+	}
+	content_length, err := strconv.Atoi(digits)
+	if err != nil { return 0, fmt.Errorf("Invalid Content-Length: '%s'", value) }
+	return content_length, nil
+}
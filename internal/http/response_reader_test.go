@@ -0,0 +1,170 @@
+package http
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseFromReader(t *testing.T) {
+	readBody := func(resp *Response) string {
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// Test: Good response with Content-Length
+	for _, per_read := range []int{1, 3, 1024} {
+		reader := &chunkReader{
+			data:            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 13\r\n\r\nHello, World!",
+			numBytesPerRead: per_read,
+		}
+		resp, err := ResponseFromReader(reader, "GET")
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1", resp.Version)
+		assert.Equal(t, StatusOK, resp.StatusCode)
+		assert.Equal(t, "OK", resp.Reason)
+		assert.Equal(t, "text/plain", resp.Headers.Get("content-type"))
+		assert.Equal(t, "Hello, World!", readBody(resp))
+	}
+
+	// Test: Reason phrase with spaces and without one
+	reader := &chunkReader{
+		data:            "HTTP/1.1 404 Not Found Here\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	resp, err := ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, ResponseStatusCode(404), resp.StatusCode)
+	assert.Equal(t, "Not Found Here", resp.Reason)
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	resp, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Reason)
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+			"5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	resp, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", readBody(resp))
+	assert.Equal(t, "abc", resp.Trailers.Get("x-checksum"))
+
+	// Test: Close delimited body of an HTTP/1.0 response
+	reader = &chunkReader{
+		data:            "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the connection closes",
+		numBytesPerRead: 4,
+	}
+	resp, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0", resp.Version)
+	assert.Equal(t, "until the connection closes", readBody(resp))
+
+	// Test: Transfer-Encoding without chunked last is read until EOF
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\nContent-Length: 2\r\n\r\ncompressed",
+		numBytesPerRead: 4,
+	}
+	resp, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "compressed", readBody(resp))
+
+	// Test: No body for HEAD, 204 and 304 despite Content-Length
+	for _, tc := range []struct{ data, method string }{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", "HEAD"},
+		{"HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\n", "GET"},
+		{"HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n", "GET"},
+	} {
+		resp, err = ResponseFromReader(&chunkReader{data: tc.data + "extra", numBytesPerRead: 3}, tc.method)
+		require.NoError(t, err)
+		assert.Equal(t, "5", resp.Headers.Get("content-length"))
+		assert.Empty(t, readBody(resp))
+	}
+
+	// Test: Interim responses are skipped, their headers are not kept
+	reader = &chunkReader{
+		data:            "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\n" +
+			"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 7,
+	}
+	resp, err = ResponseFromReader(reader, "POST")
+	require.NoError(t, err)
+	assert.Equal(t, ResponseStatusCode(201), resp.StatusCode)
+	assert.Empty(t, resp.Headers.Get("link"))
+	assert.Equal(t, "ok", readBody(resp))
+
+	// Test: 101 is final and has no body
+	reader = &chunkReader{
+		data:            "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	resp, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, ResponseStatusCode(101), resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Headers.Get("upgrade"))
+
+	// Test: Repeated identical Content-Length
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc",
+		numBytesPerRead: 3,
+	}
+	resp, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", readBody(resp))
+
+	// Test: Plain io.Reader
+	resp, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hi", readBody(resp))
+	require.NoError(t, resp.Body.Close())
+
+	// Test: Body shorter than Content-Length
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+		numBytesPerRead: 3,
+	}
+	resp, err = ResponseFromReader(reader, "GET")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Invalid responses
+	for _, data := range []string{
+		"HTTP/2 200 OK\r\n\r\n",
+		"HTTP/1.1 20 OK\r\n\r\n",
+		"HTTP/1.1 abc OK\r\n\r\n",
+		"HTTP/1.1 099 Low\r\n\r\n",
+		"GET / HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nBad Header\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabc",
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: +1\r\n\r\nx",
+		"HTTP/1.1 200 OK\r\nContent-Length: -0\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 0x1\r\n\r\nx",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n",
+		"",
+	} {
+		_, err = ResponseFromReader(&chunkReader{data: data, numBytesPerRead: 4}, "GET")
+		require.Error(t, err, data)
+	}
+
+	// Test: Endless heads are not buffered
+	for _, reader := range []io.Reader{
+		io.MultiReader(strings.NewReader("HTTP/1.1 200 OK\r\n"), &repeatReader{data: []byte(strings.Repeat("X-Field: value\r\n", 256))}),
+		io.MultiReader(strings.NewReader("HTTP/1.1 200 OK\r\nX-Field: "), &repeatReader{data: []byte(strings.Repeat("value", 1024))}),
+		&repeatReader{data: []byte(strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 256))},
+	} {
+		_, err = ResponseFromReader(reader, "GET")
+		require.ErrorIs(t, err, errHeadTooLarge)
+	}
+}
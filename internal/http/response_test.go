@@ -0,0 +1,239 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBodyFrom(t *testing.T) {
+	// Test: Fixed length body
+	buf := &bytes.Buffer{}
+	w := NewResponseWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "text/plain"}))
+	_, err := w.WriteBodyFrom(strings.NewReader("hello world!\nignored"), 13)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "content-length: 13\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello world!\n"))
+
+	// Test: Source shorter than size
+	buf = &bytes.Buffer{}
+	w = NewResponseWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "text/plain"}))
+	_, err = w.WriteBodyFrom(strings.NewReader("short"), 13)
+	require.Error(t, err)
+
+	// Test: Chunked body falls back to chunk framing
+	buf = &bytes.Buffer{}
+	w = NewResponseWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"}))
+	_, err = w.WriteBodyFrom(strings.NewReader("hello world!\n"), 13)
+	require.NoError(t, err)
+	assert.NotContains(t, buf.String(), "content-length")
+	assert.Contains(t, buf.String(), "\r\n\r\nd\r\nhello world!\n\r\n0\r\n")
+
+	// Test: A file body reaches ReadFrom of the connection, e.g. for sendfile
+	path := filepath.Join(t.TempDir(), "large.bin")
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("a"), 64 << 10), 0o644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	rf := &readFromRecorder{}
+	w = NewResponseWriter(rf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "application/octet-stream"}))
+	_, err = w.WriteBodyFrom(f, 64 << 10)
+	require.NoError(t, err)
+	require.Len(t, rf.sources, 1)
+	lr, ok := rf.sources[0].(*io.LimitedReader)
+	require.True(t, ok)
+	assert.Same(t, f, lr.R)
+	assert.Equal(t, int64(64 << 10), rf.read)
+	assert.True(t, strings.HasSuffix(rf.String(), "\r\n\r\n" + strings.Repeat("a", 64 << 10)))
+}
+
+// Records the sources passed to ReadFrom, like a TCP connection would get,
+// and how much it read from them
+type readFromRecorder struct {
+	bytes.Buffer
+	sources []io.Reader
+	read int64
+}
+
+func (rf *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	rf.sources = append(rf.sources, r)
+	n, err := rf.Buffer.ReadFrom(r)
+	rf.read += n
+	return n, err
+}
+
+// Fails every write after the first n
+type failingWriter struct {
+	n int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.n == 0 { return 0, errors.New("write failed") }
+	fw.n--
+	return len(p), nil
+}
+
+func TestResponseWriterBuffering(t *testing.T) {
+	// Test: Head and a small body go out in one write
+	cw := &countingWriter{}
+	w := NewResponseWriter(cw)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "text/plain"}))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, cw.writes)
+
+	// Test: Chunks are sent on Flush and with the end of the body
+	cw = &countingWriter{}
+	w = NewResponseWriter(cw)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"}))
+	for range 3 {
+		_, err = w.WriteChunkedBody([]byte("chunk"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 0, cw.writes)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 1, cw.writes)
+	_, err = w.WriteChunkedBody([]byte("last"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.Equal(t, 2, cw.writes)
+
+	// Test: Write errors are returned
+	w = NewResponseWriter(&failingWriter{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "text/plain"}))
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+
+	w = NewResponseWriter(&failingWriter{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(Headers{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"}))
+	_, err = w.WriteChunkedBody(bytes.Repeat([]byte("x"), 2 * buffer_size))
+	require.Error(t, err)
+	_, err = w.WriteChunkedBody([]byte("more"))
+	require.Error(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.Error(t, err)
+}
+
+const benchFileSize = 64 << 20
+
+// Returns a large file and a TCP connection whose peer discards everything
+func benchSetup(b *testing.B) (*os.File, net.Conn) {
+	path := filepath.Join(b.TempDir(), "large.bin")
+	require.NoError(b, os.WriteFile(path, bytes.Repeat([]byte("a"), benchFileSize), 0o644))
+	f, err := os.Open(path)
+	require.NoError(b, err)
+	b.Cleanup(func() { f.Close() })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	b.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil { return }
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(b, err)
+	b.Cleanup(func() { conn.Close() })
+	return f, conn
+}
+
+func BenchmarkWriteBody(b *testing.B) {
+	f, conn := benchSetup(b)
+	b.SetBytes(benchFileSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		data, err := os.ReadFile(f.Name())
+		if err != nil { b.Fatal(err) }
+		w := NewResponseWriter(conn)
+		w.Headers.Set("Content-Type", "application/octet-stream")
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(nil)
+		if _, err := w.WriteBody(data); err != nil { b.Fatal(err) }
+	}
+}
+
+func BenchmarkWriteBodyFrom(b *testing.B) {
+	f, conn := benchSetup(b)
+	b.SetBytes(benchFileSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := f.Seek(0, io.SeekStart); err != nil { b.Fatal(err) }
+		w := NewResponseWriter(conn)
+		w.Headers.Set("Content-Type", "application/octet-stream")
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(nil)
+		if _, err := w.WriteBodyFrom(f, benchFileSize); err != nil { b.Fatal(err) }
+	}
+}
+
+// Counts the writes that would each be a syscall on a connection
+type countingWriter struct {
+	writes int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return len(p), nil
+}
+
+func BenchmarkResponseWriter(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 100)
+	for _, bc := range []struct {
+		name string
+		write func(w *ResponseWriter)
+	}{
+		{"Small Body", func(w *ResponseWriter) {
+			w.WriteHeaders(Headers{"Content-Type": "text/plain", "Cache-Control": "no-cache", "X-Request-Id": "1"})
+			w.WriteBody([]byte("hello world"))
+		}},
+		{"Chunked", func(w *ResponseWriter) {
+			w.WriteHeaders(Headers{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"})
+			w.WriteTrailers(Headers{"X-Checksum": "abc"})
+			for range 10 { w.WriteChunkedBody(chunk) }
+			w.WriteChunkedBodyDone()
+		}},
+	} {
+		// Unbuffered passes every write straight on, like the writer did
+		// before responses were buffered per connection
+		for _, size := range []int{buffer_size, 1} {
+			name := bc.name + "/Buffered"
+			if size == 1 { name = bc.name + "/Unbuffered" }
+			b.Run(name, func(b *testing.B) {
+				cw := &countingWriter{}
+				b.ReportAllocs()
+				for b.Loop() {
+					w := NewResponseWriter(cw)
+					w.writer = bufio.NewWriterSize(cw, size)
+					w.WriteStatusLine(StatusOK)
+					bc.write(&w)
+				}
+				b.ReportMetric(float64(cw.writes) / float64(b.N), "writes/op")
+			})
+		}
+	}
+}
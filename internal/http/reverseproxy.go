@@ -0,0 +1,345 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BalancePolicy int
+const (
+	RoundRobin BalancePolicy = iota
+	// Picks the backend with the fewest requests in flight
+	LeastConnections
+	// Picks the backend by ReverseProxy.HashKey, so the same key keeps
+	// going to the same backend while it is available
+	ConsistentHash
+)
+
+const (
+	DefaultUpstreamTimeout = 30 * time.Second
+	DefaultFailTimeout = 10 * time.Second
+	DefaultHealthCheckInterval = 5 * time.Second
+)
+
+// Points per backend on the hash ring, more spread keys more evenly
+const hashRingReplicas = 100
+
+// Forwards requests to a pool of backends. Backends are taken out of
+// rotation when active health checks fail or after MaxFails failed
+// attempts, which is what passive ejection means here. Upgrade requests,
+// e.g. WebSockets, are not passed on
+type ReverseProxy struct {
+	Policy BalancePolicy
+	// Key for ConsistentHash. Defaults to the client IP
+	HashKey func(r *Request) string
+	// Sends the Host of the client request instead of the backend address
+	PreserveHost bool
+	// Limit for connecting to a backend and for waiting on its response
+	// headers. Defaults to DefaultUpstreamTimeout
+	Timeout time.Duration
+	// Failed attempts in a row after which a backend is ejected for
+	// FailTimeout. Defaults to 1 and DefaultFailTimeout
+	MaxFails int
+	FailTimeout time.Duration
+	// Path requested by RunHealthChecks. Backends answering with anything
+	// but 2xx or 3xx are out of rotation until they pass again
+	HealthCheckPath string
+	// Defaults to DefaultHealthCheckInterval
+	HealthCheckInterval time.Duration
+	ErrorLog *log.Logger
+	backends []*backend
+	ring []ringPoint
+	next atomic.Uint64
+	mu sync.Mutex
+}
+
+type backend struct {
+	address string
+	// Requests in flight
+	active atomic.Int64
+	// Guarded by ReverseProxy.mu
+	fails int
+	ejected_until time.Time
+	unhealthy bool
+}
+
+type ringPoint struct {
+	hash uint64
+	backend *backend
+}
+
+// Creates a proxy for backends given as "host:port". Options have to be set
+// before the proxy serves requests
+func NewReverseProxy(backends []string) *ReverseProxy {
+	p := &ReverseProxy{}
+	for _, address := range backends {
+		b := &backend{address: address}
+		p.backends = append(p.backends, b)
+		for i := range hashRingReplicas {
+			p.ring = append(p.ring, ringPoint{hashKey(address + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	slices.SortFunc(p.ring, func(a, b ringPoint) int {
+		if a.hash < b.hash { return -1 }
+		if a.hash > b.hash { return 1 }
+		return 0
+	})
+	return p
+}
+
+// Serves a request from a backend. Backends that can not be reached are
+// skipped, since nothing has been sent to them yet. See RFC 9110 7.6
+func (p *ReverseProxy) Handle(w ResponseWriter, r *Request) {
+	if r.Target.Form == AuthorityForm {
+		p.fail(&w, StatusBadRequest, "CONNECT is not supported")
+		return
+	}
+
+	tried := map[*backend]bool{}
+	for range p.backends {
+		b := p.pick(r, tried)
+		if b == nil { break }
+		tried[b] = true
+
+		dialer := net.Dialer{Timeout: p.timeout()}
+		upstream, err := dialer.DialContext(r.Context(), "tcp", b.address)
+		if err != nil {
+			if r.Context().Err() != nil { return }
+			p.logf("Error connecting to backend %s: %v", b.address, err)
+			p.markFailed(b)
+			continue
+		}
+		p.serve(&w, r, b, upstream)
+		return
+	}
+	p.fail(&w, StatusBadGateway, "No backend available")
+}
+
+func (p *ReverseProxy) serve(w *ResponseWriter, r *Request, b *backend, upstream net.Conn) {
+	b.active.Add(1)
+	defer b.active.Add(-1)
+	defer upstream.Close()
+	stop := context.AfterFunc(r.Context(), func() { upstream.Close() })
+	defer stop()
+
+	if err := p.writeRequest(upstream, r, b); err != nil {
+		p.logf("Error forwarding request to backend %s: %v", b.address, err)
+		p.fail(w, StatusBadGateway, "Could not forward request")
+		return
+	}
+	upstream.SetReadDeadline(time.Now().Add(p.timeout()))
+	resp, err := ResponseFromReader(upstream, r.StatusLine.Method)
+	if err == nil && resp.StatusCode == 101 { err = fmt.Errorf("Unexpected protocol switch") }
+	if err != nil {
+		if r.Context().Err() != nil { return }
+		p.logf("Error reading response from backend %s: %v", b.address, err)
+		p.markFailed(b)
+		p.fail(w, StatusBadGateway, "Invalid response from backend")
+		return
+	}
+	upstream.SetReadDeadline(time.Time{})
+	p.markOK(b)
+
+	w.WriteResponse(resp, r.StatusLine.Method)
+}
+
+// Sends the request with forwarding headers added. The connection is only
+// used for this request
+func (p *ReverseProxy) writeRequest(dst io.Writer, r *Request, b *backend) error {
+	headers := Headers{}
+	hop := HopByHopHeaders(r.Headers.Get("connection"))
+	for name, value := range r.Headers {
+		if !hop[name] { headers.Set(name, value) }
+	}
+	// Needed to pass trailers on, e.g. for gRPC. See RFC 9110 10.1.4. Write
+	// keeps the declaration only if it frames the body in chunks
+	if HeaderHasToken(r.Headers.Get("te"), "trailers") { headers.Set("TE", "trailers") }
+	if trailer := r.Headers.Get("trailer"); trailer != "" { headers.Set("Trailer", trailer) }
+	headers.Set("Connection", "close")
+	p.setForwardingHeaders(headers, r)
+	if !p.PreserveHost { headers.Set("Host", b.address) }
+
+	out := *r
+	out.Headers = headers
+	return out.Write(dst)
+}
+
+// Appends this hop to X-Forwarded-For and Forwarded, and records the
+// original host and protocol. See RFC 7239 4 and 5
+func (p *ReverseProxy) setForwardingHeaders(headers Headers, r *Request) {
+	proto := "http"
+	if r.TLS != nil { proto = "https" }
+	host := r.Headers.Get("host")
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil { client = "unknown" }
+
+	headers.Add("X-Forwarded-For", client)
+	headers.Set("X-Forwarded-Host", host)
+	headers.Set("X-Forwarded-Proto", proto)
+
+	node := client
+	if strings.Contains(client, ":") { node = "\"[" + client + "]\"" }
+	element := "for=" + node + ";proto=" + proto
+	if host != "" { element += ";host=\"" + host + "\"" }
+	headers.Add("Forwarded", element)
+}
+
+// Returns the next available backend that was not tried yet, nil if there
+// is none
+func (p *ReverseProxy) pick(r *Request, tried map[*backend]bool) *backend {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	usable := func(b *backend) bool {
+		return !tried[b] && !b.unhealthy && !now.Before(b.ejected_until)
+	}
+
+	switch p.Policy {
+	case ConsistentHash:
+		if len(p.ring) == 0 { return nil }
+		key := ""
+		if p.HashKey != nil {
+			key = p.HashKey(r)
+		} else if r.ClientIP.IsValid() {
+			key = r.ClientIP.String()
+		}
+		hash := hashKey(key)
+		start, _ := slices.BinarySearchFunc(p.ring, hash, func(point ringPoint, hash uint64) int {
+			if point.hash < hash { return -1 }
+			if point.hash > hash { return 1 }
+			return 0
+		})
+		for i := range p.ring {
+			point := p.ring[(start + i) % len(p.ring)]
+			if usable(point.backend) { return point.backend }
+		}
+		return nil
+	case LeastConnections:
+		// Ties are broken round-robin
+		var best *backend
+		offset := int(p.next.Add(1))
+		for i := range p.backends {
+			b := p.backends[(offset + i) % len(p.backends)]
+			if usable(b) && (best == nil || b.active.Load() < best.active.Load()) { best = b }
+		}
+		return best
+	default:
+		offset := int(p.next.Add(1))
+		for i := range p.backends {
+			b := p.backends[(offset + i) % len(p.backends)]
+			if usable(b) { return b }
+		}
+		return nil
+	}
+}
+
+func (p *ReverseProxy) markFailed(b *backend) {
+	max_fails := p.MaxFails
+	if max_fails <= 0 { max_fails = 1 }
+	fail_timeout := p.FailTimeout
+	if fail_timeout <= 0 { fail_timeout = DefaultFailTimeout }
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.fails++
+	if b.fails >= max_fails {
+		b.fails = 0
+		b.ejected_until = time.Now().Add(fail_timeout)
+		p.logf("Backend %s ejected for %v", b.address, fail_timeout)
+	}
+}
+
+func (p *ReverseProxy) markOK(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.fails = 0
+}
+
+// Checks every backend each HealthCheckInterval until ctx is done. Returns
+// right away if HealthCheckPath is empty
+func (p *ReverseProxy) RunHealthChecks(ctx context.Context) {
+	if p.HealthCheckPath == "" { return }
+	interval := p.HealthCheckInterval
+	if interval <= 0 { interval = DefaultHealthCheckInterval }
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				healthy := p.check(ctx, b)
+				p.mu.Lock()
+				if b.unhealthy == healthy { p.logf("Backend %s healthy: %v", b.address, healthy) }
+				b.unhealthy = !healthy
+				p.mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *ReverseProxy) check(ctx context.Context, b *backend) bool {
+	dialer := net.Dialer{Timeout: p.timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", b.address)
+	if err != nil { return false }
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout()))
+
+	request := "GET " + p.HealthCheckPath + " HTTP/1.1\r\nHost: " + b.address + "\r\nConnection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil { return false }
+	resp, err := ResponseFromReader(conn, "GET")
+	return err == nil && resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func (p *ReverseProxy) timeout() time.Duration {
+	if p.Timeout > 0 { return p.Timeout }
+	return DefaultUpstreamTimeout
+}
+
+func (p *ReverseProxy) fail(w *ResponseWriter, code ResponseStatusCode, reason string) {
+	w.WriteStatusLine(code)
+	w.Headers.Set("Content-Type", "text/plain")
+	w.WriteHeaders(nil)
+	w.WriteBody([]byte(reason))
+}
+
+func (p *ReverseProxy) logf(format string, args ...any) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// FNV-1a with the MurmurHash3 finalizer. FNV alone barely changes the high
+// bits for keys that only differ at the end, e.g. IP addresses
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
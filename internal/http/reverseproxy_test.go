@@ -0,0 +1,269 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	nethttp "net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Answers every connection with a canned response and closes it
+func rawBackend(t *testing.T, response string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil { return }
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil || line == "\r\n" { break }
+				}
+				conn.Write([]byte(response))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func startProxy(t *testing.T, p *ReverseProxy) string {
+	p.ErrorLog = log.New(io.Discard, "", 0)
+	srv, err := ListenAndServe("127.0.0.1:0", p.Handle)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + srv.Listener.Addr().String()
+}
+
+func TestReverseProxy(t *testing.T) {
+	// Echoes what it got and answers with its name
+	backend := func(name string) string {
+		srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+			if r.Target.Path == "/health" && name == "sick" {
+				w.WriteStatusLine(StatusInternalServerError)
+				w.Headers.Set("Content-Type", "text/plain")
+				w.WriteHeaders(nil)
+				w.WriteBody([]byte("sick"))
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			w.WriteStatusLine(StatusOK)
+			w.Headers.Set("Content-Type", "text/plain")
+			w.Headers.Set("X-Backend", name)
+			w.Headers.Set("X-Target", r.StatusLine.Target)
+			w.Headers.Set("X-Host", r.Headers.Get("host"))
+			w.Headers.Set("X-Got-Forwarded-For", r.Headers.Get("x-forwarded-for"))
+			w.Headers.Set("X-Got-Forwarded-Host", r.Headers.Get("x-forwarded-host"))
+			w.Headers.Set("X-Got-Forwarded-Proto", r.Headers.Get("x-forwarded-proto"))
+			w.Headers.Set("X-Got-Forwarded", r.Headers.Get("forwarded"))
+			w.Headers.Set("X-Got-Hop", r.Headers.Get("x-hop"))
+			w.Headers.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(nil)
+			w.WriteTrailers(Headers{"x-checksum": "sum-" + r.Trailers.Get("x-checksum")})
+			w.WriteChunkedBody(data)
+			w.WriteChunkedBodyDone()
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { srv.Close() })
+		return srv.Listener.Addr().String()
+	}
+	dead := func() string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listener.Close()
+		return listener.Addr().String()
+	}
+
+	t.Run("Forwarding Headers", func(t *testing.T) {
+		address := backend("a")
+		proxy := startProxy(t, NewReverseProxy([]string{address}))
+		req, err := nethttp.NewRequest("GET", proxy + "/path?q=1", nil)
+		require.NoError(t, err)
+		req.Host = "example.com"
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("X-Forwarded-For", "203.0.113.1")
+		resp, err := nethttp.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "/path?q=1", resp.Header.Get("X-Target"))
+		assert.Equal(t, address, resp.Header.Get("X-Host"))
+		assert.Equal(t, "203.0.113.1, 127.0.0.1", resp.Header.Get("X-Got-Forwarded-For"))
+		assert.Equal(t, "example.com", resp.Header.Get("X-Got-Forwarded-Host"))
+		assert.Equal(t, "http", resp.Header.Get("X-Got-Forwarded-Proto"))
+		assert.Equal(t, "for=127.0.0.1;proto=http;host=\"example.com\"", resp.Header.Get("X-Got-Forwarded"))
+		assert.Empty(t, resp.Header.Get("X-Got-Hop"))
+
+		p := NewReverseProxy([]string{address})
+		p.PreserveHost = true
+		req.URL.Host = strings.TrimPrefix(startProxy(t, p), "http://")
+		resp, err = nethttp.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "example.com", resp.Header.Get("X-Host"))
+	})
+
+	t.Run("Chunked Body and Trailers", func(t *testing.T) {
+		proxy := startProxy(t, NewReverseProxy([]string{backend("a")}))
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("hello "))
+			pw.Write([]byte("world"))
+			pw.Close()
+		}()
+		req, err := nethttp.NewRequest("POST", proxy + "/upload", pr)
+		require.NoError(t, err)
+		req.Trailer = nethttp.Header{"X-Checksum": {"abc"}}
+		resp, err := nethttp.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(data))
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		assert.Equal(t, "sum-abc", resp.Trailer.Get("X-Checksum"))
+	})
+
+	t.Run("Status Passthrough", func(t *testing.T) {
+		teapot := rawBackend(t, "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 418 I'm a teapot\r\nContent-Length: 3\r\nKeep-Alive: timeout=5\r\n\r\ntea")
+		proxy := startProxy(t, NewReverseProxy([]string{teapot}))
+		resp, err := nethttp.Get(proxy + "/")
+		require.NoError(t, err)
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "418 I'm a teapot", resp.Status)
+		assert.Equal(t, "tea", string(data))
+		assert.Empty(t, resp.Header.Get("Keep-Alive"))
+
+		resp, err = nethttp.Head(proxy + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, int64(3), resp.ContentLength)
+
+		empty := rawBackend(t, "HTTP/1.1 204 No Content\r\nX-Test: 1\r\n\r\n")
+		resp, err = nethttp.Get(startProxy(t, NewReverseProxy([]string{empty})) + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 204, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("X-Test"))
+	})
+
+	t.Run("Close Delimited Body", func(t *testing.T) {
+		old := rawBackend(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end")
+		resp, err := nethttp.Get(startProxy(t, NewReverseProxy([]string{old})) + "/")
+		require.NoError(t, err)
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "until the end", string(data))
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	})
+
+	t.Run("Round Robin", func(t *testing.T) {
+		proxy := startProxy(t, NewReverseProxy([]string{backend("a"), backend("b")}))
+		counts := map[string]int{}
+		for range 4 {
+			resp, err := nethttp.Get(proxy + "/")
+			require.NoError(t, err)
+			resp.Body.Close()
+			counts[resp.Header.Get("X-Backend")]++
+		}
+		assert.Equal(t, map[string]int{"a": 2, "b": 2}, counts)
+	})
+
+	t.Run("Passive Ejection", func(t *testing.T) {
+		p := NewReverseProxy([]string{dead(), backend("a")})
+		proxy := startProxy(t, p)
+		for range 3 {
+			resp, err := nethttp.Get(proxy + "/")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, "a", resp.Header.Get("X-Backend"))
+		}
+		p.mu.Lock()
+		assert.True(t, p.backends[0].ejected_until.After(time.Now()))
+		p.mu.Unlock()
+
+		resp, err := nethttp.Get(startProxy(t, NewReverseProxy([]string{dead()})) + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 502, resp.StatusCode)
+	})
+
+	t.Run("Health Checks", func(t *testing.T) {
+		p := NewReverseProxy([]string{backend("sick"), backend("a")})
+		p.HealthCheckPath = "/health"
+		p.HealthCheckInterval = 10 * time.Millisecond
+		proxy := startProxy(t, p)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go p.RunHealthChecks(ctx)
+		assert.Eventually(t, func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return p.backends[0].unhealthy && !p.backends[1].unhealthy
+		}, time.Second, 10 * time.Millisecond)
+
+		for range 3 {
+			resp, err := nethttp.Get(proxy + "/")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, "a", resp.Header.Get("X-Backend"))
+		}
+	})
+}
+
+func TestReverseProxyBalancing(t *testing.T) {
+	addresses := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+
+	t.Run("Least Connections", func(t *testing.T) {
+		p := NewReverseProxy(addresses)
+		p.Policy = LeastConnections
+		p.backends[0].active.Store(3)
+		p.backends[1].active.Store(1)
+		p.backends[2].active.Store(2)
+		assert.Equal(t, p.backends[1], p.pick(&Request{}, nil))
+		assert.Equal(t, p.backends[2], p.pick(&Request{}, map[*backend]bool{p.backends[1]: true}))
+	})
+
+	t.Run("Consistent Hash", func(t *testing.T) {
+		p := NewReverseProxy(addresses)
+		p.Policy = ConsistentHash
+		request := func(ip string) *Request { return &Request{ClientIP: netip.MustParseAddr(ip)} }
+
+		picked := map[string]*backend{}
+		used := map[*backend]bool{}
+		for i := range 50 {
+			ip := "192.0.2." + strconv.Itoa(i + 1)
+			picked[ip] = p.pick(request(ip), nil)
+			used[picked[ip]] = true
+			assert.Equal(t, picked[ip], p.pick(request(ip), nil))
+		}
+		assert.Len(t, used, 3)
+
+		// Only keys of the ejected backend move
+		p.backends[0].ejected_until = time.Now().Add(time.Minute)
+		for ip, b := range picked {
+			if b == p.backends[0] {
+				assert.NotEqual(t, b, p.pick(request(ip), nil))
+			} else {
+				assert.Equal(t, b, p.pick(request(ip), nil))
+			}
+		}
+	})
+}
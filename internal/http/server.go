@@ -1,76 +1,403 @@
 package http
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
 	"net"
-	"strconv"
+	"net/netip"
+	"sync"
 	"sync/atomic"
 	"log"
 	"log/slog"
+	"math"
 	"os"
+	"strconv"
+	"time"
 )
 
 type Server struct {
 	Listener net.Listener
 	Handler Handler
 	ErrorLog *log.Logger
+	// Returns the base context for all requests. Defaults to
+	// context.Background()
+	BaseContext func(net.Listener) context.Context
+	// Modifies the context used for a new connection
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+	// Proxies whose X-Forwarded-For and Forwarded headers are trusted to
+	// find the client IP. Empty disables it
+	TrustedProxies []netip.Prefix
+	// Base configuration for ListenAndServeTLS
+	TLSConfig *tls.Config
+	// CA pool to verify client certificates against. See RequireClientCert
+	ClientCAs *x509.CertPool
+	// Connections handled at once, hijacked ones count until their handler
+	// returns. Connections over the limit wait for a free slot unless
+	// RejectOverLimit is set. 0 means no limit
+	MaxConns int
+	// Answer connections over MaxConns with 503 and close them instead of
+	// letting them wait
+	RejectOverLimit bool
+	// Sent as Retry-After with the 503 of RejectOverLimit, rounded up to
+	// seconds. Defaults to 1s
+	RetryAfter time.Duration
+	conn_slots chan struct{}
+	// Connections being answered with the 503 of RejectOverLimit
+	reject_slots chan struct{}
+	done chan struct{}
+	certs certStore
+	cert_poll_interval time.Duration
+	tls_handshake_errors atomic.Uint64
 	closed atomic.Bool
+	next_conn_id atomic.Uint64
+	mu sync.Mutex
+	// Connections that are not hijacked
+	conns map[*conn]struct{}
 }
 
 type Handler func(w ResponseWriter, req *Request)
 
+type contextKey struct {
+	name string
+}
+
+// Context keys to access values in a request context
+var (
+	ServerContextKey = &contextKey{"http-server"}
+	LocalAddrContextKey = &contextKey{"local-addr"}
+	RemoteAddrContextKey = &contextKey{"remote-addr"}
+)
+
 func ListenAndServe(address string, handler Handler) (*Server, error) {
 	if address == "" { address = ":http" }
+	srv, err := listen(address, handler)
+	if err != nil { return nil, err }
+    
+	go srv.Serve()
+	return srv, nil
+}
+
+func listen(address string, handler Handler) (*Server, error) {
 	ln, err := net.Listen("tcp", address)
 	if err != nil { return nil, err }
 
-	srv := &Server{
+	return &Server{
 		Listener: ln,
 		Handler: handler,
 		ErrorLog: slog.NewLogLogger(slog.NewJSONHandler(os.Stderr, nil), slog.LevelError),
-	}
-    
-	go srv.Serve()
-	return srv, nil
+	}, nil
 }
 
 func (s *Server) Serve() error {
+	base := context.Background()
+	if s.BaseContext != nil { base = s.BaseContext(s.Listener) }
+	base = context.WithValue(base, ServerContextKey, s)
+	if s.MaxConns > 0 { s.conn_slots = make(chan struct{}, s.MaxConns) }
+	if s.RejectOverLimit { s.reject_slots = make(chan struct{}, maxRejects) }
+
+	delay := time.Duration(0)
 	for {
-		conn, err := s.Listener.Accept()
+		rwc, err := s.Listener.Accept()
 		if s.closed.Load() {
+			if err == nil { rwc.Close() }
 			return nil // Graceful exit
 		}
+		if errors.Is(err, net.ErrClosed) { return err }
 		if err != nil {
-			s.ErrorLog.Printf("Error: %v", err)
+			// Errors like EMFILE go away once connections are closed, retrying
+			// right away would only spin
+			delay = min(max(2 * delay, minAcceptDelay), maxAcceptDelay)
+			s.logf("Accept error: %v, retrying in %v", err, delay)
+			time.Sleep(delay)
 			continue
 		}
-		go s.handle(conn)
+		delay = 0
+		if !s.acquireConnSlot(rwc) { continue }
+
+		ctx := context.WithValue(base, LocalAddrContextKey, rwc.LocalAddr())
+		ctx = context.WithValue(ctx, RemoteAddrContextKey, rwc.RemoteAddr())
+		if s.ConnContext != nil { ctx = s.ConnContext(ctx, rwc) }
+		c := newConn(s, rwc, ctx)
+		c.id = s.next_conn_id.Add(1)
+		s.trackConn(c, true)
+		go s.handle(c)
 	}
 }
 
-func (s *Server) Close() error {
+// Backoff between failed accepts
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// How long a connection over MaxConns gets to receive the 503
+const rejectTimeout = time.Second
+
+// How long a rejected connection is read after the 503 so closing it does
+// not reset it
+const rejectLingerTimeout = 100 * time.Millisecond
+
+// Connections answered with 503 at once. A flood beyond that is closed
+// without an answer instead of piling up goroutines
+const maxRejects = 16
+
+// Takes a slot for rwc if MaxConns is set. Reports false if rwc was
+// rejected or the server closed while waiting
+func (s *Server) acquireConnSlot(rwc net.Conn) bool {
+	if s.conn_slots == nil { return true }
+	select {
+	case s.conn_slots <- struct{}{}:
+		return true
+	default:
+	}
+	if s.RejectOverLimit {
+		select {
+		case s.reject_slots <- struct{}{}:
+			go s.reject(rwc)
+		default:
+			rwc.Close()
+		}
+		return false
+	}
+
+	select {
+	case s.conn_slots <- struct{}{}:
+		return true
+	case <-s.doneChan():
+		rwc.Close()
+		return false
+	}
+}
+
+func (s *Server) releaseConnSlot() {
+	if s.conn_slots != nil { <-s.conn_slots }
+}
+
+// Answers a connection over MaxConns without reading a request. See RFC
+// 9110 15.6.4 and 10.2.3. Closing with the request unread would reset the
+// connection and could lose the 503, so the write side is closed first and
+// at most a request head is read. The linger is shorter and smaller than
+// the one of conn.close, so a flood can not hold the slots
+func (s *Server) reject(rwc net.Conn) {
+	defer func() { <-s.reject_slots }()
+	defer rwc.Close()
+	rwc.SetDeadline(time.Now().Add(rejectTimeout))
+
+	retry_after := s.RetryAfter
+	if retry_after <= 0 { retry_after = time.Second }
+	w := NewResponseWriter(rwc)
+	w.WriteStatusLine(StatusServiceUnavailable)
+	w.WriteHeaders(Headers{
+		"Content-Type": "text/plain",
+		"Retry-After": strconv.Itoa(int(math.Ceil(retry_after.Seconds()))),
+	})
+	if _, err := w.WriteBody([]byte("Too many connections")); err != nil {
+		s.logf("Error rejecting connection from %s: %v", rwc.RemoteAddr(), err)
+		return
+	}
+
+	type closeWriter interface { CloseWrite() error }
+	if cw, ok := rwc.(closeWriter); ok && cw.CloseWrite() == nil {
+		rwc.SetReadDeadline(time.Now().Add(rejectLingerTimeout))
+		io.Copy(io.Discard, io.LimitReader(rwc, maxHeadSize))
+	}
+}
+
+// Closed once the server is closed or shut down
+func (s *Server) doneChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil { s.done = make(chan struct{}) }
+	return s.done
+}
+
+func (s *Server) markClosed() {
 	s.closed.Store(true)
-	return s.Listener.Close()
+	done := s.doneChan()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-done:
+	default:
+		close(done)
+	}
+}
+
+// Closes the listener and all active connections. Hijacked connections are
+// left alone
+func (s *Server) Close() error {
+	s.markClosed()
+	err := s.Listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.cancel()
+		c.rwc.Close()
+	}
+	return err
+}
+
+// Closes the listener, cancels the context of running requests and waits
+// for active connections to finish. Hijacked connections are not waited for
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.markClosed()
+	err := s.Listener.Close()
+
+	s.mu.Lock()
+	for c := range s.conns { c.cancel() }
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		// Connections waiting for another request are not coming back
+		for c := range s.conns {
+			if c.idle.Load() { c.rwc.Close() }
+		}
+		active := len(s.conns)
+		s.mu.Unlock()
+		if active == 0 { return err }
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil { s.conns = map[*conn]struct{}{} }
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+func (s *Server) handle(c *conn) {
+	defer s.releaseConnSlot()
+	defer func() {
+		c.cancel()
+		// A hijacked connection belongs to the handler now
+		if c.hijacked.Load() { return }
+		c.close()
+		s.trackConn(c, false)
+	}()
+	if !s.handshake(c) { return }
+
+	// HTTP/2 negotiated with ALPN or with prior knowledge. Either way the
+	// client starts with the preface. See RFC 9113 3.2 and 3.3
+	if c.r.readH2Preface() {
+		s.serveH2(c, nil, nil, nil)
+		return
+	}
+	if c.negotiatedProtocol() == "h2" { return }
+
+	// Closing the body must not close the connection
+	c.rr = newRequestReader(io.NopCloser(c.r))
+	c.bw = writerPool.Get().(*bufio.Writer)
+	c.bw.Reset(c.rwc)
+	defer func() {
+		// A hijacking handler may still read the body
+		if c.hijacked.Load() { return }
+		c.rr.release()
+		c.bw.Reset(nil)
+		writerPool.Put(c.bw)
+	}()
+	for s.serveRequest(c) {}
+}
+
+// Serves a single HTTP/1.x request. Reports if the connection can be used
+// for the next one
+func (s *Server) serveRequest(c *conn) bool {
 	w := ResponseWriter{
 		Headers: Headers{},
-		writer: conn,
+		writer: c.bw,
 		state: writingStatusLine,
+		conn: c,
 	}
 
-	r, err := RequestFromReader(conn)
+	c.idle.Store(true)
+	r := &Request{}
+	err := c.rr.readInto(r)
+	c.idle.Store(false)
+	if errors.Is(err, io.EOF) { return false }
 	if err != nil {
-		w.WriteStatusLine(StatusBadRequest)
+		status := StatusBadRequest
+		if errors.Is(err, errVersionNotSupported) { status = StatusHTTPVersionNotSupported }
+		if errors.Is(err, errNotImplemented) { status = StatusNotImplemented }
+		if errors.Is(err, errHeadTooLarge) { status = StatusRequestHeaderFieldsTooLarge }
+		w.WriteStatusLine(status)
 		w.WriteHeaders(Headers{
 			"Connection": "close",
 			"Content-Type": "text/plain", // TODO: Add possibility to set content type
-			"Content-Length": strconv.Itoa(len([]byte(err.Error()))),
 		})
 		w.WriteBody([]byte(err.Error()))
-		return 
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	r.ctx = ctx
+	s.initRequest(c, r)
+	c.body, _ = r.Body.(*body)
+	w.proto = r.Proto
+	w.head = r.StatusLine.Method == "HEAD"
+	c.keep_alive = wantsKeepAlive(r) && !s.closed.Load()
+	c.response_done = false
+
+	if settings, ok := h2cUpgradeSettings(c, r); ok {
+		s.upgradeH2C(c, r, settings)
+		return false
+	}
+
+	// Watch for the client hanging up once the body is read
+	if c.body == nil || c.body.done() {
+		c.r.startBackgroundRead()
+	} else {
+		c.body.on_eof = c.r.startBackgroundRead
 	}
 
 	s.Handler(w, r)
+	// Sends what an unfinished response left in the buffer
+	if !c.hijacked.Load() { c.bw.Flush() }
+
+	if c.hijacked.Load() || !c.keep_alive || !c.response_done || s.closed.Load() { return false }
+	return c.finishRequest()
+}
+
+// See RFC 9112 9.3
+func wantsKeepAlive(r *Request) bool {
+	connection := r.Headers.Get("connection")
+	if r.Proto == "HTTP/1.0" { return HeaderHasToken(connection, "keep-alive") }
+	return !HeaderHasToken(connection, "close")
+}
+
+// Sets the connection details of a request
+func (s *Server) initRequest(c *conn, r *Request) {
+	r.RemoteAddr = c.rwc.RemoteAddr().String()
+	r.LocalAddr = c.rwc.LocalAddr().String()
+	r.ConnID = c.id
+	r.ClientIP = s.clientIP(r)
+	if tls_conn, ok := c.rwc.(*tls.Conn); ok {
+		state := tls_conn.ConnectionState()
+		r.TLS = &state
+	}
 }
@@ -0,0 +1,375 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	hijacked := make(chan net.Conn, 1)
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		conn, brw, err := w.Hijack()
+		if err != nil { return }
+		// Bytes sent right after the request are still readable
+		data := make([]byte, 5)
+		io.ReadFull(brw, data)
+		brw.WriteString("hijacked " + string(data))
+		brw.Flush()
+		hijacked <- conn
+
+		// The response writer can not be used anymore
+		assert.Error(t, w.WriteStatusLine(StatusOK))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\nextra"))
+	require.NoError(t, err)
+
+	server_conn := <-hijacked
+	buf := make([]byte, 14)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hijacked extra", string(buf))
+
+	// Hijacked connections are neither tracked nor closed by the server
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	_, err = server_conn.Write([]byte("still open"))
+	require.NoError(t, err)
+	server_conn.Close()
+}
+
+func TestRequestContext(t *testing.T) {
+	type key string
+	values := make(chan []any, 1)
+	cancelled := make(chan error, 1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &Server{
+		Listener: ln,
+		ErrorLog: log.New(io.Discard, "", 0),
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), key("base"), "base value")
+		},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, key("conn"), "conn value")
+		},
+		Handler: func(w ResponseWriter, r *Request) {
+			io.ReadAll(r.Body)
+			ctx := r.Context()
+			values <- []any{
+				ctx.Value(key("base")),
+				ctx.Value(key("conn")),
+				ctx.Value(ServerContextKey),
+				ctx.Value(LocalAddrContextKey),
+				r.RemoteAddr,
+				r.LocalAddr,
+				r.ConnID,
+				r.ClientIP.String(),
+			}
+			select {
+			case <-ctx.Done():
+				cancelled <- ctx.Err()
+			case <-time.After(5 * time.Second):
+				cancelled <- nil
+			}
+		},
+	}
+	go srv.Serve()
+	defer srv.Close()
+
+	// Test: Values from the hooks and the server
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	v := <-values
+	assert.Equal(t, "base value", v[0])
+	assert.Equal(t, "conn value", v[1])
+	assert.Equal(t, srv, v[2])
+	assert.Equal(t, ln.Addr().String(), v[3].(net.Addr).String())
+	assert.Equal(t, conn.LocalAddr().String(), v[4])
+	assert.Equal(t, ln.Addr().String(), v[5])
+	assert.Equal(t, uint64(1), v[6])
+	assert.Equal(t, "127.0.0.1", v[7])
+
+	// Test: Client hanging up cancels the context
+	conn.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+	// Test: Request with a body is only watched after the body was read
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	v = <-values
+	assert.Equal(t, uint64(2), v[6])
+	conn.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+	// Test: Shutdown cancels running requests
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-values
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		w.WriteStatusLine(StatusOK)
+		if r.StatusLine.Target == "/chunked" {
+			w.WriteHeaders(Headers{"Content-Type": "text/plain", "Transfer-Encoding": "chunked"})
+			w.WriteChunkedBody([]byte("hello "))
+			w.WriteChunkedBody([]byte("world"))
+			w.WriteChunkedBodyDone()
+			return
+		}
+		// The body is left unread on purpose
+		w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+		w.WriteBody([]byte(r.StatusLine.Target + " " + strconv.FormatUint(r.ConnID, 10)))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	// Sends the raw requests and reads the responses until the connection closes
+	roundTrip := func(requests string) []string {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Write([]byte(requests))
+		require.NoError(t, err)
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return strings.SplitAfter(string(data), "\r\n\r\n")
+	}
+
+	// Test: Pipelined HTTP/1.1 requests share the connection
+	resp := roundTrip("POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /b HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.Len(t, resp, 4)
+	assert.NotContains(t, resp[0], "connection")
+	assert.True(t, strings.HasPrefix(resp[1], "/a "))
+	id := strings.TrimPrefix(resp[1][:strings.Index(resp[1], "HTTP/1.1")], "/a ")
+	assert.True(t, strings.HasPrefix(resp[2], "/b " + id + "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp[2], "connection: close\r\n")
+	assert.Equal(t, "/c " + id, resp[3])
+
+	// Test: HTTP/1.0 closes the connection by default
+	resp = roundTrip("GET /a HTTP/1.0\r\n\r\nGET /b HTTP/1.0\r\n\r\n")
+	require.Len(t, resp, 2)
+	assert.True(t, strings.HasPrefix(resp[0], "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, resp[0], "connection: close\r\n")
+	assert.True(t, strings.HasPrefix(resp[1], "/a "))
+
+	// Test: HTTP/1.0 keep-alive is opt-in
+	resp = roundTrip("GET /a HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /b HTTP/1.0\r\n\r\n")
+	require.Len(t, resp, 3)
+	assert.Contains(t, resp[0], "connection: keep-alive\r\n")
+	assert.True(t, strings.HasPrefix(resp[2], "/b "))
+
+	// Test: HTTP/1.0 gets a close-delimited body instead of chunks
+	resp = roundTrip("GET /chunked HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /b HTTP/1.0\r\n\r\n")
+	require.Len(t, resp, 2)
+	assert.NotContains(t, resp[0], "transfer-encoding")
+	assert.Contains(t, resp[0], "connection: close\r\n")
+	assert.Equal(t, "hello world", resp[1])
+
+	// Test: Unsupported versions
+	resp = roundTrip("GET / HTTP/2.0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp[0], "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+
+	// Test: Heads over the limit
+	resp = roundTrip("GET / HTTP/1.1\r\nHost: localhost\r\n" + strings.Repeat("X-Field: value\r\n", maxHeadSize / 8) + "\r\n")
+	assert.True(t, strings.HasPrefix(resp[0], "HTTP/1.1 431 Request Header Fields Too Large\r\n"))
+
+	// Test: Idle connections are closed on shutdown
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	reply := make([]byte, 1024)
+	_, err = conn.Read(reply)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+}
+
+func TestMaxConns(t *testing.T) {
+	serve := func(srv *Server) (string, chan struct{}) {
+		entered, release := make(chan struct{}), make(chan struct{})
+		srv.Handler = func(w ResponseWriter, r *Request) {
+			if r.StatusLine.Target == "/block" {
+				entered <- struct{}{}
+				<-release
+			}
+			w.WriteStatusLine(StatusOK)
+			w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+			w.WriteBody([]byte("ok"))
+		}
+		go srv.Serve()
+		t.Cleanup(func() { srv.Close() })
+		addr := srv.Listener.Addr().String()
+
+		// Takes the only slot until release is closed
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte("GET /block HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		<-entered
+		return addr, release
+	}
+
+	// Test: Connections over the limit wait for a free slot
+	srv, err := listen("127.0.0.1:0", nil)
+	require.NoError(t, err)
+	srv.MaxConns = 1
+	addr, release := serve(srv)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	close(release)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Close stops waiting for a slot
+	srv, err = listen("127.0.0.1:0", nil)
+	require.NoError(t, err)
+	srv.MaxConns = 1
+	addr, release = serve(srv)
+	defer close(release)
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	srv.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _ := conn.Read(make([]byte, 1))
+	assert.Zero(t, n)
+
+	// Test: Connections over the limit are rejected with 503
+	srv, err = listen("127.0.0.1:0", nil)
+	require.NoError(t, err)
+	srv.MaxConns = 1
+	srv.RejectOverLimit = true
+	srv.RetryAfter = 1500 * time.Millisecond
+	addr, release = serve(srv)
+	defer close(release)
+	// The request is not read, but it does not make the close reset the
+	// connection before the 503 arrives
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8192\r\n\r\n" + strings.Repeat("x", 8192)))
+	resp, err := ResponseFromReader(io.NopCloser(conn), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "2", resp.Headers.Get("retry-after"))
+	assert.Equal(t, "close", resp.Headers.Get("connection"))
+	data, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Too many connections", string(data))
+	// The server closed gracefully instead of resetting the connection
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Connections beyond the running rejects are closed without an answer
+	for range cap(srv.reject_slots) { srv.reject_slots <- struct{}{} }
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _ = conn.Read(make([]byte, 1))
+	assert.Zero(t, n)
+}
+
+// Fails every accept with err
+type failingListener struct {
+	net.Listener
+	err error
+	accepts int
+}
+
+func (fl *failingListener) Accept() (net.Conn, error) {
+	fl.accepts++
+	if fl.accepts > 5 { return nil, net.ErrClosed }
+	return nil, fl.err
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	ln := &failingListener{err: errors.New("too many open files")}
+	srv := &Server{Listener: ln, ErrorLog: log.New(io.Discard, "", 0)}
+	start := time.Now()
+	err := srv.Serve()
+	require.ErrorIs(t, err, net.ErrClosed)
+	assert.Equal(t, 6, ln.accepts)
+	// 5 + 10 + 20 + 40 + 80ms
+	assert.GreaterOrEqual(t, time.Since(start), 155 * time.Millisecond)
+}
+
+// Sends GETs one after another on a single connection
+func BenchmarkServerKeepAlive(b *testing.B) {
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+		w.WriteBody([]byte("ok"))
+	})
+	if err != nil { b.Fatal(err) }
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil { b.Fatal(err) }
+	defer conn.Close()
+
+	// Every response has the same length, the Date header has a fixed width
+	request := []byte(benchmarkGET)
+	conn.Write(request)
+	resp, err := ResponseFromReader(io.NopCloser(conn), "GET")
+	if err != nil { b.Fatal(err) }
+	io.ReadAll(resp.Body)
+	buf := make([]byte, 4096)
+	n, resp_len := 0, 0
+	conn.Write(request)
+	for resp_len == 0 || n < resp_len {
+		m, err := conn.Read(buf[n:])
+		if err != nil { b.Fatal(err) }
+		n += m
+		if i := strings.Index(string(buf[:n]), "\r\n\r\nok"); i != -1 { resp_len = i + 6 }
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := conn.Write(request); err != nil { b.Fatal(err) }
+		if _, err := io.ReadFull(conn, buf[:resp_len]); err != nil { b.Fatal(err) }
+	}
+}
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single Server-Sent Event. Empty fields are not sent.
+// See https://html.spec.whatwg.org/multipage/server-sent-events.html
+type Event struct {
+	ID string
+	Event string
+	Retry time.Duration
+	Data string
+}
+
+func (e Event) marshal() ([]byte, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return nil, fmt.Errorf("Event id must not contain newlines or NUL")
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return nil, fmt.Errorf("Event name must not contain newlines")
+	}
+
+	frame := ""
+	if e.ID != "" { frame += "id: " + e.ID + "\n" }
+	if e.Event != "" { frame += "event: " + e.Event + "\n" }
+	if e.Retry > 0 { frame += "retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n" }
+	// Every line of data needs its own field, any line ending counts
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		frame += "data: " + line + "\n"
+	}
+	return []byte(frame + "\n"), nil
+}
+
+// Streams Server-Sent Events over a chunked response. Every event is
+// written as its own chunk so it reaches the client right away
+type EventStream struct {
+	// Value of the Last-Event-ID header sent by a reconnecting client
+	LastEventID string
+	w *ResponseWriter
+	mu sync.Mutex
+	done chan struct{}
+	close_once sync.Once
+}
+
+// Starts a text/event-stream response. A comment is sent every heartbeat
+// interval to keep proxies from closing the idle connection, zero disables
+// it. The stream must be closed before the handler returns
+func NewEventStream(w *ResponseWriter, r *Request, heartbeat time.Duration) (*EventStream, error) {
+	s := &EventStream{
+		LastEventID: r.Headers.Get("last-event-id"),
+		w: w,
+		done: make(chan struct{}),
+	}
+
+	if err := w.WriteStatusLine(StatusOK); err != nil { return nil, err }
+	w.Headers.Set("Content-Type", "text/event-stream")
+	w.Headers.Set("Cache-Control", "no-cache")
+	w.Headers.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteHeaders(nil); err != nil { return nil, err }
+	// Flush headers so the client knows the stream is open
+	if _, err := w.WriteChunkedBody(nil); err != nil { return nil, err }
+	if err := w.Flush(); err != nil { return nil, err }
+
+	go s.watchContext(r.Context())
+	if heartbeat > 0 { go s.heartbeat(heartbeat) }
+	return s, nil
+}
+
+// Closed when the client went away, the request context was cancelled or
+// the stream was closed
+func (s *EventStream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *EventStream) Send(e Event) error {
+	frame, err := e.marshal()
+	if err != nil { return err }
+	return s.write(frame)
+}
+
+// Ends the stream. Does not close the connection
+func (s *EventStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	s.close_once.Do(func() { close(s.done) })
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
+
+func (s *EventStream) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return fmt.Errorf("Event stream is closed")
+	default:
+	}
+
+	_, err := s.w.WriteChunkedBody(data)
+	if err == nil { err = s.w.Flush() }
+	if err != nil { s.close_once.Do(func() { close(s.done) }) }
+	return err
+}
+
+func (s *EventStream) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			// Lines starting with a colon are comments
+			if err := s.write([]byte(": heartbeat\n\n")); err != nil { return }
+		}
+	}
+}
+
+func (s *EventStream) watchContext(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.close_once.Do(func() { close(s.done) })
+	case <-s.done:
+	}
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventMarshal(t *testing.T) {
+	// Test: All fields
+	frame, err := Event{ID: "1", Event: "update", Retry: 3 * time.Second, Data: "hello"}.marshal()
+	require.NoError(t, err)
+	assert.Equal(t, "id: 1\nevent: update\nretry: 3000\ndata: hello\n\n", string(frame))
+
+	// Test: Multi-line data
+	frame, err = Event{Data: "line 1\nline 2\r\nline 3\rline 4"}.marshal()
+	require.NoError(t, err)
+	assert.Equal(t, "data: line 1\ndata: line 2\ndata: line 3\ndata: line 4\n\n", string(frame))
+
+	// Test: Newline in id
+	_, err = Event{ID: "1\n2", Data: "hello"}.marshal()
+	require.Error(t, err)
+}
+
+func TestEventStream(t *testing.T) {
+	last_event_id := make(chan string, 1)
+	disconnected := make(chan bool, 1)
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		stream, err := NewEventStream(&w, r, 10*time.Millisecond)
+		if err != nil { return }
+		defer stream.Close()
+		last_event_id <- stream.LastEventID
+
+		stream.Send(Event{ID: "42", Data: "first\nsecond"})
+		select {
+		case <-stream.Done():
+			disconnected <- true
+		case <-time.After(5 * time.Second):
+			disconnected <- false
+		}
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 41\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "41", <-last_event_id)
+
+	br := bufio.NewReader(conn)
+	response := ""
+	for !strings.Contains(response, ": heartbeat\n\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		response += line
+	}
+	assert.True(t, strings.HasPrefix(response, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, response, "content-type: text/event-stream\r\n")
+	assert.Contains(t, response, "id: 42\ndata: first\ndata: second\n\n")
+
+	// Test: Client going away ends the stream
+	conn.Close()
+	assert.True(t, <-disconnected)
+}
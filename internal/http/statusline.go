@@ -2,10 +2,16 @@ package http
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 )
 
+var (
+	errVersionNotSupported = errors.New("HTTP version not supported")
+	errNotImplemented = errors.New("Not implemented")
+)
+
 type StatusLine struct {
 	Method        string
 	Target        string
@@ -13,28 +19,45 @@ type StatusLine struct {
 }
 
 func (sl *StatusLine) parse(data []byte) (int, error) {
+	return sl.parseWith(data, nil)
+}
+
+// Parses the request-line like parse, strings are taken from strs when it
+// has them
+func (sl *StatusLine) parseWith(data []byte, strs *stringTable) (int, error) {
 	idx := bytes.Index(data, []byte("\r\n"))
 	if idx == -1 { return 0, nil }
 
-	// parts[0] = method, parts[1] = request-target, parts[2] = HTTP version
-	parts := strings.Split(string(data[:idx]), " ")
-	if len(parts) != 3 {
+	// method SP request-target SP HTTP-version
+	method, rest, _ := bytes.Cut(data[:idx], []byte(" "))
+	target, version, ok := bytes.Cut(rest, []byte(" "))
+	if !ok || bytes.IndexByte(version, ' ') != -1 {
 		return 0, fmt.Errorf("Status line must only have 3 space-separated parts")
 	}
 
-	if !isUpper(parts[0]) {
+	if !isUpper(method) {
 		return 0, fmt.Errorf("Request-method must only contain uppercase letters")
 	}
-	if !strings.HasPrefix(parts[1], "/") {
-		return 0, fmt.Errorf("Request-target must start with a slash")
+	// See RFC 9110 9.1
+	if len(method) == 0 || !isValidHeaderName(method) {
+		return 0, fmt.Errorf("Request-method must be a token: '%s'", method)
 	}
-	if parts[2] != "HTTP/1.1" {
-		return 0, fmt.Errorf("HTTP version must be HTTP/1.1")
+	// HTTP/2 and later do not use a text request line. A higher 1.x minor
+	// version is served as HTTP/1.1, see Request.Proto. See RFC 9112 2.3
+	if !isHTTPVersion(string(version)) || version[5] != '1' {
+		return 0, fmt.Errorf("%w: '%s'", errVersionNotSupported, version)
 	}
 
-	sl.Method = parts[0]
-	sl.Target = parts[1]
-	sl.Version = parts[2]
+	sl.Method = strs.str(method)
+	sl.Target = strs.str(target)
+	sl.Version = strs.str(version)
 
 	return idx + 2, nil
 }
+
+// Reports if s is "HTTP/" DIGIT "." DIGIT, the name is case-sensitive.
+// See RFC 9112 2.3
+func isHTTPVersion(s string) bool {
+	return len(s) == 8 && strings.HasPrefix(s, "HTTP/") && s[6] == '.' &&
+		s[5] >= '0' && s[5] <= '9' && s[7] >= '0' && s[7] <= '9'
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+type TargetForm int
+const (
+	// "/path?query", the usual form
+	OriginForm TargetForm = iota
+	// "http://host/path?query", used for requests to proxies
+	AbsoluteForm
+	// "host:port", only for CONNECT
+	AuthorityForm
+	// "*", only for OPTIONS
+	AsteriskForm
+)
+
+// Parsed request-target. See RFC 9112 3.2
+type RequestTarget struct {
+	Form TargetForm
+	// Only set for absolute-form, in lower case
+	Scheme string
+	// Host with optional port. Only set for absolute-form and authority-form
+	Authority string
+	// Path without query. Empty for authority-form and "*" for asterisk-form
+	Path string
+	RawQuery string
+}
+
+func parseRequestTarget(method string, target string) (RequestTarget, error) {
+	for _, c := range []byte(target) {
+		if c <= ' ' || c == 0x7f {
+			return RequestTarget{}, fmt.Errorf("Invalid character in request-target: '%s'", target)
+		}
+	}
+
+	switch {
+	case method == "CONNECT":
+		// See RFC 9112 3.2.3
+		if !isValidAuthority(target, true) {
+			return RequestTarget{}, fmt.Errorf("CONNECT needs a host and port as request-target: '%s'", target)
+		}
+		return RequestTarget{Form: AuthorityForm, Authority: target}, nil
+	case target == "*":
+		// See RFC 9112 3.2.4
+		if method != "OPTIONS" {
+			return RequestTarget{}, fmt.Errorf("Asterisk-form request-target is only allowed for OPTIONS")
+		}
+		return RequestTarget{Form: AsteriskForm, Path: "*"}, nil
+	case strings.HasPrefix(target, "/"):
+		// See RFC 9112 3.2.1
+		path, query, _ := strings.Cut(target, "?")
+		return RequestTarget{Form: OriginForm, Path: path, RawQuery: query}, nil
+	}
+
+	// See RFC 9112 3.2.2
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isValidScheme(scheme) {
+		return RequestTarget{}, fmt.Errorf("Invalid request-target: '%s'", target)
+	}
+	authority, path := rest, ""
+	if idx := strings.IndexAny(rest, "/?#"); idx != -1 { authority, path = rest[:idx], rest[idx:] }
+	// Fragments are never sent. See RFC 9110 4.2.5
+	if strings.Contains(path, "#") || !isValidAuthority(authority, false) {
+		return RequestTarget{}, fmt.Errorf("Invalid request-target: '%s'", target)
+	}
+	path, query, _ := strings.Cut(path, "?")
+	if path == "" { path = "/" }
+	return RequestTarget{
+		Form: AbsoluteForm,
+		Scheme: strings.ToLower(scheme),
+		Authority: authority,
+		Path: path,
+		RawQuery: query,
+	}, nil
+}
+
+// The Host header must be sent exactly once with HTTP/1.1 and later. The target of
+// an absolute-form request replaces it. See RFC 9112 3.2 and 3.2.2
+func (r *Request) resolveHost() error {
+	host := r.Headers.Get("host")
+	if host == "" && r.StatusLine.Version != "HTTP/1.0" { return fmt.Errorf("Missing Host header") }
+	if r.Target.Form == AbsoluteForm {
+		r.Headers.Set("Host", r.Target.Authority)
+		return nil
+	}
+	if host != "" && !isValidAuthority(host, false) { return fmt.Errorf("Invalid Host header: '%s'", host) }
+	return nil
+}
+
+// See RFC 3986 3.1
+func isValidScheme(s string) bool {
+	if s == "" { return false }
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Checks a host with optional port. User info is not allowed. See RFC 9110 4.2
+func isValidAuthority(s string, require_port bool) bool {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end == -1 { return false }
+		addr, err := netip.ParseAddr(s[1:end])
+		if err != nil || !addr.Is6() { return false }
+		host, port = "", s[end+1:]
+		if port != "" {
+			if port[0] != ':' { return false }
+			port = port[1:]
+		} else if require_port {
+			return false
+		}
+	} else {
+		idx := strings.LastIndex(s, ":")
+		if idx != -1 { host, port = s[:idx], s[idx+1:] }
+		if host == "" || (require_port && idx == -1) { return false }
+	}
+
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-._~%!$&'()*+,;=", r):
+		default:
+			return false
+		}
+	}
+	if len(port) > 5 || (require_port && port == "") { return false }
+	for _, r := range port {
+		if r < '0' || r > '9' { return false }
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestTarget(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want RequestTarget
+	}{
+		{"GET", "/search?q=go", RequestTarget{Form: OriginForm, Path: "/search", RawQuery: "q=go"}},
+		{"GET", "HTTP://example.com:8080/a?b", RequestTarget{Form: AbsoluteForm, Scheme: "http", Authority: "example.com:8080", Path: "/a", RawQuery: "b"}},
+		{"GET", "http://example.com", RequestTarget{Form: AbsoluteForm, Scheme: "http", Authority: "example.com", Path: "/"}},
+		{"CONNECT", "example.com:443", RequestTarget{Form: AuthorityForm, Authority: "example.com:443"}},
+		{"CONNECT", "[::1]:443", RequestTarget{Form: AuthorityForm, Authority: "[::1]:443"}},
+		{"OPTIONS", "*", RequestTarget{Form: AsteriskForm, Path: "*"}},
+	}
+	for _, tt := range tests {
+		got, err := parseRequestTarget(tt.method, tt.target)
+		require.NoError(t, err, tt.target)
+		assert.Equal(t, tt.want, got, tt.target)
+	}
+
+	invalid := []struct {
+		method string
+		target string
+	}{
+		{"GET", "*"},
+		{"GET", "example.com:443"},
+		{"CONNECT", "/"},
+		{"CONNECT", "example.com"},
+		{"CONNECT", "http://example.com:443"},
+		{"GET", "http://user@example.com/"},
+		{"GET", "http:///path"},
+		{"GET", "http://example.com/#fragment"},
+		{"GET", "1http://example.com/"},
+		{"GET", "/\x7f"},
+	}
+	for _, tt := range invalid {
+		_, err := parseRequestTarget(tt.method, tt.target)
+		assert.Error(t, err, tt.target)
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	parse := func(data string) (*Request, error) {
+		return RequestFromReader(&chunkReader{data: data, numBytesPerRead: 7})
+	}
+
+	// Test: Absolute-form overrides Host
+	r, err := parse("GET http://example.com/a HTTP/1.1\r\nHost: other.com\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", r.Headers.Get("host"))
+	assert.Equal(t, "/a", r.Target.Path)
+
+	// Test: Authority-form
+	r, err = parse("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.Target.Form)
+
+	// Test: Missing Host
+	_, err = parse("GET / HTTP/1.1\r\nAccept: */*\r\n\r\n")
+	assert.ErrorContains(t, err, "Missing Host")
+
+	// Test: Multiple Host headers
+	_, err = parse("GET / HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n")
+	assert.ErrorContains(t, err, "Multiple Host")
+	_, err = parse("GET / HTTP/1.1\r\nHost: a.com\r\nHost: a.com\r\n\r\n")
+	assert.ErrorContains(t, err, "Multiple Host")
+
+	// Test: Invalid Host
+	_, err = parse("GET / HTTP/1.1\r\nHost: a.com/path\r\n\r\n")
+	assert.ErrorContains(t, err, "Invalid Host")
+}
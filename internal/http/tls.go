@@ -0,0 +1,218 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often certificate files are checked for changes
+const certPollInterval = time.Second
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+func ListenAndServeTLS(address string, certFile string, keyFile string, handler Handler) (*Server, error) {
+	if address == "" { address = ":https" }
+	srv, err := listen(address, handler)
+	if err != nil { return nil, err }
+	if err := srv.listenTLS(certFile, keyFile); err != nil {
+		srv.Listener.Close()
+		return nil, err
+	}
+
+	go srv.Serve()
+	return srv, nil
+}
+
+// Like Serve but wraps the listener in TLS first. certFile and keyFile may
+// be empty if TLSConfig or AddCertificate provide the certificates
+func (s *Server) ServeTLS(certFile string, keyFile string) error {
+	if err := s.listenTLS(certFile, keyFile); err != nil { return err }
+	return s.Serve()
+}
+
+// Adds a certificate that is picked by SNI. The files are reloaded when
+// they change or on SIGHUP
+func (s *Server) AddCertificate(certFile string, keyFile string) error {
+	return s.certs.add(certFile, keyFile)
+}
+
+// Loads all certificates from disk again. Certificates that fail to load
+// are kept as they are
+func (s *Server) ReloadCertificates() error {
+	return s.certs.reload(true)
+}
+
+// Number of failed TLS handshakes
+func (s *Server) TLSHandshakeErrors() uint64 {
+	return s.tls_handshake_errors.Load()
+}
+
+// Wraps the listener in TLS. TLSConfig is used as the base configuration.
+// Certificates from files are only used if it does not have any
+func (s *Server) listenTLS(certFile string, keyFile string) error {
+	config := &tls.Config{}
+	if s.TLSConfig != nil { config = s.TLSConfig.Clone() }
+
+	if certFile != "" || keyFile != "" {
+		if err := s.certs.add(certFile, keyFile); err != nil { return err }
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		if s.certs.empty() { return errors.New("No TLS certificate configured") }
+		config.GetCertificate = s.certs.getCertificate
+	}
+
+	// Offer HTTP/2 first, handle picks the engine for the negotiated protocol
+	if len(config.NextProtos) == 0 { config.NextProtos = []string{"h2", "http/1.1"} }
+
+	// Client certificates are verified if given. Whether one is needed is
+	// up to RequireClientCert or the handler
+	if s.ClientCAs != nil {
+		config.ClientCAs = s.ClientCAs
+		if config.ClientAuth == tls.NoClientCert { config.ClientAuth = tls.VerifyClientCertIfGiven }
+	}
+
+	s.Listener = tls.NewListener(s.Listener, config)
+	go s.watchCertificates()
+	return nil
+}
+
+// Reloads certificates on SIGHUP or when the files change
+func (s *Server) watchCertificates() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	interval := s.cert_poll_interval
+	if interval == 0 { interval = certPollInterval }
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for !s.closed.Load() {
+		select {
+		case <-sighup:
+			if err := s.certs.reload(true); err != nil {
+				s.logf("Error reloading TLS certificates: %v", err)
+			}
+		case <-ticker.C:
+			if err := s.certs.reload(false); err != nil {
+				s.logf("Error reloading TLS certificates: %v", err)
+			}
+		}
+	}
+}
+
+// Protocol negotiated with ALPN, empty without TLS or if the client did
+// not offer any
+func (c *conn) negotiatedProtocol() string {
+	tls_conn, ok := c.rwc.(*tls.Conn)
+	if !ok { return "" }
+	return tls_conn.ConnectionState().NegotiatedProtocol
+}
+
+func (s *Server) handshake(c *conn) bool {
+	tls_conn, ok := c.rwc.(*tls.Conn)
+	if !ok { return true }
+
+	ctx, cancel := context.WithTimeout(c.ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tls_conn.HandshakeContext(ctx); err != nil {
+		s.tls_handshake_errors.Add(1)
+		s.logf("TLS handshake error from %s: %v", c.rwc.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+type certStore struct {
+	mu sync.RWMutex
+	pairs []*certPair
+}
+
+type certPair struct {
+	cert_file string
+	key_file string
+	cert *tls.Certificate
+	mod_time time.Time
+}
+
+func (cs *certStore) add(certFile string, keyFile string) error {
+	pair := &certPair{cert_file: certFile, key_file: keyFile}
+	if err := pair.load(); err != nil { return err }
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.pairs = append(cs.pairs, pair)
+	return nil
+}
+
+func (cs *certStore) empty() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return len(cs.pairs) == 0
+}
+
+// Reloads certificates whose files changed, or all of them if forced
+func (cs *certStore) reload(force bool) error {
+	cs.mu.RLock()
+	pairs := append([]*certPair{}, cs.pairs...)
+	cs.mu.RUnlock()
+
+	errs := []error{}
+	for _, pair := range pairs {
+		mod_time, err := pair.modTime()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !force && !mod_time.After(pair.mod_time) { continue }
+
+		reloaded := &certPair{cert_file: pair.cert_file, key_file: pair.key_file}
+		if err := reloaded.load(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cs.mu.Lock()
+		*pair = *reloaded
+		cs.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Picks the first certificate that is valid for the requested server
+// name. Falls back to the first certificate
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if len(cs.pairs) == 0 { return nil, errors.New("No TLS certificate configured") }
+
+	for _, pair := range cs.pairs {
+		if hello.SupportsCertificate(pair.cert) == nil { return pair.cert, nil }
+	}
+	return cs.pairs[0].cert, nil
+}
+
+func (p *certPair) load() error {
+	mod_time, err := p.modTime()
+	if err != nil { return err }
+	cert, err := tls.LoadX509KeyPair(p.cert_file, p.key_file)
+	if err != nil { return fmt.Errorf("Loading certificate %s: %w", p.cert_file, err) }
+	p.cert = &cert
+	p.mod_time = mod_time
+	return nil
+}
+
+// Latest modification time of the certificate and key file
+func (p *certPair) modTime() (time.Time, error) {
+	cert_info, err := os.Stat(p.cert_file)
+	if err != nil { return time.Time{}, err }
+	key_info, err := os.Stat(p.key_file)
+	if err != nil { return time.Time{}, err }
+	if key_info.ModTime().After(cert_info.ModTime()) { return key_info.ModTime(), nil }
+	return cert_info.ModTime(), nil
+}
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"io"
+	"net"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Writes a self-signed certificate for the given DNS names to dir
+func generateCert(t *testing.T, dir string, name string, serial int64) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	key_der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	cert_file := filepath.Join(dir, name + ".crt")
+	key_file := filepath.Join(dir, name + ".key")
+	require.NoError(t, os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0o600))
+	return cert_file, key_file, cert
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	a_cert, a_key, a := generateCert(t, dir, "a.test", 1)
+	b_cert, b_key, b := generateCert(t, dir, "b.test", 2)
+
+	srv, err := listen("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		w.WriteStatusLine(StatusOK)
+		w.Headers.Set("Content-Type", "text/plain")
+		w.WriteHeaders(nil)
+		w.WriteBody([]byte(r.TLS.ServerName))
+	})
+	require.NoError(t, err)
+	srv.cert_poll_interval = 10 * time.Millisecond
+	addr := srv.Listener.Addr().String()
+	require.NoError(t, srv.listenTLS(a_cert, a_key))
+	go srv.Serve()
+	defer srv.Close()
+	require.NoError(t, srv.AddCertificate(b_cert, b_key))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(a)
+	roots.AddCert(b)
+	get := func(server_name string) (*x509.Certificate, string) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: server_name, RootCAs: roots})
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + server_name + "\r\n\r\n"))
+		require.NoError(t, err)
+		status, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		return conn.ConnectionState().PeerCertificates[0], status
+	}
+
+	// Test: Certificates are picked by SNI
+	cert, status := get("a.test")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	assert.Equal(t, int64(1), cert.SerialNumber.Int64())
+	cert, _ = get("b.test")
+	assert.Equal(t, int64(2), cert.SerialNumber.Int64())
+
+	// Test: Changed files are reloaded
+	_, _, a = generateCert(t, dir, "a.test", 3)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(a_cert, future, future))
+	roots.AddCert(a)
+	assert.Eventually(t, func() bool {
+		cert, _ := get("a.test")
+		return cert.SerialNumber.Int64() == 3
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Test: Handshake errors are counted
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"))
+	reply := make([]byte, 1024)
+	n, _ := conn.Read(reply)
+	conn.Close()
+	assert.False(t, strings.HasPrefix(string(reply[:n]), "HTTP/1.1"))
+	assert.Eventually(t, func() bool { return srv.TLSHandshakeErrors() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestTLSALPN(t *testing.T) {
+	dir := t.TempDir()
+	cert_file, key_file, cert := generateCert(t, dir, "a.test", 1)
+	srv, err := listen("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(Headers{"Content-Type": "text/plain"})
+		w.WriteBody([]byte(r.Proto + " " + r.TLS.NegotiatedProtocol))
+	})
+	require.NoError(t, err)
+	addr := srv.Listener.Addr().String()
+	require.NoError(t, srv.listenTLS(cert_file, key_file))
+	go srv.Serve()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	get := func(h2 bool) (string, string) {
+		config := &tls.Config{ServerName: "a.test", RootCAs: roots, NextProtos: []string{"http/1.1"}}
+		if h2 { config.NextProtos = nil }
+		transport := &nethttp.Transport{TLSClientConfig: config, ForceAttemptHTTP2: h2}
+		defer transport.CloseIdleConnections()
+		resp, err := (&nethttp.Client{Transport: transport}).Get("https://" + addr + "/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.Proto, string(data)
+	}
+
+	// Test: The same handler serves both protocols
+	proto, data := get(true)
+	assert.Equal(t, "HTTP/2.0", proto)
+	assert.Equal(t, "HTTP/2.0 h2", data)
+	proto, data = get(false)
+	assert.Equal(t, "HTTP/1.1", proto)
+	assert.Equal(t, "HTTP/1.1 http/1.1", data)
+}
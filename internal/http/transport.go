@@ -0,0 +1,348 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConnsPerHost = 2
+	DefaultIdleConnTimeout = 90 * time.Second
+)
+
+// Opens connections for the client and keeps idle keep-alive connections
+// per host for later requests. The zero value is ready to use
+type Transport struct {
+	// Opens connections. Defaults to a net.Dialer
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+	// Used for https URLs. ServerName defaults to the host of the URL
+	TLSConfig *tls.Config
+	// Sends Connection: close and never reuses connections
+	DisableKeepAlives bool
+	// Defaults to DefaultMaxIdleConnsPerHost, negative keeps none
+	MaxIdleConnsPerHost int
+	// Limit for connections per host, idle ones included. Requests wait
+	// for a free connection when it is reached. Zero means no limit
+	MaxConnsPerHost int
+	// Idle connections are closed after this. Defaults to
+	// DefaultIdleConnTimeout
+	IdleConnTimeout time.Duration
+	mu sync.Mutex
+	pools map[string]*hostPool
+}
+
+type PoolStats struct {
+	Idle int
+	// Connections in use, including ones being dialed
+	Active int
+	// Requests waiting for a connection because of MaxConnsPerHost
+	Waiters int
+}
+
+type hostPool struct {
+	// Most recently used last
+	idle []*persistConn
+	active int
+	waiters []chan struct{}
+}
+
+type persistConn struct {
+	// TLS or plain connection that requests are sent on
+	conn net.Conn
+	// Underlying TCP connection, watched while idle
+	raw net.Conn
+	key string
+	// Was idle before, so the server may have closed it since
+	reused bool
+	idle_timer *time.Timer
+	watch_done chan struct{}
+	dead atomic.Bool
+	probe [1]byte
+}
+
+// Returns the stats per host, keyed by "scheme://host:port"
+func (t *Transport) Stats() map[string]PoolStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := map[string]PoolStats{}
+	for key, pool := range t.pools {
+		stats[key] = PoolStats{Idle: len(pool.idle), Active: pool.active, Waiters: len(pool.waiters)}
+	}
+	return stats
+}
+
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pool := range t.pools {
+		for _, pc := range pool.idle {
+			pc.idle_timer.Stop()
+			pc.conn.Close()
+		}
+		pool.idle = nil
+		t.wakeWaiter(pool)
+	}
+}
+
+// Sends the request on a pooled or new connection. A reused connection can
+// turn out to be closed by the server. Requests that are safe to repeat
+// are then sent again on a new one. See RFC 9112 9.3.1
+func (t *Transport) roundTrip(ctx context.Context, req *Request, cancel context.CancelFunc) (*Response, error) {
+	key, address := poolKey(req.Target)
+	out := *req
+	out.Headers = Headers{}
+	for name, value := range req.Headers { out.Headers.Set(name, value) }
+	if t.DisableKeepAlives { out.Headers.Set("Connection", "close") }
+
+	for {
+		pc, err := t.getConn(ctx, key, req.Target.Scheme, address)
+		if err != nil {
+			cancel()
+			return nil, contextError(ctx, err)
+		}
+		e := &exchange{t: t, pc: pc, ctx: ctx, cancel: cancel}
+		e.stop = context.AfterFunc(ctx, func() { pc.conn.Close() })
+
+		err = out.Write(e)
+		resp := (*Response)(nil)
+		if err == nil { resp, err = ResponseFromReader(e, req.StatusLine.Method) }
+		if err == nil {
+			b := resp.Body.(*body)
+			e.body = b
+			e.reusable = !t.DisableKeepAlives && !b.until_eof && responseKeepsAlive(resp)
+			// The connection is free as soon as the body is read
+			b.on_eof = func() { e.Close() }
+			return resp, nil
+		}
+
+		e.stop()
+		t.closeConn(pc)
+		if pc.reused && e.read_bytes == 0 && canRetry(req) && ctx.Err() == nil { continue }
+		cancel()
+		return nil, contextError(ctx, err)
+	}
+}
+
+func (t *Transport) getConn(ctx context.Context, key string, scheme string, address string) (*persistConn, error) {
+	for {
+		t.mu.Lock()
+		if t.pools == nil { t.pools = map[string]*hostPool{} }
+		pool := t.pools[key]
+		if pool == nil {
+			pool = &hostPool{}
+			t.pools[key] = pool
+		}
+
+		if n := len(pool.idle); n > 0 {
+			pc := pool.idle[n-1]
+			pool.idle = pool.idle[:n-1]
+			pool.active++
+			t.mu.Unlock()
+
+			// Stop watching it, a closed connection is not used again
+			pc.idle_timer.Stop()
+			pc.raw.SetReadDeadline(aLongTimeAgo)
+			<-pc.watch_done
+			pc.raw.SetReadDeadline(time.Time{})
+			if pc.dead.Load() {
+				t.closeConn(pc)
+				continue
+			}
+			pc.reused = true
+			return pc, nil
+		}
+
+		if t.MaxConnsPerHost <= 0 || pool.active < t.MaxConnsPerHost {
+			pool.active++
+			t.mu.Unlock()
+			pc, err := t.dial(ctx, key, scheme, address)
+			if err != nil {
+				t.mu.Lock()
+				pool.active--
+				t.wakeWaiter(pool)
+				t.mu.Unlock()
+				return nil, err
+			}
+			return pc, nil
+		}
+
+		wake := make(chan struct{}, 1)
+		pool.waiters = append(pool.waiters, wake)
+		t.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			t.mu.Lock()
+			pool.waiters = slices.DeleteFunc(pool.waiters, func(ch chan struct{}) bool { return ch == wake })
+			// Pass a wakeup that came in the meantime on
+			if len(wake) > 0 { t.wakeWaiter(pool) }
+			t.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (t *Transport) dial(ctx context.Context, key string, scheme string, address string) (*persistConn, error) {
+	dial := t.Dial
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = dialer.DialContext
+	}
+	raw, err := dial(ctx, "tcp", address)
+	if err != nil { return nil, err }
+	pc := &persistConn{conn: raw, raw: raw, key: key}
+	if scheme != "https" { return pc, nil }
+
+	config := &tls.Config{}
+	if t.TLSConfig != nil { config = t.TLSConfig.Clone() }
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		config.ServerName = host
+	}
+	if len(config.NextProtos) == 0 { config.NextProtos = []string{"http/1.1"} }
+	tls_conn := tls.Client(raw, config)
+	if err := tls_conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	pc.conn = tls_conn
+	return pc, nil
+}
+
+// Returns a connection to the pool, or closes it if the pool is full
+func (t *Transport) putConn(pc *persistConn) {
+	max_idle := t.MaxIdleConnsPerHost
+	if max_idle == 0 { max_idle = DefaultMaxIdleConnsPerHost }
+	idle_timeout := t.IdleConnTimeout
+	if idle_timeout <= 0 { idle_timeout = DefaultIdleConnTimeout }
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pool := t.pools[pc.key]
+	pool.active--
+	if len(pool.idle) >= max_idle {
+		pc.conn.Close()
+		t.wakeWaiter(pool)
+		return
+	}
+
+	pc.watch_done = make(chan struct{})
+	pc.idle_timer = time.AfterFunc(idle_timeout, func() { t.removeIdle(pc) })
+	pool.idle = append(pool.idle, pc)
+	go t.watch(pc)
+	t.wakeWaiter(pool)
+}
+
+// Watches an idle connection. Servers close them whenever they like, and
+// any data before a request is sent is an error as well
+func (t *Transport) watch(pc *persistConn) {
+	defer close(pc.watch_done)
+	n, err := pc.raw.Read(pc.probe[:])
+	var ne net.Error
+	if n > 0 || !errors.As(err, &ne) || !ne.Timeout() {
+		pc.dead.Store(true)
+		t.removeIdle(pc)
+	}
+}
+
+func (t *Transport) removeIdle(pc *persistConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pool := t.pools[pc.key]
+	idx := slices.Index(pool.idle, pc)
+	if idx == -1 { return }
+	pool.idle = slices.Delete(pool.idle, idx, idx+1)
+	pc.conn.Close()
+	t.wakeWaiter(pool)
+}
+
+// Closes a connection that was in use
+func (t *Transport) closeConn(pc *persistConn) {
+	pc.conn.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pool := t.pools[pc.key]
+	pool.active--
+	t.wakeWaiter(pool)
+}
+
+// Needs t.mu
+func (t *Transport) wakeWaiter(pool *hostPool) {
+	if len(pool.waiters) == 0 { return }
+	pool.waiters[0] <- struct{}{}
+	pool.waiters = pool.waiters[1:]
+}
+
+// One request and response on a connection. Reads fail with the context
+// error once it is done. Closing hands the connection back to the pool if
+// the response was read completely
+type exchange struct {
+	t *Transport
+	pc *persistConn
+	ctx context.Context
+	cancel context.CancelFunc
+	stop func() bool
+	body *body
+	reusable bool
+	read_bytes int
+	close_once sync.Once
+}
+
+func (e *exchange) Read(p []byte) (int, error) {
+	n, err := e.pc.conn.Read(p)
+	e.read_bytes += n
+	if err != nil && !errors.Is(err, io.EOF) { err = contextError(e.ctx, err) }
+	return n, err
+}
+
+func (e *exchange) Write(p []byte) (int, error) {
+	return e.pc.conn.Write(p)
+}
+
+func (e *exchange) Close() error {
+	e.close_once.Do(func() {
+		// Nothing may be left over, no second response was asked for
+		stopped := e.stop()
+		e.cancel()
+		if stopped && e.reusable && e.body.done() && len(e.body.rb.buffered()) == 0 {
+			e.t.putConn(e.pc)
+		} else {
+			e.t.closeConn(e.pc)
+		}
+	})
+	return nil
+}
+
+func poolKey(target RequestTarget) (string, string) {
+	port := "80"
+	if target.Scheme == "https" { port = "443" }
+	address := target.Authority
+	if _, p, err := net.SplitHostPort(address); err != nil || p == "" {
+		address = net.JoinHostPort(trimBrackets(address), port)
+	}
+	return target.Scheme + "://" + address, address
+}
+
+// See RFC 9112 9.3
+func responseKeepsAlive(resp *Response) bool {
+	connection := resp.Headers.Get("connection")
+	if resp.Version == "HTTP/1.0" { return HeaderHasToken(connection, "keep-alive") }
+	return !HeaderHasToken(connection, "close")
+}
+
+// Idempotent requests without a body can be sent again. See RFC 9110 9.2.2
+func canRetry(req *Request) bool {
+	switch req.StatusLine.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+	return req.Body == nil || req.Headers.Get("content-length") == "0"
+}
@@ -0,0 +1,209 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	srv, err := ListenAndServe("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		io.ReadAll(r.Body)
+		if r.Target.Path == "/slow" { <-block }
+		w.WriteStatusLine(StatusOK)
+		w.Headers.Set("Content-Type", "text/plain")
+		w.WriteHeaders(nil)
+		w.WriteBody([]byte(strconv.FormatUint(r.ConnID, 10)))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	address := srv.Listener.Addr().String()
+	base := "http://" + address
+	key := "http://" + address
+
+	get := func(client *Client, url string) string {
+		req, err := NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(context.Background(), req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	t.Run("Reuse", func(t *testing.T) {
+		transport := &Transport{}
+		defer transport.CloseIdleConnections()
+		client := &Client{Transport: transport}
+		first := get(client, base + "/")
+		assert.Equal(t, PoolStats{Idle: 1}, transport.Stats()[key])
+		assert.Equal(t, first, get(client, base + "/"))
+		assert.Equal(t, PoolStats{Idle: 1}, transport.Stats()[key])
+
+		transport.CloseIdleConnections()
+		assert.Equal(t, PoolStats{}, transport.Stats()[key])
+		assert.NotEqual(t, first, get(client, base + "/"))
+	})
+
+	t.Run("Unread Body", func(t *testing.T) {
+		transport := &Transport{}
+		defer transport.CloseIdleConnections()
+		req, err := NewRequest("GET", base + "/", nil)
+		require.NoError(t, err)
+		resp, err := (&Client{Transport: transport}).Do(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, PoolStats{Active: 1}, transport.Stats()[key])
+		resp.Body.Close()
+		assert.Equal(t, PoolStats{}, transport.Stats()[key])
+	})
+
+	t.Run("Disable Keep-Alives", func(t *testing.T) {
+		transport := &Transport{DisableKeepAlives: true}
+		client := &Client{Transport: transport}
+		first := get(client, base + "/")
+		assert.Equal(t, PoolStats{}, transport.Stats()[key])
+		assert.NotEqual(t, first, get(client, base + "/"))
+	})
+
+	t.Run("Max Conns Per Host", func(t *testing.T) {
+		transport := &Transport{MaxConnsPerHost: 1}
+		defer transport.CloseIdleConnections()
+		client := &Client{Transport: transport}
+		req, err := NewRequest("GET", base + "/slow", nil)
+		require.NoError(t, err)
+		go client.Do(context.Background(), req)
+		assert.Eventually(t, func() bool { return transport.Stats()[key].Active == 1 }, time.Second, 5 * time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			req, _ := NewRequest("GET", base + "/", nil)
+			_, err := client.Do(ctx, req)
+			done <- err
+		}()
+		assert.Eventually(t, func() bool { return transport.Stats()[key].Waiters == 1 }, time.Second, 5 * time.Millisecond)
+		cancel()
+		require.ErrorIs(t, <-done, context.Canceled)
+		assert.Equal(t, PoolStats{Active: 1}, transport.Stats()[key])
+	})
+
+	t.Run("Idle Timeout", func(t *testing.T) {
+		transport := &Transport{IdleConnTimeout: 20 * time.Millisecond}
+		get(&Client{Transport: transport}, base + "/")
+		assert.Equal(t, 1, transport.Stats()[key].Idle)
+		assert.Eventually(t, func() bool { return transport.Stats()[key].Idle == 0 }, time.Second, 5 * time.Millisecond)
+	})
+
+	t.Run("Max Idle Conns Per Host", func(t *testing.T) {
+		transport := &Transport{MaxIdleConnsPerHost: -1}
+		get(&Client{Transport: transport}, base + "/")
+		assert.Equal(t, PoolStats{}, transport.Stats()[key])
+	})
+}
+
+func TestTransportStaleConnections(t *testing.T) {
+	// Answers the first request on every connection and then closes it
+	// without saying so, like a server whose idle timeout ran out
+	var conns atomic.Int32
+	var requests atomic.Int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	close_conn := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil { return }
+			id := conns.Add(1)
+			go func() {
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						conn.Close()
+						return
+					}
+					if line != "\r\n" { continue }
+					requests.Add(1)
+					body := strconv.Itoa(int(id))
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+					close_conn <- conn
+				}
+			}()
+		}
+	}()
+	base := "http://" + listener.Addr().String()
+
+	// The watcher notices a close while the connection is idle
+	t.Run("Detected While Idle", func(t *testing.T) {
+		transport := &Transport{}
+		client := &Client{Transport: transport}
+		req, err := NewRequest("GET", base + "/", nil)
+		require.NoError(t, err)
+		resp, err := client.Do(context.Background(), req)
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		(<-close_conn).Close()
+		assert.Eventually(t, func() bool { return transport.Stats()["http://" + listener.Addr().String()].Idle == 0 }, time.Second, 5 * time.Millisecond)
+	})
+
+	// A close racing with the next request is retried for idempotent
+	// requests only
+	t.Run("Retry", func(t *testing.T) {
+		transport := &Transport{}
+		client := &Client{Transport: transport}
+		send := func(method string, body io.Reader) (string, error) {
+			req, err := NewRequest(method, base + "/", body)
+			require.NoError(t, err)
+			resp, err := client.Do(context.Background(), req)
+			if err != nil { return "", err }
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			return string(data), err
+		}
+		stale := func() {
+			// Stop the watcher, so the close is only noticed when the next
+			// request is sent
+			transport.mu.Lock()
+			for _, pool := range transport.pools {
+				for _, pc := range pool.idle {
+					pc.idle_timer.Stop()
+					pc.raw.SetReadDeadline(aLongTimeAgo)
+					<-pc.watch_done
+					pc.raw.SetReadDeadline(time.Time{})
+					pc.watch_done = make(chan struct{})
+					close(pc.watch_done)
+				}
+			}
+			transport.mu.Unlock()
+			(<-close_conn).Close()
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		first, err := send("GET", nil)
+		require.NoError(t, err)
+		stale()
+		second, err := send("GET", nil)
+		require.NoError(t, err)
+		assert.NotEqual(t, first, second)
+
+		stale()
+		before := requests.Load()
+		_, err = send("POST", strings.NewReader("data"))
+		require.Error(t, err)
+		assert.Equal(t, before, requests.Load())
+	})
+}
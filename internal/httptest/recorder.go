@@ -0,0 +1,87 @@
+// Package httptest runs handlers of the http package in tests, either in
+// memory with a ResponseRecorder or behind a TestServer on a loopback port
+// or an in-memory listener.
+package httptest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/lieberdev/http/internal/http"
+)
+
+// Address set as the peer of requests from NewRequest
+const DefaultRemoteAddr = "192.0.2.1:1234"
+
+// Records the response of a handler in memory. The fields are set by Serve
+type ResponseRecorder struct {
+	StatusCode http.ResponseStatusCode
+	Reason string
+	// As written by the handler. The writer is not backed by a connection,
+	// so Connection: close is always set
+	Headers http.Headers
+	Body *bytes.Buffer
+	Trailers http.Headers
+	// The whole response as written on the wire
+	Raw bytes.Buffer
+}
+
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{Headers: http.Headers{}, Body: &bytes.Buffer{}, Trailers: http.Headers{}}
+}
+
+// Runs handler for req and parses what it wrote into the recorder. An error
+// means the handler wrote no or an invalid response
+func (rec *ResponseRecorder) Serve(handler http.Handler, req *http.Request) error {
+	w := http.NewResponseWriter(&rec.Raw)
+	handler(w, req)
+	// The handler may not have finished the response
+	w.Flush()
+	if rec.Raw.Len() == 0 { return errors.New("Handler wrote no response") }
+
+	resp, err := http.ResponseFromReader(bytes.NewReader(rec.Raw.Bytes()), req.StatusLine.Method)
+	if err != nil { return err }
+	rec.StatusCode = resp.StatusCode
+	rec.Reason = resp.Reason
+	rec.Headers = resp.Headers
+	rec.Body.Reset()
+	if _, err := io.Copy(rec.Body, resp.Body); err != nil { return err }
+	if resp.Trailers != nil { rec.Trailers = resp.Trailers }
+	return nil
+}
+
+// Builds a request as the server would pass it to a handler. target is a
+// path like "/items?id=1" or an absolute URL, whose authority becomes the
+// Host. Otherwise Host is "example.com". Panics on invalid input, since it
+// is meant for tests
+func NewRequest(method string, target string, body io.Reader) *http.Request {
+	data := []byte{}
+	if body != nil {
+		var err error
+		data, err = io.ReadAll(body)
+		if err != nil { panic(err) }
+	}
+
+	host := "example.com"
+	if _, rest, ok := strings.Cut(target, "://"); ok {
+		host, _, _ = strings.Cut(rest, "/")
+		host, _, _ = strings.Cut(host, "?")
+	}
+	raw := &bytes.Buffer{}
+	fmt.Fprintf(raw, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, target, host)
+	if body != nil { raw.WriteString("Content-Length: " + strconv.Itoa(len(data)) + "\r\n") }
+	raw.WriteString("\r\n")
+	raw.Write(data)
+
+	req, err := http.RequestFromReader(io.NopCloser(raw))
+	if err != nil { panic(err) }
+	req.RemoteAddr = DefaultRemoteAddr
+	req.LocalAddr = "192.0.2.2:80"
+	req.ClientIP = netip.MustParseAddrPort(DefaultRemoteAddr).Addr()
+	return req
+}
@@ -0,0 +1,75 @@
+package httptest
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lieberdev/http/internal/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseRecorder(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		w.WriteStatusLine(http.StatusOK)
+		w.Headers.Set("Content-Type", "text/plain")
+		w.Headers.Set("X-Method", r.StatusLine.Method)
+		w.Headers.Set("X-Host", r.Headers.Get("host"))
+		w.Headers.Set("X-Query", r.Target.RawQuery)
+		w.WriteHeaders(nil)
+		w.WriteBody(data)
+	}
+
+	t.Run("Body", func(t *testing.T) {
+		rec := NewRecorder()
+		req := NewRequest("POST", "/items?id=1", strings.NewReader("hello"))
+		require.NoError(t, rec.Serve(echo, req))
+		assert.Equal(t, http.StatusOK, rec.StatusCode)
+		assert.Equal(t, "OK", rec.Reason)
+		assert.Equal(t, "POST", rec.Headers.Get("x-method"))
+		assert.Equal(t, "example.com", rec.Headers.Get("x-host"))
+		assert.Equal(t, "id=1", rec.Headers.Get("x-query"))
+		assert.Equal(t, "5", rec.Headers.Get("content-length"))
+		assert.Equal(t, "hello", rec.Body.String())
+		assert.True(t, strings.HasPrefix(rec.Raw.String(), "HTTP/1.1 200 OK\r\n"))
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		rec := NewRecorder()
+		require.NoError(t, rec.Serve(echo, NewRequest("HEAD", "http://api.test/", nil)))
+		assert.Equal(t, "api.test", rec.Headers.Get("x-host"))
+		assert.Empty(t, rec.Body.String())
+	})
+
+	t.Run("Trailers", func(t *testing.T) {
+		rec := NewRecorder()
+		err := rec.Serve(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteStatusLine(http.StatusOK)
+			w.Headers.Set("Content-Type", "text/plain")
+			w.Headers.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(nil)
+			w.WriteTrailers(http.Headers{"x-checksum": "abc"})
+			w.WriteChunkedBody([]byte("chunk"))
+			w.WriteChunkedBodyDone()
+		}, NewRequest("GET", "/", nil))
+		require.NoError(t, err)
+		assert.Equal(t, "chunk", rec.Body.String())
+		assert.Equal(t, "abc", rec.Trailers.Get("x-checksum"))
+	})
+
+	t.Run("No Response", func(t *testing.T) {
+		rec := NewRecorder()
+		require.Error(t, rec.Serve(func(w http.ResponseWriter, r *http.Request) {}, NewRequest("GET", "/", nil)))
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		req := NewRequest("GET", "/", nil)
+		assert.Equal(t, "HTTP/1.1", req.Proto)
+		assert.Equal(t, DefaultRemoteAddr, req.RemoteAddr)
+		assert.Equal(t, "192.0.2.1", req.ClientIP.String())
+		assert.Empty(t, req.Headers.Get("content-length"))
+		assert.Panics(t, func() { NewRequest("get", "/", nil) })
+	})
+}
@@ -0,0 +1,101 @@
+package httptest
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/lieberdev/http/internal/http"
+)
+
+// Server for a handler with a client that connects to it
+type TestServer struct {
+	*http.Server
+	// Base URL without trailing slash, e.g. "http://127.0.0.1:52341"
+	URL string
+	// Sends requests to the server, also for the in-memory listener
+	Client *http.Client
+	transport *http.Transport
+}
+
+// Starts a server for handler on an ephemeral loopback port
+func NewTestServer(handler http.Handler) *TestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { panic(err) }
+	return start(ln, handler, nil)
+}
+
+// Starts a server for handler on an in-memory listener. Connections are
+// net.Pipe pairs, so no port is used. The URL is only understood by Client
+func NewPipeServer(handler http.Handler) *TestServer {
+	ln := &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	return start(ln, handler, ln.dial)
+}
+
+func start(ln net.Listener, handler http.Handler, dial func(ctx context.Context, network string, address string) (net.Conn, error)) *TestServer {
+	srv := &http.Server{
+		Listener: ln,
+		Handler: handler,
+		ErrorLog: log.New(os.Stderr, "httptest: ", log.LstdFlags),
+	}
+	go srv.Serve()
+	transport := &http.Transport{Dial: dial}
+	return &TestServer{
+		Server: srv,
+		URL: "http://" + ln.Addr().String(),
+		Client: &http.Client{Transport: transport},
+		transport: transport,
+	}
+}
+
+// Closes the server and the idle connections of Client
+func (s *TestServer) Close() error {
+	s.transport.CloseIdleConnections()
+	return s.Server.Close()
+}
+
+// Hands out one end of a net.Pipe per dial
+type pipeListener struct {
+	conns chan net.Conn
+	done chan struct{}
+	close_once sync.Once
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string { return "pipe" }
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.close_once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	client.Close()
+	server.Close()
+	if ctx.Err() != nil { return nil, ctx.Err() }
+	return nil, net.ErrClosed
+}
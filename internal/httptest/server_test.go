@@ -0,0 +1,52 @@
+package httptest
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/lieberdev/http/internal/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestServer(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteStatusLine(http.StatusOK)
+		w.Headers.Set("Content-Type", "text/plain")
+		w.WriteHeaders(nil)
+		w.WriteBody([]byte(r.Target.Path + " " + strconv.FormatUint(r.ConnID, 10)))
+	}
+	get := func(srv *TestServer, path string) string {
+		req, err := http.NewRequest("GET", srv.URL + path, nil)
+		require.NoError(t, err)
+		resp, err := srv.Client.Do(context.Background(), req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	for _, tc := range []struct {
+		name string
+		start func(http.Handler) *TestServer
+	}{
+		{"Loopback", NewTestServer},
+		{"Pipe", NewPipeServer},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := tc.start(handler)
+			assert.Equal(t, "/a 1", get(srv, "/a"))
+			// The connection is kept alive
+			assert.Equal(t, "/b 1", get(srv, "/b"))
+			require.NoError(t, srv.Close())
+
+			req, err := http.NewRequest("GET", srv.URL + "/", nil)
+			require.NoError(t, err)
+			_, err = srv.Client.Do(context.Background(), req)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Package proxy implements a forward proxy on top of the http server.
+// Absolute-form requests are forwarded to their origin server and CONNECT
+// requests are tunnelled. Tunnels take over the client connection, so only
+// HTTP/1.x clients can use the proxy.
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lieberdev/http/internal/http"
+)
+
+const DefaultDialTimeout = 10 * time.Second
+
+type Proxy struct {
+	// Destinations that may be reached as "host:port". A host of "*"
+	// matches any host and "*.example.com" any subdomain of example.com. A
+	// port of "*" matches any port. An empty list denies everything
+	Allow []string
+	// Checks the Basic credentials sent in Proxy-Authorization. nil
+	// disables authentication
+	Authenticate func(user string, password string) bool
+	// Sent in Proxy-Authenticate. Defaults to "proxy"
+	Realm string
+	// Names the proxy in the Via header of forwarded messages. Defaults to
+	// "proxy"
+	Name string
+	// Opens connections to upstream servers. Defaults to a net.Dialer with
+	// DefaultDialTimeout
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// Serves a proxy request, use it as the server handler
+func (p *Proxy) Handle(w http.ResponseWriter, r *http.Request) {
+	if r.Proto == "HTTP/2.0" {
+		fail(&w, http.StatusHTTPVersionNotSupported, "Proxy needs HTTP/1.x")
+		return
+	}
+	if p.Authenticate != nil && !p.authenticated(r) {
+		realm := p.Realm
+		if realm == "" { realm = "proxy" }
+		w.WriteStatusLine(http.StatusProxyAuthRequired)
+		w.Headers.Set("Proxy-Authenticate", "Basic realm=\"" + realm + "\"")
+		w.Headers.Set("Content-Type", "text/plain")
+		w.WriteHeaders(nil)
+		w.WriteBody([]byte("Proxy authentication required"))
+		return
+	}
+
+	switch {
+	case r.Target.Form == http.AuthorityForm:
+		p.tunnel(&w, r)
+	case r.Target.Form == http.AbsoluteForm && r.Target.Scheme == "http":
+		p.forward(&w, r)
+	default:
+		fail(&w, http.StatusBadRequest, "Proxy needs an absolute-form http request-target or CONNECT")
+	}
+}
+
+// See RFC 9110 11.7.1
+func (p *Proxy) authenticated(r *http.Request) bool {
+	scheme, credentials, ok := strings.Cut(r.Headers.Get("proxy-authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "basic") { return false }
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil { return false }
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && p.Authenticate(user, password)
+}
+
+func (p *Proxy) allowed(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil { return false }
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range p.Allow {
+		allowed_host, allowed_port, err := net.SplitHostPort(entry)
+		if err != nil || (allowed_port != "*" && allowed_port != port) { continue }
+		allowed_host = strings.ToLower(allowed_host)
+		switch {
+		case allowed_host == "*", allowed_host == host:
+			return true
+		case strings.HasPrefix(allowed_host, "*.") && strings.HasSuffix(host, allowed_host[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) dial(ctx context.Context, address string) (net.Conn, error) {
+	if p.Dial != nil { return p.Dial(ctx, "tcp", address) }
+	dialer := net.Dialer{Timeout: DefaultDialTimeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// Forwards the request over a new upstream connection and passes the
+// response on as it arrives. See RFC 9110 7.6
+func (p *Proxy) forward(w *http.ResponseWriter, r *http.Request) {
+	address := r.Target.Authority
+	if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+		address = net.JoinHostPort(strings.Trim(strings.TrimSuffix(address, ":"), "[]"), "80")
+	}
+	if !p.allowed(address) {
+		fail(w, http.StatusForbidden, "Destination not allowed")
+		return
+	}
+	upstream, err := p.dial(r.Context(), address)
+	if err != nil {
+		fail(w, http.StatusBadGateway, "Could not connect to upstream")
+		return
+	}
+	defer upstream.Close()
+	stop := context.AfterFunc(r.Context(), func() { upstream.Close() })
+	defer stop()
+
+	if err := p.writeRequest(upstream, r); err != nil {
+		fail(w, http.StatusBadGateway, "Could not forward request")
+		return
+	}
+	resp, err := http.ResponseFromReader(upstream, r.StatusLine.Method)
+	// Upgrade is never forwarded, so a switch is not expected
+	if err == nil && resp.StatusCode == 101 { err = fmt.Errorf("Unexpected protocol switch") }
+	if err != nil {
+		fail(w, http.StatusBadGateway, "Invalid response from upstream")
+		return
+	}
+	resp.Headers.Add("Via", p.via(resp.Version))
+	w.WriteResponse(resp, r.StatusLine.Method)
+}
+
+// Opens a tunnel to the requested authority and copies bytes in both
+// directions until both sides are done. See RFC 9110 9.3.6
+func (p *Proxy) tunnel(w *http.ResponseWriter, r *http.Request) {
+	if !p.allowed(r.Target.Authority) {
+		fail(w, http.StatusForbidden, "Destination not allowed")
+		return
+	}
+	upstream, err := p.dial(r.Context(), r.Target.Authority)
+	if err != nil {
+		fail(w, http.StatusBadGateway, "Could not connect to upstream")
+		return
+	}
+	defer upstream.Close()
+
+	conn, brw, err := w.Hijack()
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer conn.Close()
+	close_both := func() {
+		conn.Close()
+		upstream.Close()
+	}
+	stop := context.AfterFunc(r.Context(), close_both)
+	defer stop()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil { return }
+	done := make(chan struct{})
+	go func() {
+		relay(upstream, brw.Reader, close_both)
+		close(done)
+	}()
+	relay(conn, upstream, close_both)
+	<-done
+}
+
+// Copies until src ends and passes the end on with a half-close, so the
+// other direction can finish. Errors tear down the whole tunnel
+func relay(dst net.Conn, src io.Reader, close_both func()) {
+	_, err := io.Copy(dst, src)
+	cw, ok := dst.(interface{ CloseWrite() error })
+	if err != nil || !ok || cw.CloseWrite() != nil { close_both() }
+}
+
+// Sends the request in origin-form without hop-by-hop headers and the
+// credentials for this proxy. The upstream connection is only used for
+// this one request
+func (p *Proxy) writeRequest(dst io.Writer, r *http.Request) error {
+	hop := http.HopByHopHeaders(r.Headers.Get("connection"))
+	headers := http.Headers{}
+	for name, value := range r.Headers {
+		if !hop[name] { headers.Set(name, value) }
+	}
+	headers.Set("Host", r.Target.Authority)
+	headers.Set("Connection", "close")
+	headers.Add("Via", p.via(r.Proto))
+	// The body was decoded by the server and is framed again by Write,
+	// which declares the trailers only for chunks. See RFC 9112 6.3
+	if http.HeaderHasToken(r.Headers.Get("transfer-encoding"), "chunked") {
+		delete(headers, "content-length")
+		if trailer := r.Headers.Get("trailer"); trailer != "" { headers.Set("Trailer", trailer) }
+	}
+
+	out := *r
+	out.Headers = headers
+	out.Target = http.RequestTarget{Form: http.OriginForm, Path: r.Target.Path, RawQuery: r.Target.RawQuery}
+	return out.Write(dst)
+}
+
+// Entry of this proxy for the Via header of a message received with proto.
+// See RFC 9110 7.6.3
+func (p *Proxy) via(proto string) string {
+	name := p.Name
+	if name == "" { name = "proxy" }
+	return strings.TrimPrefix(proto, "HTTP/") + " " + name
+}
+
+func fail(w *http.ResponseWriter, code http.ResponseStatusCode, reason string) {
+	w.WriteStatusLine(code)
+	w.Headers.Set("Content-Type", "text/plain")
+	w.WriteHeaders(nil)
+	w.WriteBody([]byte(reason))
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lieberdev/http/internal/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	// Echoes the request line, header names and body
+	upstream, err := http.ListenAndServe("127.0.0.1:0", func(w http.ResponseWriter, r *http.Request) {
+		names := []string{}
+		for name := range r.Headers { names = append(names, name) }
+		sort.Strings(names)
+		body, _ := io.ReadAll(r.Body)
+		w.WriteStatusLine(http.StatusOK)
+		w.Headers.Set("Content-Type", "text/plain")
+		w.WriteHeaders(nil)
+		w.WriteBody([]byte(r.StatusLine.Target + "\n" + strings.Join(names, ",") + "\n" + r.Headers.Get("host") + "\n" +
+			string(body) + "\n" + r.Trailers.Get("x-checksum")))
+	})
+	require.NoError(t, err)
+	defer upstream.Close()
+	upstream_addr := upstream.Listener.Addr().String()
+
+	// Sends a canned response after an interim one, a chunked one for
+	// /chunked
+	raw_upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer raw_upstream.Close()
+	go func() {
+		for {
+			conn, err := raw_upstream.Accept()
+			if err != nil { return }
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				request_line, _ := br.ReadString('\n')
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil || line == "\r\n" { break }
+				}
+				if strings.HasPrefix(request_line, "GET /chunked ") {
+					conn.Write([]byte("HTTP/1.1 200 OK\r\n" +
+						"Proxy-Authenticate: Basic realm=\"upstream\"\r\n" +
+						"Trailer: X-Checksum\r\n" +
+						"Transfer-Encoding: chunked\r\n" +
+						"\r\n" +
+						"2\r\nok\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n" +
+					"HTTP/1.0 404 Not Found\r\n" +
+					"Connection: X-Secret\r\n" +
+					"X-Secret: 1\r\n" +
+					"Keep-Alive: timeout=5\r\n" +
+					"Proxy-Authenticate: Basic realm=\"upstream\"\r\n" +
+					"Trailer: X-Checksum\r\n" +
+					"Content-Length: 2\r\n" +
+					"\r\n" +
+					"no"))
+			}()
+		}
+	}()
+	raw_addr := raw_upstream.Addr().String()
+
+	// Echoes everything back
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil { return }
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	echo_addr := echo.Addr().String()
+
+	p := &Proxy{
+		Allow: []string{upstream_addr, raw_addr, echo_addr, "127.0.0.1:1"},
+		Authenticate: func(user string, password string) bool { return user == "ci" && password == "secret" },
+	}
+	srv, err := http.ListenAndServe("127.0.0.1:0", p.Handle)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("ci:secret")) + "\r\n"
+	send := func(request string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte(request))
+		require.NoError(t, err)
+		return conn, bufio.NewReader(conn)
+	}
+	readHead := func(br *bufio.Reader) string {
+		head := ""
+		for {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			head += line
+			if line == "\r\n" { return head }
+		}
+	}
+
+	// Reads the response to a forwarded request, the connection stays open
+	readResponse := func(br *bufio.Reader, method string) (*http.Response, string) {
+		resp, err := http.ResponseFromReader(br, method)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("Forward", func(t *testing.T) {
+		_, br := send("GET http://" + upstream_addr + "/hello?x=1 HTTP/1.1\r\n" +
+			"Host: ignored\r\n" +
+			auth +
+			"Connection: keep-alive, X-Hop\r\n" +
+			"Keep-Alive: timeout=5\r\n" +
+			"TE: trailers\r\n" +
+			"X-Hop: 1\r\n" +
+			"X-End: 1\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n")
+		resp, body := readResponse(br, "GET")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "1.1 proxy", resp.Headers.Get("via"))
+		assert.Equal(t, "/hello?x=1\nconnection,host,via,x-end\n" + upstream_addr + "\n\n", body)
+	})
+
+	t.Run("Keep Alive", func(t *testing.T) {
+		conn, br := send("GET http://" + upstream_addr + "/a HTTP/1.1\r\nHost: " + upstream_addr + "\r\n" + auth + "\r\n")
+		_, body := readResponse(br, "GET")
+		assert.True(t, strings.HasPrefix(body, "/a\n"))
+		_, err := conn.Write([]byte("HEAD http://" + upstream_addr + "/b HTTP/1.1\r\nHost: " + upstream_addr + "\r\n" + auth + "\r\n"))
+		require.NoError(t, err)
+		resp, body := readResponse(br, "HEAD")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Headers.Get("content-length"))
+		assert.Empty(t, body)
+	})
+
+	t.Run("Chunked Body", func(t *testing.T) {
+		_, br := send("POST http://" + upstream_addr + "/upload HTTP/1.1\r\n" +
+			"Host: " + upstream_addr + "\r\n" +
+			auth +
+			"Transfer-Encoding: chunked\r\n" +
+			"Content-Length: 100\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n")
+		resp, body := readResponse(br, "POST")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		// The proxy frames the body in chunks again and declares the trailers
+		assert.Equal(t, "/upload\nconnection,host,trailer,transfer-encoding,via\n" + upstream_addr + "\nhello world\nabc", body)
+	})
+
+	t.Run("Response Headers", func(t *testing.T) {
+		_, br := send("GET http://" + raw_addr + "/ HTTP/1.1\r\nHost: " + raw_addr + "\r\n" + auth + "\r\n")
+		resp, body := readResponse(br, "GET")
+		assert.Equal(t, http.ResponseStatusCode(404), resp.StatusCode)
+		assert.Equal(t, "Not Found", resp.Reason)
+		assert.Equal(t, "2", resp.Headers.Get("content-length"))
+		assert.Equal(t, "1.0 proxy", resp.Headers.Get("via"))
+		assert.Empty(t, resp.Headers.Get("x-secret"))
+		assert.Empty(t, resp.Headers.Get("keep-alive"))
+		assert.Empty(t, resp.Headers.Get("connection"))
+		assert.Empty(t, resp.Headers.Get("proxy-authenticate"))
+		assert.Empty(t, resp.Headers.Get("trailer"))
+		assert.Equal(t, "no", body)
+
+		// A chunked body is framed again with its trailers declared
+		_, br = send("GET http://" + raw_addr + "/chunked HTTP/1.1\r\nHost: " + raw_addr + "\r\n" + auth + "\r\n")
+		resp, body = readResponse(br, "GET")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Headers.Get("proxy-authenticate"))
+		assert.Equal(t, "X-Checksum", resp.Headers.Get("trailer"))
+		assert.Equal(t, "ok", body)
+		assert.Equal(t, "abc", resp.Trailers.Get("x-checksum"))
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		conn, br := send("CONNECT " + echo_addr + " HTTP/1.1\r\nHost: " + echo_addr + "\r\n" + auth + "\r\nearly")
+		assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n\r\n", readHead(br))
+		_, err := conn.Write([]byte(" data"))
+		require.NoError(t, err)
+		conn.(*net.TCPConn).CloseWrite()
+		data, err := io.ReadAll(br)
+		require.NoError(t, err)
+		assert.Equal(t, "early data", string(data))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			request string
+			status string
+		}{
+			{"Missing Credentials", "CONNECT " + echo_addr + " HTTP/1.1\r\nHost: " + echo_addr + "\r\n\r\n", "407 Proxy Authentication Required"},
+			{"Wrong Credentials", "CONNECT " + echo_addr + " HTTP/1.1\r\nHost: " + echo_addr + "\r\n" +
+				"Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("ci:wrong")) + "\r\n\r\n", "407 Proxy Authentication Required"},
+			{"Denied Tunnel", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n" + auth + "\r\n", "403 Forbidden"},
+			{"Denied Forward", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n" + auth + "\r\n", "403 Forbidden"},
+			{"Origin Form", "GET / HTTP/1.1\r\nHost: localhost\r\n" + auth + "\r\n", "400 Bad Request"},
+			{"Unreachable", "CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n" + auth + "\r\n", "502 Bad Gateway"},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				_, br := send(tc.request)
+				head := readHead(br)
+				assert.Contains(t, head, "HTTP/1.1 " + tc.status + "\r\n")
+				if strings.HasPrefix(tc.status, "407") {
+					assert.Contains(t, strings.ToLower(head), "proxy-authenticate: basic realm=\"proxy\"\r\n")
+				}
+			})
+		}
+	})
+}
+
+func TestAllowed(t *testing.T) {
+	p := &Proxy{Allow: []string{"example.com:443", "*.internal:*", "10.0.0.1:80", "[::1]:8080"}}
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"example.com:443", true},
+		{"EXAMPLE.com.:443", true},
+		{"example.com:80", false},
+		{"api.example.com:443", false},
+		{"db.internal:5432", true},
+		{"internal:5432", false},
+		{"10.0.0.1:80", true},
+		{"10.0.0.2:80", false},
+		{"[::1]:8080", true},
+		{"example.com", false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.allowed, p.allowed(tc.address), tc.address)
+	}
+	assert.False(t, (&Proxy{}).allowed("example.com:443"))
+	assert.True(t, (&Proxy{Allow: []string{"*:*"}}).allowed("example.com:443"))
+}
@@ -0,0 +1,38 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+var errMessageTooBig = errors.New("Message exceeds size limit")
+
+// Removed from and added back to every compressed message. See RFC 7692 7.2
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// An empty final block, appended after the tail so a complete message ends
+// the stream cleanly. A message cut off inside a block does not
+var deflateEnd = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Compresses a message without context takeover, so every message can be
+// decompressed on its own
+func compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil { return nil, err }
+	if _, err := fw.Write(data); err != nil { return nil, err }
+	if err := fw.Flush(); err != nil { return nil, err }
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+func decompress(data []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail), bytes.NewReader(deflateEnd)))
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil { return nil, err }
+	if int64(len(out)) > limit { return nil, errMessageTooBig }
+	return out, nil
+}
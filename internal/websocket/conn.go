@@ -0,0 +1,299 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	continuationFrame = 0
+	finalBit = 1 << 7
+	rsv1Bit = 1 << 6
+	rsv2Bit = 1 << 5
+	rsv3Bit = 1 << 4
+	maskBit = 1 << 7
+	maxControlFramePayload = 125
+)
+
+type Conn struct {
+	conn net.Conn
+	br *bufio.Reader
+	is_server bool
+	compression bool
+	max_message_size int64
+	write_mu sync.Mutex
+	close_sent bool
+	close_received bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, is_server bool) *Conn {
+	if br == nil { br = bufio.NewReader(conn) }
+	return &Conn{
+		conn: conn,
+		br: br,
+		is_server: is_server,
+		max_message_size: DefaultMaxMessageSize,
+	}
+}
+
+type frame struct {
+	fin bool
+	rsv1 bool
+	opcode int
+	payload []byte
+}
+
+// Reads the next data message. Fragments are reassembled, pings are
+// answered and a close frame is echoed before *CloseError is returned
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	message_type := 0
+	compressed := false
+	message := []byte{}
+
+	for {
+		f, err := c.readFrame()
+		if err != nil { return 0, nil, err }
+
+		switch f.opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, f.payload, false); err != nil { return 0, nil, err }
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(f.payload)
+		case TextMessage, BinaryMessage:
+			if message_type != 0 {
+				return 0, nil, c.protocolError(CloseProtocolError, "Expected continuation frame")
+			}
+			message_type = f.opcode
+			compressed = f.rsv1
+		case continuationFrame:
+			if message_type == 0 {
+				return 0, nil, c.protocolError(CloseProtocolError, "Continuation frame without message")
+			}
+			if f.rsv1 {
+				return 0, nil, c.protocolError(CloseProtocolError, "RSV1 set on continuation frame")
+			}
+		}
+
+		if int64(len(message) + len(f.payload)) > c.max_message_size {
+			return 0, nil, c.protocolError(CloseMessageTooBig, "Message exceeds size limit")
+		}
+		message = append(message, f.payload...)
+		if !f.fin { continue }
+
+		if compressed {
+			message, err = decompress(message, c.max_message_size)
+			if errors.Is(err, errMessageTooBig) {
+				return 0, nil, c.protocolError(CloseMessageTooBig, "Message exceeds size limit")
+			} else if err != nil {
+				return 0, nil, c.protocolError(CloseInvalidFramePayloadData, "Invalid compressed data")
+			}
+		}
+		if message_type == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.protocolError(CloseInvalidFramePayloadData, "Text message is not valid UTF-8")
+		}
+		return message_type, message, nil
+	}
+}
+
+// Writes a single message. Data messages are compressed if negotiated
+func (c *Conn) WriteMessage(message_type int, data []byte) error {
+	switch message_type {
+	case TextMessage, BinaryMessage:
+		if !c.compression { return c.writeFrame(message_type, data, false) }
+		compressed, err := compress(data)
+		if err != nil { return err }
+		return c.writeFrame(message_type, compressed, true)
+	case PingMessage, PongMessage:
+		if len(data) > maxControlFramePayload {
+			return fmt.Errorf("Control frame payload must not exceed %d bytes", maxControlFramePayload)
+		}
+		return c.writeFrame(message_type, data, false)
+	case CloseMessage:
+		return fmt.Errorf("Use WriteClose to send a close message")
+	default:
+		return fmt.Errorf("Unknown message type: %d", message_type)
+	}
+}
+
+// Starts the close handshake. ReadMessage returns *CloseError once the
+// peer has answered. See RFC 6455 7.1.2
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := []byte{}
+	if code != CloseNoStatusReceived {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+	}
+	if len(payload) > maxControlFramePayload {
+		return fmt.Errorf("Close reason is too long")
+	}
+	return c.writeFrame(CloseMessage, payload, false)
+}
+
+// Closes the underlying connection, sending a close frame first if the
+// close handshake has not been started yet
+func (c *Conn) Close() error {
+	c.write_mu.Lock()
+	close_sent := c.close_sent
+	c.write_mu.Unlock()
+	if !close_sent { c.WriteClose(CloseNormalClosure, "") }
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *Conn) handleClose(payload []byte) error {
+	code := CloseNoStatusReceived
+	reason := ""
+	if len(payload) == 1 {
+		return c.protocolError(CloseProtocolError, "Invalid close frame payload")
+	}
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+		if !isValidCloseCode(code) {
+			return c.protocolError(CloseProtocolError, "Invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return c.protocolError(CloseInvalidFramePayloadData, "Close reason is not valid UTF-8")
+		}
+	}
+
+	c.close_received = true
+	// Echo the status code back if we did not start the handshake
+	c.write_mu.Lock()
+	close_sent := c.close_sent
+	c.write_mu.Unlock()
+	if !close_sent { c.WriteClose(code, "") }
+	return &CloseError{Code: code, Text: reason}
+}
+
+// Fails the connection with a close frame. See RFC 6455 7.1.7
+func (c *Conn) protocolError(code int, reason string) error {
+	c.WriteClose(code, reason)
+	return &CloseError{Code: code, Text: reason}
+}
+
+func (c *Conn) readFrame() (frame, error) {
+	f := frame{}
+	if c.close_received { return f, io.EOF }
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.br, header); err != nil { return f, err }
+
+	f.fin = header[0] & finalBit != 0
+	f.rsv1 = header[0] & rsv1Bit != 0
+	f.opcode = int(header[0] & 0x0f)
+	masked := header[1] & maskBit != 0
+	length := int64(header[1] & 0x7f)
+
+	if header[0] & (rsv2Bit | rsv3Bit) != 0 || (f.rsv1 && !c.compression) {
+		return f, c.protocolError(CloseProtocolError, "Reserved bits must not be set")
+	}
+	// RFC 6455 5.1
+	// Clients must mask every frame and servers must not mask any frame
+	if masked != c.is_server {
+		return f, c.protocolError(CloseProtocolError, "Invalid frame masking")
+	}
+
+	switch f.opcode {
+	case continuationFrame, TextMessage, BinaryMessage:
+	case CloseMessage, PingMessage, PongMessage:
+		// RFC 6455 5.5
+		// Control frames must not be fragmented and carry at most 125 bytes
+		if !f.fin || length > maxControlFramePayload || f.rsv1 {
+			return f, c.protocolError(CloseProtocolError, "Invalid control frame")
+		}
+	default:
+		return f, c.protocolError(CloseProtocolError, "Unknown opcode")
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.br, ext); err != nil { return f, err }
+		length = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.br, ext); err != nil { return f, err }
+		length = int64(binary.BigEndian.Uint64(ext))
+		if length < 0 {
+			return f, c.protocolError(CloseProtocolError, "Invalid payload length")
+		}
+	}
+	if length > c.max_message_size {
+		return f, c.protocolError(CloseMessageTooBig, "Message exceeds size limit")
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		if _, err := io.ReadFull(c.br, mask); err != nil { return f, err }
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil { return f, err }
+	if masked { maskBytes(mask, f.payload) }
+	return f, nil
+}
+
+func (c *Conn) writeFrame(opcode int, payload []byte, compressed bool) error {
+	c.write_mu.Lock()
+	defer c.write_mu.Unlock()
+	if c.close_sent { return fmt.Errorf("Close frame was already sent") }
+
+	b0 := byte(opcode) | finalBit
+	if compressed { b0 |= rsv1Bit }
+	buf := []byte{b0}
+
+	b1 := byte(0)
+	if !c.is_server { b1 = maskBit }
+	switch length := len(payload); {
+	case length <= 125:
+		buf = append(buf, b1 | byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b1 | 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b1 | 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if c.is_server {
+		buf = append(buf, payload...)
+	} else {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil { return err }
+		buf = append(buf, mask...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(mask, buf[start:])
+	}
+
+	if opcode == CloseMessage { c.close_sent = true }
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func maskBytes(mask []byte, data []byte) {
+	for i := range data { data[i] ^= mask[i%4] }
+}
+
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+	case code >= 1007 && code <= 1014:
+	case code >= 3000 && code <= 4999:
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package websocket
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type readResult struct {
+	message_type int
+	data []byte
+	err error
+}
+
+// Connected over loopback TCP rather than net.Pipe, so writes are buffered
+// by the kernel like on a real connection
+func newPipe(t *testing.T) (*Conn, *Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	b, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	a, err := ln.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return newConn(a, nil, true), newConn(b, nil, false)
+}
+
+func readAsync(c *Conn) chan readResult {
+	ch := make(chan readResult, 1)
+	go func() {
+		message_type, data, err := c.ReadMessage()
+		ch <- readResult{message_type, data, err}
+	}()
+	return ch
+}
+
+// Builds a masked client frame
+func rawFrame(b0 byte, payload string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	buf := []byte{b0, maskBit | byte(len(payload))}
+	buf = append(buf, mask...)
+	data := []byte(payload)
+	maskBytes(mask, data)
+	return append(buf, data...)
+}
+
+func TestComputeAcceptKey(t *testing.T) {
+	// Example from RFC 6455 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestOffersDeflate(t *testing.T) {
+	assert.True(t, offersDeflate("permessage-deflate"))
+	assert.True(t, offersDeflate("foo, permessage-deflate; client_max_window_bits"))
+	assert.False(t, offersDeflate("permessage-deflate; server_max_window_bits=10"))
+	assert.False(t, offersDeflate("x-webkit-deflate-frame"))
+}
+
+func TestReadWriteMessage(t *testing.T) {
+	// Test: Text message from client to server
+	server, client := newPipe(t)
+	ch := readAsync(server)
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("hello")))
+	res := <-ch
+	require.NoError(t, res.err)
+	assert.Equal(t, TextMessage, res.message_type)
+	assert.Equal(t, "hello", string(res.data))
+
+	// Test: Large binary message from server to client
+	large := []byte(strings.Repeat("x", 70000))
+	ch = readAsync(client)
+	require.NoError(t, server.WriteMessage(BinaryMessage, large))
+	res = <-ch
+	require.NoError(t, res.err)
+	assert.Equal(t, BinaryMessage, res.message_type)
+	assert.Equal(t, large, res.data)
+
+	// Test: Compressed message
+	server, client = newPipe(t)
+	server.compression, client.compression = true, true
+	ch = readAsync(server)
+	require.NoError(t, client.WriteMessage(TextMessage, []byte(strings.Repeat("compress me ", 100))))
+	res = <-ch
+	require.NoError(t, res.err)
+	assert.Equal(t, strings.Repeat("compress me ", 100), string(res.data))
+}
+
+func TestFragmentation(t *testing.T) {
+	// Test: Fragmented message with a ping in between
+	server, client := newPipe(t)
+	ch := readAsync(server)
+	go func() {
+		client.conn.Write(rawFrame(TextMessage, "hel"))
+		client.conn.Write(rawFrame(finalBit | PingMessage, "ping"))
+		client.conn.Write(rawFrame(continuationFrame, "lo "))
+		client.conn.Write(rawFrame(finalBit | continuationFrame, "world"))
+	}()
+	go client.ReadMessage()
+	res := <-ch
+	require.NoError(t, res.err)
+	assert.Equal(t, "hello world", string(res.data))
+
+	// Test: Continuation without a message
+	server, client = newPipe(t)
+	ch = readAsync(server)
+	go client.conn.Write(rawFrame(finalBit | continuationFrame, "oops"))
+	go client.ReadMessage()
+	res = <-ch
+	require.Error(t, res.err)
+	assert.Equal(t, CloseProtocolError, res.err.(*CloseError).Code)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	// Test: Unmasked frame from client
+	server, client := newPipe(t)
+	ch := readAsync(server)
+	go client.conn.Write([]byte{finalBit | TextMessage, 2, 'h', 'i'})
+	close_ch := readAsync(client)
+	res := <-ch
+	require.Error(t, res.err)
+	assert.Equal(t, CloseProtocolError, res.err.(*CloseError).Code)
+	closed := <-close_ch
+	assert.Equal(t, CloseProtocolError, closed.err.(*CloseError).Code)
+
+	// Test: Message bigger than the limit
+	server, client = newPipe(t)
+	server.max_message_size = 4
+	ch = readAsync(server)
+	go client.WriteMessage(TextMessage, []byte("too big"))
+	go client.ReadMessage()
+	res = <-ch
+	require.Error(t, res.err)
+	assert.Equal(t, CloseMessageTooBig, res.err.(*CloseError).Code)
+
+	// Test: Invalid UTF-8 in text message
+	server, client = newPipe(t)
+	ch = readAsync(server)
+	go client.WriteMessage(TextMessage, []byte{0xff, 0xfe})
+	go client.ReadMessage()
+	res = <-ch
+	require.Error(t, res.err)
+	assert.Equal(t, CloseInvalidFramePayloadData, res.err.(*CloseError).Code)
+
+	// Test: Compressed message cut off inside a block
+	compressed, err := compress([]byte("The quick brown fox jumps over the lazy dog"))
+	require.NoError(t, err)
+	_, err = decompress(compressed, 1024)
+	require.NoError(t, err)
+	server, client = newPipe(t)
+	server.compression = true
+	ch = readAsync(server)
+	go client.conn.Write(rawFrame(finalBit | rsv1Bit | BinaryMessage, string(compressed[:len(compressed)/2])))
+	go client.ReadMessage()
+	res = <-ch
+	require.Error(t, res.err)
+	assert.Equal(t, CloseInvalidFramePayloadData, res.err.(*CloseError).Code)
+}
+
+func TestCloseHandshake(t *testing.T) {
+	server, client := newPipe(t)
+	ch := readAsync(server)
+	client_ch := readAsync(client)
+	require.NoError(t, client.WriteClose(CloseNormalClosure, "bye"))
+
+	// Server receives the close and echoes it
+	res := <-ch
+	require.Error(t, res.err)
+	assert.Equal(t, &CloseError{Code: CloseNormalClosure, Text: "bye"}, res.err)
+
+	// Client receives the echo and does not answer again
+	res = <-client_ch
+	require.Error(t, res.err)
+	assert.Equal(t, CloseNormalClosure, res.err.(*CloseError).Code)
+
+	// No more writes after the close handshake
+	require.Error(t, client.WriteMessage(TextMessage, []byte("late")))
+
+	// Test: Registered codes like "try again later" are accepted
+	server, client = newPipe(t)
+	ch = readAsync(server)
+	go client.ReadMessage()
+	require.NoError(t, client.WriteClose(CloseTryAgainLater, "busy"))
+	res = <-ch
+	assert.Equal(t, &CloseError{Code: CloseTryAgainLater, Text: "busy"}, res.err)
+}
+
+func TestIsValidCloseCode(t *testing.T) {
+	for _, code := range []int{1000, 1003, 1007, 1011, 1012, 1013, 1014, 3000, 4999} {
+		assert.True(t, isValidCloseCode(code), code)
+	}
+	for _, code := range []int{999, 1004, 1005, 1006, 1015, 1016, 2999, 5000} {
+		assert.False(t, isValidCloseCode(code), code)
+	}
+}
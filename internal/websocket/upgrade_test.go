@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lieberdev/http/internal/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgrade(t *testing.T) {
+	upgrader := &Upgrader{EnableCompression: true}
+	srv, err := http.ListenAndServe("127.0.0.1:0", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(&w, r)
+		if err != nil { return }
+		defer c.Close()
+		for {
+			message_type, data, err := c.ReadMessage()
+			if err != nil { return }
+			c.WriteMessage(message_type, data)
+		}
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	dial := func(request string) (net.Conn, *bufio.Reader, string) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte(request))
+		require.NoError(t, err)
+		br := bufio.NewReader(conn)
+		response := ""
+		for {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			response += line
+			if line == "\r\n" { break }
+		}
+		return conn, br, response
+	}
+
+	// Test: Successful handshake and echo
+	conn, br, response := dial("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n" +
+		"\r\n")
+	assert.Contains(t, response, "HTTP/1.1 101 Switching Protocols\r\n")
+	assert.Contains(t, response, "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, response, "Sec-WebSocket-Extensions: permessage-deflate")
+
+	client := newConn(conn, br, false)
+	client.compression = true
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("echo")))
+	message_type, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, message_type)
+	assert.Equal(t, "echo", string(data))
+
+	require.NoError(t, client.WriteClose(CloseNormalClosure, ""))
+	_, _, err = client.ReadMessage()
+	assert.Equal(t, CloseNormalClosure, err.(*CloseError).Code)
+
+	// Test: Missing key
+	_, _, response = dial("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"\r\n")
+	assert.Contains(t, response, "HTTP/1.1 400 Bad Request\r\n")
+
+	// Test: Cross origin request
+	_, _, response = dial("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Origin: http://evil.example\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"\r\n")
+	assert.Contains(t, response, "HTTP/1.1 400 Bad Request\r\n")
+
+	// Test: Writer without a connection
+	buf := &bytes.Buffer{}
+	w := http.NewResponseWriter(buf)
+	r, err := http.RequestFromReader(io.NopCloser(strings.NewReader("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"\r\n")))
+	require.NoError(t, err)
+	_, err = upgrader.Upgrade(&w, r)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 400 Bad Request\r\n"))
+}
@@ -0,0 +1,156 @@
+// Package websocket implements the WebSocket protocol (RFC 6455) on top of
+// the http server. Connections are created by upgrading a request inside a
+// handler.
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lieberdev/http/internal/http"
+)
+
+// Message types. See RFC 6455 11.8
+const (
+	TextMessage = 1
+	BinaryMessage = 2
+	CloseMessage = 8
+	PingMessage = 9
+	PongMessage = 10
+)
+
+// Close codes. See RFC 6455 7.4.1 and the IANA WebSocket Close Code Number
+// Registry for 1012 to 1014
+const (
+	CloseNormalClosure = 1000
+	CloseGoingAway = 1001
+	CloseProtocolError = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatusReceived = 1005
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig = 1009
+	CloseInternalServerErr = 1011
+	CloseServiceRestart = 1012
+	CloseTryAgainLater = 1013
+	CloseBadGateway = 1014
+)
+
+const DefaultMaxMessageSize = 32 << 20
+
+// Appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Returned by ReadMessage once the close handshake has happened
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Text)
+}
+
+type Upgrader struct {
+	// Limit for a single message after reassembling fragments and
+	// decompressing. Defaults to DefaultMaxMessageSize
+	MaxMessageSize int64
+	// Negotiate permessage-deflate (RFC 7692) if the client offers it
+	EnableCompression bool
+	// Decides if the Origin header is acceptable. By default the origin
+	// host has to match the Host header
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Performs the opening handshake and takes over the connection. On failure
+// an error response is written and the error is returned.
+// See RFC 6455 4.2
+func (u *Upgrader) Upgrade(w *http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.StatusLine.Method != "GET" {
+		return nil, u.fail(w, "Method must be GET to upgrade")
+	}
+	if !http.HeaderHasToken(r.Headers.Get("connection"), "upgrade") {
+		return nil, u.fail(w, "Connection header must contain upgrade")
+	}
+	if !http.HeaderHasToken(r.Headers.Get("upgrade"), "websocket") {
+		return nil, u.fail(w, "Upgrade header must contain websocket")
+	}
+	if r.Headers.Get("sec-websocket-version") != "13" {
+		w.Headers.Set("Sec-WebSocket-Version", "13")
+		return nil, u.fail(w, "Unsupported websocket version")
+	}
+	key := r.Headers.Get("sec-websocket-key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, u.fail(w, "Invalid Sec-WebSocket-Key")
+	}
+	check_origin := u.CheckOrigin
+	if check_origin == nil { check_origin = sameOrigin }
+	if !check_origin(r) {
+		return nil, u.fail(w, "Origin not allowed")
+	}
+
+	// Fails for writers not backed by a connection, e.g. a recorder
+	conn, brw, err := w.Hijack()
+	if err != nil { return nil, u.fail(w, err.Error()) }
+
+	compress := u.EnableCompression && offersDeflate(r.Headers.Get("sec-websocket-extensions"))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n"
+	if compress {
+		resp += "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n"
+	}
+	resp += "\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := newConn(conn, brw.Reader, true)
+	c.compression = compress
+	if u.MaxMessageSize > 0 { c.max_message_size = u.MaxMessageSize }
+	return c, nil
+}
+
+func (u *Upgrader) fail(w *http.ResponseWriter, reason string) error {
+	w.WriteStatusLine(http.StatusBadRequest)
+	w.Headers.Set("Content-Type", "text/plain")
+	w.WriteHeaders(nil)
+	w.WriteBody([]byte(reason))
+	return fmt.Errorf("websocket: %s", reason)
+}
+
+func computeAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Only offers that we can honour are accepted. We can not limit our window
+// size, so offers with server_max_window_bits are skipped. See RFC 7692 7.1
+func offersDeflate(value string) bool {
+	for _, ext := range strings.Split(value, ",") {
+		params := strings.Split(ext, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" { continue }
+		ok := true
+		for _, param := range params[1:] {
+			name, bits, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name != "server_max_window_bits" { continue }
+			if n, err := strconv.Atoi(strings.Trim(bits, "\"")); err != nil || n != 15 { ok = false }
+		}
+		if ok { return true }
+	}
+	return false
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Headers.Get("origin")
+	if origin == "" { return true }
+	u, err := url.Parse(origin)
+	if err != nil { return false }
+	return strings.EqualFold(u.Host, r.Headers.Get("host"))
+}